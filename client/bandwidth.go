@@ -0,0 +1,204 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync_server/share"
+	"time"
+)
+
+const (
+	// reads and writes of a limited connection are split into pieces this big so the limit stays smooth
+	limitedChunkSize = 32 * 1024
+	// longest a transfer sleeps at once, a limit changed meanwhile applies once it wakes up
+	maxLimitWait = 250 * time.Millisecond
+	windowLayout = "15:04"
+)
+
+// tokenBucket lets through rate bytes per second with bursts of up to a second, a zero rate lets everything through.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) setRate(kib int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = float64(max(kib, 0) * 1024)
+	b.tokens = 0
+	b.last = time.Now()
+}
+
+// take blocks until n bytes may go through, it's shared by every transfer in the same direction.
+func (b *tokenBucket) take(n int) {
+	for n > 0 {
+		b.mu.Lock()
+		if b.rate <= 0 {
+			b.mu.Unlock()
+			return
+		}
+		now := time.Now()
+		b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+		want := min(float64(n), b.rate)
+		if b.tokens >= want {
+			b.tokens -= want
+			n -= int(want)
+			b.mu.Unlock()
+			continue
+		}
+		wait := time.Duration((want - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+		time.Sleep(min(wait, maxLimitWait))
+	}
+}
+
+// limitedConn is a transfer connection holding to the bandwidth limits.
+type limitedConn struct {
+	net.Conn
+	upload   *tokenBucket
+	download *tokenBucket
+}
+
+func (c limitedConn) Read(p []byte) (int, error) {
+	if len(p) > limitedChunkSize {
+		p = p[:limitedChunkSize]
+	}
+	n, err := c.Conn.Read(p)
+	c.download.take(n)
+	return n, err
+}
+
+func (c limitedConn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := p[written:min(written+limitedChunkSize, len(p))]
+		c.upload.take(len(chunk))
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// bandwidth holds the limits of the client and the sync windows replacing them at times.
+type bandwidth struct {
+	mu       sync.Mutex
+	limit    share.BandwidthLimit
+	windows  []share.SyncWindow
+	upload   tokenBucket
+	download tokenBucket
+}
+
+func newBandwidth(limit share.BandwidthLimit, windows []share.SyncWindow) *bandwidth {
+	b := &bandwidth{limit: limit, windows: windows}
+	b.apply()
+	return b
+}
+
+// BandwidthStatus is what the http api shows of the limits, Active being the ones applied right now.
+type BandwidthStatus struct {
+	share.BandwidthLimit
+	SyncWindows []share.SyncWindow   `json:"sync_windows"`
+	Window      *share.SyncWindow    `json:"window,omitempty"`
+	Active      share.BandwidthLimit `json:"active"`
+}
+
+// active returns the limits applying at now and the window they come from, the first window matching wins.
+func (b *bandwidth) active(now time.Time) (share.BandwidthLimit, *share.SyncWindow) {
+	minute := now.Hour()*60 + now.Minute()
+	for i, window := range b.windows {
+		start, startErr := windowMinute(window.Start)
+		end, endErr := windowMinute(window.End)
+		if startErr != nil || endErr != nil {
+			continue
+		}
+		if start <= end && minute >= start && minute < end ||
+			start > end && (minute >= start || minute < end) {
+			return window.BandwidthLimit, &b.windows[i]
+		}
+	}
+	return b.limit, nil
+}
+
+// apply sets the limits of the current time, it runs every minute to follow the sync windows.
+func (b *bandwidth) apply() {
+	b.mu.Lock()
+	limit, _ := b.active(time.Now())
+	b.mu.Unlock()
+	b.upload.setRate(limit.UploadLimit)
+	b.download.setRate(limit.DownloadLimit)
+}
+
+func (b *bandwidth) set(limit share.BandwidthLimit, windows []share.SyncWindow) {
+	b.mu.Lock()
+	b.limit, b.windows = limit, windows
+	b.mu.Unlock()
+	b.apply()
+}
+
+func (b *bandwidth) status() BandwidthStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	active, window := b.active(time.Now())
+	return BandwidthStatus{BandwidthLimit: b.limit, SyncWindows: b.windows, Window: window, Active: active}
+}
+
+// limited wraps a transfer connection into the limits.
+func (b *bandwidth) limited(conn net.Conn) net.Conn {
+	return limitedConn{Conn: conn, upload: &b.upload, download: &b.download}
+}
+
+func windowMinute(value string) (int, error) {
+	t, err := time.Parse(windowLayout, value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid sync window time %q, expected HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// SetBandwidth replaces the limits and sync windows and writes them to client.yaml.
+func (s *SyncService) SetBandwidth(limit share.BandwidthLimit, windows []share.SyncWindow) error {
+	if limit.UploadLimit < 0 || limit.DownloadLimit < 0 {
+		return fmt.Errorf("limits can't be negative")
+	}
+	if windows == nil {
+		windows = []share.SyncWindow{}
+	}
+	config := make([]map[string]any, len(windows))
+	for i, window := range windows {
+		if _, err := windowMinute(window.Start); err != nil {
+			return err
+		}
+		if _, err := windowMinute(window.End); err != nil {
+			return err
+		}
+		if window.UploadLimit < 0 || window.DownloadLimit < 0 {
+			return fmt.Errorf("limits can't be negative")
+		}
+		config[i] = map[string]any{
+			"start":          window.Start,
+			"end":            window.End,
+			"upload_limit":   window.UploadLimit,
+			"download_limit": window.DownloadLimit,
+		}
+	}
+	s.bandwidth.set(limit, windows)
+	s.Cfg.BandwidthLimit, s.Cfg.SyncWindows = limit, windows
+	if err := share.SetClientConfig("upload_limit", limit.UploadLimit); err != nil {
+		return err
+	}
+	if err := share.SetClientConfig("download_limit", limit.DownloadLimit); err != nil {
+		return err
+	}
+	return share.SetClientConfig("sync_windows", config)
+}
+
+func (s *SyncService) Bandwidth() BandwidthStatus {
+	return s.bandwidth.status()
+}
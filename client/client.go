@@ -1,8 +1,11 @@
 package client
 
 import (
+	"io/fs"
 	"log/slog"
+	"os"
 	"path/filepath"
+	"strings"
 	"sync_server/share"
 	"time"
 
@@ -18,10 +21,11 @@ type Client struct {
 
 // server will run in background and will have a listening port on custome port to execute commands
 func NewClient(cfg *share.ClientConfig) *Client {
+	syncService := NewSyncService(cfg)
 	return &Client{
 		Cfg:          cfg,
-		HttpListener: NewHttpListener(cfg),
-		SyncService:  NewSyncService(cfg),
+		HttpListener: NewHttpListener(cfg, syncService),
+		SyncService:  syncService,
 	}
 }
 func (c *Client) Start() error {
@@ -52,24 +56,101 @@ func (c *Client) Sync() {
 			panic(err)
 		}
 	}
+	closes, err := newCloseWatcher()
+	if err != nil {
+		panic(err)
+	}
+	defer closes.Close()
+	// fsnotify doesn't watch recursively, every folder is watched on its own
+	watch := func(dir string) {
+		if err := watcher.Add(dir); err != nil {
+			slog.Error("Error watching folder", "path", dir, "err", err)
+		}
+		if err := closes.Add(dir); err != nil {
+			slog.Error("Error watching folder for closed files", "path", dir, "err", err)
+		}
+	}
+	moves := newMoveDetector(c.SyncService)
+	moves.index(c.Cfg.SyncDirs)
+	for dir := range moves.dirs {
+		watch(dir)
+	}
+	stability := newStabilityDetector(c.Cfg.QuietPeriod)
+	ticker := time.NewTicker(renamePairWindow)
+	defer ticker.Stop()
+	stabilityTicker := time.NewTicker(stability.checkInterval())
+	defer stabilityTicker.Stop()
 	for {
 		select {
 		case event, ok := <-watcher.Events:
 			if !ok {
 				return
 			}
-			if event.Has(fsnotify.Write) || event.Has(fsnotify.Rename) || event.Has(fsnotify.Create) || event.Has(fsnotify.Remove) {
-				parentDir := filepath.Dir(event.Name)
-				fileName := filepath.Base(event.Name)
-
-				c.SyncService.ChangeChan <- ChangeEvent{
-					File: share.ChangeRequestChange{
-						FileName:    fileName,
-						ChangeEvent: event.Op.String(),
-					},
-					Dir:  parentDir,
-					Time: time.Now(),
+			if strings.HasSuffix(event.Name, share.PartialSuffix) {
+				continue
+			}
+			// the device doesn't hold excluded subtrees, removing the local copies mustn't delete them remotely
+			if !c.watched(event.Name) {
+				continue
+			}
+			if c.SyncService.OwnWrite(event.Name) {
+				c.applied(watch, moves, stability, event)
+				continue
+			}
+			switch {
+			case event.Has(fsnotify.Rename):
+				stability.forget(event.Name)
+				moves.renamed(event.Name)
+			case event.Has(fsnotify.Remove):
+				stability.forget(event.Name)
+				c.changed(event.Name, moves.removed(event.Name))
+			case event.Has(fsnotify.Create):
+				if info, err := os.Lstat(event.Name); err == nil && info.IsDir() {
+					if oldPath, moved := moves.paired(event.Name); moved {
+						c.movedDir(watch, moves, stability, oldPath, event.Name)
+					} else {
+						c.createdDir(watch, moves, stability, event.Name)
+					}
+					continue
+				}
+				change := share.ChangeRequestChange{FileName: filepath.Base(event.Name), ChangeEvent: event.Op.String()}
+				oldPath, moved := moves.paired(event.Name)
+				moves.seen(event.Name)
+				if !moved {
+					stability.track(event.Name, change)
+					continue
+				}
+				// a rename doesn't write, the moved file is complete
+				change.ChangeEvent, change.OldPath = share.MoveChange, oldPath
+				change.Digest, _ = share.FileDigest(event.Name)
+				c.changed(event.Name, change)
+			case event.Has(fsnotify.Write):
+				if moves.isDir(event.Name) {
+					continue
 				}
+				moves.seen(event.Name)
+				stability.track(event.Name, share.ChangeRequestChange{FileName: filepath.Base(event.Name), ChangeEvent: event.Op.String()})
+			case event.Has(fsnotify.Chmod):
+				// a file still being written sends its metadata along with its content
+				if moves.isDir(event.Name) || stability.tracked(event.Name) {
+					continue
+				}
+				c.changed(event.Name, share.ChangeRequestChange{FileName: filepath.Base(event.Name), ChangeEvent: share.MetadataChange})
+			}
+		case path, ok := <-closes.Events():
+			if !ok {
+				return
+			}
+			if change, ok := stability.closed(path); ok {
+				c.changed(path, change)
+			}
+		case <-stabilityTicker.C:
+			for path, change := range stability.stable() {
+				c.changed(path, change)
+			}
+		case <-ticker.C:
+			for _, path := range moves.expired() {
+				c.changed(path, moves.removed(path))
 			}
 		case err, ok := <-watcher.Errors:
 			if !ok {
@@ -79,3 +160,102 @@ func (c *Client) Sync() {
 		}
 	}
 }
+
+func (c *Client) watched(path string) bool {
+	return !c.SyncService.Excluded(path) && !c.SyncService.Ignored(path).Ignored
+}
+
+// changed queues the change, every change leaving a file at path carries its metadata.
+func (c *Client) changed(path string, change share.ChangeRequestChange) {
+	switch change.ChangeEvent {
+	case "REMOVE", share.DirCreateChange, share.DirRemoveChange:
+	default:
+		metadata, ok := c.SyncService.localMetadata(path)
+		if !ok {
+			return
+		}
+		change.Metadata = metadata
+	}
+	c.SyncService.Enqueue(ChangeEvent{
+		File: change,
+		Dir:  filepath.Dir(path),
+		Time: time.Now(),
+	})
+}
+
+// applied keeps track of a path the client changed itself to apply a change of another device,
+// nothing is sent back for it.
+func (c *Client) applied(watch func(dir string), moves *moveDetector, stability *stabilityDetector, event fsnotify.Event) {
+	stability.forget(event.Name)
+	if event.Has(fsnotify.Rename) || event.Has(fsnotify.Remove) {
+		moves.forget(event.Name)
+		return
+	}
+	filepath.WalkDir(event.Name, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !c.watched(path) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		moves.seen(path)
+		if d.IsDir() {
+			watch(path)
+		}
+		return nil
+	})
+}
+
+// createdDir watches a new folder and syncs what it already holds, a folder moved in arrives with its content.
+func (c *Client) createdDir(watch func(dir string), moves *moveDetector, stability *stabilityDetector, dir string) {
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !c.watched(path) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		moves.seen(path)
+		if !d.IsDir() {
+			stability.track(path, share.ChangeRequestChange{FileName: d.Name(), ChangeEvent: "CREATE"})
+			return nil
+		}
+		watch(path)
+		c.changed(path, share.ChangeRequestChange{FileName: d.Name(), ChangeEvent: share.DirCreateChange})
+		return nil
+	})
+}
+
+// movedDir watches a folder renamed inside the sync folders and sends the rename as a single move,
+// the server moves what it stores under the old path so nothing is uploaded again.
+func (c *Client) movedDir(watch func(dir string), moves *moveDetector, stability *stabilityDetector, oldPath string, dir string) {
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !c.watched(path) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		moves.seen(path)
+		if d.IsDir() {
+			watch(path)
+			return nil
+		}
+		// a file still being written when its folder was renamed is sent once it settles under its new path
+		if old := oldPath + strings.TrimPrefix(path, dir); stability.tracked(old) {
+			stability.forget(old)
+			stability.track(path, share.ChangeRequestChange{FileName: d.Name(), ChangeEvent: "CREATE"})
+		}
+		return nil
+	})
+	c.changed(dir, share.ChangeRequestChange{FileName: filepath.Base(dir), ChangeEvent: share.MoveChange, OldPath: oldPath, Dir: true})
+}
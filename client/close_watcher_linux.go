@@ -0,0 +1,102 @@
+//go:build linux
+
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// closeWatcher reports the files a writer closed, fsnotify doesn't expose IN_CLOSE_WRITE so it has its own inotify instance.
+// The instance is nonblocking and read through the runtime poller, so closing it wakes the pending read.
+type closeWatcher struct {
+	fd     int
+	file   *os.File
+	mu     sync.Mutex
+	dirs   map[int32]string
+	events chan string
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newCloseWatcher() (*closeWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	w := &closeWatcher{
+		fd:     fd,
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		dirs:   make(map[int32]string),
+		events: make(chan string, 100),
+		done:   make(chan struct{}),
+	}
+	go w.read()
+	return w, nil
+}
+
+func (w *closeWatcher) Add(dir string) error {
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, syscall.IN_CLOSE_WRITE)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	w.dirs[int32(wd)] = dir
+	w.mu.Unlock()
+	return nil
+}
+
+func (w *closeWatcher) Events() <-chan string {
+	return w.events
+}
+
+func (w *closeWatcher) Close() error {
+	err := os.ErrClosed
+	w.once.Do(func() {
+		close(w.done)
+		err = w.file.Close()
+	})
+	return err
+}
+
+func (w *closeWatcher) read() {
+	defer close(w.events)
+	buf := make([]byte, 4096*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buf)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil || n <= 0 {
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			wd := int32(binary.NativeEndian.Uint32(buf[offset:]))
+			mask := binary.NativeEndian.Uint32(buf[offset+4:])
+			nameLen := int(binary.NativeEndian.Uint32(buf[offset+12:]))
+			start := offset + syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[start:start+nameLen]), "\x00")
+			offset = start + nameLen
+
+			w.mu.Lock()
+			dir := w.dirs[wd]
+			if mask&syscall.IN_IGNORED != 0 {
+				delete(w.dirs, wd)
+			}
+			w.mu.Unlock()
+			if mask&syscall.IN_CLOSE_WRITE == 0 || dir == "" || name == "" {
+				continue
+			}
+			select {
+			case w.events <- filepath.Join(dir, name):
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package client
+
+// closeWatcher only exists on linux, elsewhere files are only considered stable after the quiet period.
+type closeWatcher struct{}
+
+func newCloseWatcher() (*closeWatcher, error) {
+	return &closeWatcher{}, nil
+}
+
+func (w *closeWatcher) Add(dir string) error {
+	return nil
+}
+
+// Events never delivers, a nil channel blocks forever.
+func (w *closeWatcher) Events() <-chan string {
+	return nil
+}
+
+func (w *closeWatcher) Close() error {
+	return nil
+}
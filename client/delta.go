@@ -0,0 +1,98 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime"
+	"sync_server/share"
+	"time"
+)
+
+// deltaBase is the local copy a delta download is applied to.
+type deltaBase struct {
+	file *os.File
+	sig  share.Signature
+}
+
+// hasDeltaBase tells whether the local copy of filePath is worth sending a signature for instead of downloading it whole.
+func hasDeltaBase(filePath string) bool {
+	size, err := share.GetSize(filePath)
+	return err == nil && size >= share.DeltaMinSize
+}
+
+func openDeltaBase(filePath string) (*deltaBase, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	sig, err := share.ComputeSignature(file, share.DeltaBlockSize(stat.Size()))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &deltaBase{file: file, sig: sig}, nil
+}
+
+func (b *deltaBase) Close() error {
+	return b.file.Close()
+}
+
+// remoteSignature fetches the block signature of the version the server has, a delta upload is computed against it.
+// Without one the whole file is sent as literal data, which the server accepts just the same.
+func (s *SyncService) remoteSignature(filePath string, size int64) share.Signature {
+	empty := share.Signature{BlockSize: share.DeltaBlockSize(size)}
+	req, _ := json.Marshal(share.SignatureRequest{
+		ClientRequest: share.ClientRequest{ClientId: s.Cfg.ClientId, Time: time.Now(), Agent: runtime.GOOS},
+		FilePath:      s.remotePath(filePath),
+	})
+	msg, err := s.NatsConn.RequestToSubject("file-signature", req, 10*time.Second)
+	if err != nil {
+		return empty
+	}
+	var res share.ServerResponse
+	if err := json.Unmarshal(msg.Data, &res); err != nil || res.Status != share.Success {
+		slog.Error("Error fetching file signature", "path", filePath, "response", res.Data)
+		return empty
+	}
+	var sig share.Signature
+	if err := json.Unmarshal([]byte(res.Data), &sig); err != nil {
+		slog.Error("Error unmarshaling file signature", "err", err)
+		return empty
+	}
+	return sig
+}
+
+// deltaSource streams the delta of the file against sig.
+func deltaSource(file io.Reader, sig share.Signature) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(share.WriteDelta(pw, sig, file))
+	}()
+	return pr
+}
+
+// deltaSink rebuilds the file into partial out of base and whatever delta is written to it.
+// The returned wait function reports the result once the writer is closed.
+func deltaSink(partial io.Writer, base *deltaBase) (io.WriteCloser, func() error) {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := share.ApplyDelta(partial, base.file, base.sig.BlockSize, pr)
+		pr.CloseWithError(err)
+		done <- err
+	}()
+	return pw, func() error {
+		if err := <-done; err != nil {
+			return fmt.Errorf("applying delta: %w", err)
+		}
+		return nil
+	}
+}
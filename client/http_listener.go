@@ -2,16 +2,18 @@ package client
 
 import (
 	"sync_server/share"
+	"time"
 
 	"github.com/labstack/echo/v4"
 )
 
 type HttpServer struct {
-	Cfg *share.ClientConfig
+	Cfg         *share.ClientConfig
+	SyncService *SyncService
 }
 
-func NewHttpListener(cfg *share.ClientConfig) *HttpServer {
-	return &HttpServer{Cfg: cfg}
+func NewHttpListener(cfg *share.ClientConfig, syncService *SyncService) *HttpServer {
+	return &HttpServer{Cfg: cfg, SyncService: syncService}
 }
 
 func (h *HttpServer) Listen() error {
@@ -42,8 +44,156 @@ func (h *HttpServer) Listen() error {
 			"dirs": newDirs,
 		})
 	})
+	trashGroup := e.Group("trash")
+	trashGroup.GET("", func(c echo.Context) error {
+		entries, err := h.SyncService.ListTrash()
+		if err != nil {
+			return c.JSON(500, map[string]string{"error": err.Error()})
+		}
+		return c.JSON(200, entries)
+	})
+	trashGroup.POST("/restore", func(c echo.Context) error {
+		entry, err := h.SyncService.RestoreTrash(c.QueryParam("id"))
+		if err != nil {
+			return c.JSON(500, map[string]string{"error": err.Error()})
+		}
+		return c.JSON(200, entry)
+	})
+	trashGroup.DELETE("", func(c echo.Context) error {
+		res, err := h.SyncService.PurgeTrash(c.QueryParam("id"))
+		if err != nil {
+			return c.JSON(500, map[string]string{"error": err.Error()})
+		}
+		return c.JSON(200, map[string]string{"result": res})
+	})
+	e.GET("/ignored", func(c echo.Context) error {
+		return c.JSON(200, h.SyncService.Ignored(c.QueryParam("path")))
+	})
+	selectiveGroup := e.Group("selective-sync")
+	selectiveGroup.GET("", func(c echo.Context) error {
+		return c.JSON(200, map[string][]string{"excluded": h.SyncService.ExcludedPaths()})
+	})
+	selectiveGroup.POST("", func(c echo.Context) error {
+		kept, err := h.SyncService.ExcludePath(c.QueryParam("path"))
+		if err != nil {
+			return c.JSON(500, map[string]interface{}{"error": err.Error(), "kept": kept})
+		}
+		return c.JSON(200, map[string]interface{}{"excluded": h.SyncService.ExcludedPaths(), "kept": kept})
+	})
+	selectiveGroup.DELETE("", func(c echo.Context) error {
+		downloaded, failed, err := h.SyncService.IncludePath(c.QueryParam("path"))
+		if err != nil {
+			return c.JSON(500, map[string]string{"error": err.Error()})
+		}
+		return c.JSON(200, map[string]interface{}{"excluded": h.SyncService.ExcludedPaths(), "downloaded": downloaded, "failed": failed})
+	})
+	transfersGroup := e.Group("transfers")
+	transfersGroup.GET("", func(c echo.Context) error {
+		return c.JSON(200, h.SyncService.transfers.Status())
+	})
+	transfersGroup.POST("/retry", func(c echo.Context) error {
+		err := h.SyncService.transfers.Retry(TransferKind(c.QueryParam("kind")), c.QueryParam("path"))
+		if err != nil {
+			return c.JSON(404, map[string]string{"error": err.Error()})
+		}
+		return c.JSON(200, h.SyncService.transfers.Status())
+	})
+	e.GET("/bandwidth", func(c echo.Context) error {
+		return c.JSON(200, h.SyncService.Bandwidth())
+	})
+	// replaces the limits, the body is {"upload_limit": KiB/s, "download_limit": KiB/s, "sync_windows": [...]}
+	e.PUT("/bandwidth", func(c echo.Context) error {
+		var body struct {
+			share.BandwidthLimit
+			SyncWindows []share.SyncWindow `json:"sync_windows"`
+		}
+		if err := c.Bind(&body); err != nil {
+			return c.JSON(400, map[string]string{"error": err.Error()})
+		}
+		if err := h.SyncService.SetBandwidth(body.BandwidthLimit, body.SyncWindows); err != nil {
+			return c.JSON(400, map[string]string{"error": err.Error()})
+		}
+		return c.JSON(200, h.SyncService.Bandwidth())
+	})
+	remoteGroup := e.Group("remote")
+	remoteGroup.GET("", func(c echo.Context) error {
+		entries, err := h.SyncService.ListRemote(c.QueryParam("path"))
+		if err != nil {
+			return c.JSON(500, map[string]string{"error": err.Error()})
+		}
+		return c.JSON(200, entries)
+	})
+	// downloads only the requested files or subtrees, the body is {"paths": [...]}
+	remoteGroup.POST("/download", func(c echo.Context) error {
+		var body struct {
+			Paths []string `json:"paths"`
+		}
+		if err := c.Bind(&body); err != nil || len(body.Paths) == 0 {
+			return c.JSON(400, map[string]string{"error": "paths are required"})
+		}
+		downloaded, failed := h.SyncService.DownloadRemote(body.Paths)
+		status := 200
+		if len(failed) > 0 {
+			status = 500
+		}
+		return c.JSON(status, map[string]interface{}{
+			"downloaded": downloaded,
+			"failed":     failed,
+		})
+	})
+	snapshotGroup := e.Group("snapshots")
+	snapshotGroup.GET("", func(c echo.Context) error {
+		snapshots, err := h.SyncService.ListSnapshots(c.QueryParam("dir"))
+		if err != nil {
+			return c.JSON(500, map[string]string{"error": err.Error()})
+		}
+		return c.JSON(200, snapshots)
+	})
+	snapshotGroup.POST("", func(c echo.Context) error {
+		at, err := queryTime(c, "at")
+		if err != nil {
+			return c.JSON(400, map[string]string{"error": err.Error()})
+		}
+		snapshot, err := h.SyncService.CreateSnapshot(c.QueryParam("name"), c.QueryParam("dir"), at)
+		if err != nil {
+			return c.JSON(500, map[string]string{"error": err.Error()})
+		}
+		return c.JSON(200, snapshot)
+	})
+	snapshotGroup.GET("/files", func(c echo.Context) error {
+		at, err := queryTime(c, "at")
+		if err != nil {
+			return c.JSON(400, map[string]string{"error": err.Error()})
+		}
+		files, err := h.SyncService.SnapshotFiles(c.QueryParam("name"), c.QueryParam("dir"), at)
+		if err != nil {
+			return c.JSON(500, map[string]string{"error": err.Error()})
+		}
+		return c.JSON(200, files)
+	})
+	// restores a named snapshot, or dir as it was at a time, into the live folder or under target
+	snapshotGroup.POST("/restore", func(c echo.Context) error {
+		at, err := queryTime(c, "at")
+		if err != nil {
+			return c.JSON(400, map[string]string{"error": err.Error()})
+		}
+		restored, err := h.SyncService.RestoreSnapshot(c.QueryParam("name"), c.QueryParam("dir"), at, c.QueryParam("target"))
+		if err != nil {
+			return c.JSON(500, map[string]interface{}{"error": err.Error(), "restored": restored})
+		}
+		return c.JSON(200, map[string]int{"restored": restored})
+	})
 	return e.Start(":" + h.Cfg.HttpPort)
 }
+
+// queryTime parses an RFC3339 query parameter, a missing one is the zero time.
+func queryTime(c echo.Context, name string) (time.Time, error) {
+	value := c.QueryParam(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
 func remove(s []string, r string) []string {
 	for i, v := range s {
 		if v == r {
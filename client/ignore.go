@@ -0,0 +1,248 @@
+package client
+
+import (
+	"bufio"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IgnoreFile holds gitignore style patterns for the folder it's in and everything below it.
+const IgnoreFile = ".syncignore"
+
+// globalIgnoreSource is reported for matches of the patterns configured in client.yaml
+const globalIgnoreSource = "client.yaml"
+
+type ignoreRule struct {
+	pattern string
+	source  string
+	line    int
+	// the patterns are relative to this folder
+	base    string
+	negate  bool
+	dirOnly bool
+	re      *regexp.Regexp
+}
+
+// IgnoreMatch tells whether a path is ignored and which rule decided it.
+type IgnoreMatch struct {
+	Path    string `json:"path"`
+	Ignored bool   `json:"ignored"`
+	// the matching pattern, empty if no rule matched
+	Rule   string `json:"rule,omitempty"`
+	Source string `json:"source,omitempty"`
+	Line   int    `json:"line,omitempty"`
+	// the ignored parent folder when the path is ignored because of it
+	Parent string `json:"parent,omitempty"`
+}
+
+type ignoreFileRules struct {
+	modified time.Time
+	rules    []ignoreRule
+}
+
+// ignoreRules caches the parsed ignore files, a file is parsed again once it's modified.
+// The global patterns are compiled once and again only when the configured ones change.
+type ignoreRules struct {
+	sync.Mutex
+	files map[string]ignoreFileRules
+	// the configured patterns the global rules were compiled from
+	patterns []string
+	global   []ignoreRule
+}
+
+// parseIgnorePattern turns a gitignore pattern into a rule, blank lines and comments give no rule.
+func parseIgnorePattern(pattern string, base string, source string, line int) (ignoreRule, bool) {
+	rule := ignoreRule{pattern: pattern, source: source, line: line, base: base}
+	if !strings.HasSuffix(pattern, "\\ ") {
+		pattern = strings.TrimRight(pattern, " \t")
+	}
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return rule, false
+	}
+	if strings.HasPrefix(pattern, "!") {
+		rule.negate = true
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, "\\!") || strings.HasPrefix(pattern, "\\#") {
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		rule.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if pattern == "" {
+		return rule, false
+	}
+	// a pattern with a slash other than a trailing one is relative to the base, otherwise it matches at any level
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	var expr strings.Builder
+	if anchored {
+		expr.WriteString("^")
+	} else {
+		expr.WriteString("^(?:.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			expr.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "/**") && i+3 == len(pattern):
+			expr.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			expr.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				expr.WriteString("\\[")
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		slog.Warn("Invalid ignore pattern", "pattern", rule.pattern, "source", source, "err", err)
+		return rule, false
+	}
+	rule.re = re
+	return rule, true
+}
+
+func (r ignoreRule) matches(path string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	rel, err := filepath.Rel(r.base, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return false
+	}
+	return r.re.MatchString(filepath.ToSlash(rel))
+}
+
+// fileRules returns the rules of the ignore file in dir, if there is one.
+func (s *SyncService) fileRules(dir string) []ignoreRule {
+	filePath := filepath.Join(dir, IgnoreFile)
+	info, err := os.Stat(filePath)
+	s.ignore.Lock()
+	defer s.ignore.Unlock()
+	if s.ignore.files == nil {
+		s.ignore.files = make(map[string]ignoreFileRules)
+	}
+	if err != nil {
+		delete(s.ignore.files, dir)
+		return nil
+	}
+	if cached, ok := s.ignore.files[dir]; ok && cached.modified.Equal(info.ModTime()) {
+		return cached.rules
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	rules := []ignoreRule{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if rule, ok := parseIgnorePattern(scanner.Text(), dir, filePath, line); ok {
+			rules = append(rules, rule)
+		}
+	}
+	s.ignore.files[dir] = ignoreFileRules{modified: info.ModTime(), rules: rules}
+	return rules
+}
+
+// globalRules returns the rules of the configured patterns relative to the sync folder root.
+func (s *SyncService) globalRules(root string) []ignoreRule {
+	s.ignore.Lock()
+	defer s.ignore.Unlock()
+	if s.ignore.global == nil || !slices.Equal(s.ignore.patterns, s.Cfg.IgnorePatterns) {
+		s.ignore.patterns = slices.Clone(s.Cfg.IgnorePatterns)
+		s.ignore.global = []ignoreRule{}
+		for i, pattern := range s.ignore.patterns {
+			if rule, ok := parseIgnorePattern(pattern, "", globalIgnoreSource, i+1); ok {
+				s.ignore.global = append(s.ignore.global, rule)
+			}
+		}
+	}
+	rules := slices.Clone(s.ignore.global)
+	for i := range rules {
+		rules[i].base = root
+	}
+	return rules
+}
+
+// syncRoot returns the sync folder containing the path.
+func (s *SyncService) syncRoot(path string) (string, bool) {
+	root := ""
+	for _, dir := range s.Cfg.SyncDirs {
+		dir = filepath.Clean(dir)
+		if underPath(path, dir) && len(dir) > len(root) {
+			root = dir
+		}
+	}
+	return root, root != ""
+}
+
+// match applies the rules in order, the last matching rule decides like in gitignore.
+func match(rules []ignoreRule, path string, isDir bool) IgnoreMatch {
+	res := IgnoreMatch{Path: path}
+	for _, rule := range rules {
+		if rule.matches(path, isDir) {
+			res.Ignored = !rule.negate
+			res.Rule, res.Source, res.Line = rule.pattern, rule.source, rule.line
+		}
+	}
+	return res
+}
+
+// Ignored checks the path against the global patterns and the ignore files from its sync folder down to its parent.
+// A path inside an ignored folder is ignored whatever the deeper rules say, as in gitignore.
+func (s *SyncService) Ignored(path string) IgnoreMatch {
+	path = filepath.Clean(path)
+	root, ok := s.syncRoot(path)
+	if !ok || path == root {
+		return IgnoreMatch{Path: path}
+	}
+	rules := s.globalRules(root)
+	rel, _ := filepath.Rel(root, path)
+	parts := strings.Split(rel, string(filepath.Separator))
+	dir := root
+	for i, part := range parts {
+		rules = append(rules, s.fileRules(dir)...)
+		dir = filepath.Join(dir, part)
+		if i == len(parts)-1 {
+			break
+		}
+		if res := match(rules, dir, true); res.Ignored {
+			res.Path, res.Parent = path, dir
+			return res
+		}
+	}
+	info, err := os.Stat(path)
+	return match(rules, path, err == nil && info.IsDir())
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"sync_server/share"
+	"testing"
+)
+
+func TestParseIgnorePattern(t *testing.T) {
+	const base = "/sync"
+	tests := []struct {
+		pattern string
+		path    string
+		isDir   bool
+		want    bool
+	}{
+		{"*.log", "/sync/a.log", false, true},
+		{"*.log", "/sync/deep/down/a.log", false, true},
+		{"*.log", "/sync/a.logs", false, false},
+		{"/build", "/sync/build", true, true},
+		{"/build", "/sync/src/build", true, false},
+		{"docs/*.md", "/sync/docs/a.md", false, true},
+		{"docs/*.md", "/sync/docs/sub/a.md", false, false},
+		{"tmp/", "/sync/tmp", true, true},
+		{"tmp/", "/sync/tmp", false, false},
+		{"**/cache", "/sync/cache", true, true},
+		{"**/cache", "/sync/a/b/cache", true, true},
+		{"logs/**", "/sync/logs/a/b.txt", false, true},
+		{"logs/**", "/sync/logs", true, false},
+		{"a/**/b", "/sync/a/b", false, true},
+		{"a/**/b", "/sync/a/x/y/b", false, true},
+		{"file?.txt", "/sync/file1.txt", false, true},
+		{"file?.txt", "/sync/file10.txt", false, false},
+		{"[abc].txt", "/sync/b.txt", false, true},
+		{"[!abc].txt", "/sync/b.txt", false, false},
+		{"[!abc].txt", "/sync/d.txt", false, true},
+		{"\\#notes", "/sync/#notes", false, true},
+		{"\\!important", "/sync/!important", false, true},
+		{"trailing  ", "/sync/trailing", false, true},
+		{"*.log", "/other/a.log", false, false},
+	}
+	for _, tt := range tests {
+		rule, ok := parseIgnorePattern(tt.pattern, base, "test", 1)
+		if !ok {
+			t.Errorf("pattern %q gave no rule", tt.pattern)
+			continue
+		}
+		if got := rule.matches(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("pattern %q on %s (dir %v) = %v, want %v", tt.pattern, tt.path, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestParseIgnorePatternNoRule(t *testing.T) {
+	for _, pattern := range []string{"", "   ", "# comment", "!", "/"} {
+		if _, ok := parseIgnorePattern(pattern, "/sync", "test", 1); ok {
+			t.Errorf("pattern %q gave a rule", pattern)
+		}
+	}
+}
+
+func TestIgnored(t *testing.T) {
+	root := t.TempDir()
+	write := func(path string, content string) {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(IgnoreFile, "*.tmp\nbuild/\n!keep.tmp\n")
+	write(filepath.Join("sub", IgnoreFile), "!*.tmp\nsecret.txt\n")
+	write("a.tmp", "")
+	write("keep.tmp", "")
+	write("build/out.bin", "")
+	write("sub/b.tmp", "")
+	write("sub/secret.txt", "")
+	write("sub/a.bak", "")
+	write("notes.txt", "")
+
+	s := &SyncService{Cfg: &share.ClientConfig{SyncDirs: []string{root}, IgnorePatterns: []string{"*.bak"}}}
+	tests := []struct {
+		path   string
+		want   bool
+		source string
+		parent string
+	}{
+		{"notes.txt", false, "", ""},
+		{"a.tmp", true, filepath.Join(root, IgnoreFile), ""},
+		{"keep.tmp", false, filepath.Join(root, IgnoreFile), ""},
+		{"build", true, filepath.Join(root, IgnoreFile), ""},
+		{"build/out.bin", true, filepath.Join(root, IgnoreFile), filepath.Join(root, "build")},
+		{"sub/b.tmp", false, filepath.Join(root, "sub", IgnoreFile), ""},
+		{"sub/secret.txt", true, filepath.Join(root, "sub", IgnoreFile), ""},
+		{"sub/a.bak", true, globalIgnoreSource, ""},
+	}
+	for _, tt := range tests {
+		res := s.Ignored(filepath.Join(root, tt.path))
+		if res.Ignored != tt.want || res.Source != tt.source || res.Parent != tt.parent {
+			t.Errorf("Ignored(%s) = %+v, want ignored %v by %q under %q", tt.path, res, tt.want, tt.source, tt.parent)
+		}
+	}
+
+	// changed global patterns apply without a restart
+	s.Cfg.IgnorePatterns = []string{"*.txt"}
+	if res := s.Ignored(filepath.Join(root, "notes.txt")); !res.Ignored {
+		t.Errorf("notes.txt isn't ignored after the global patterns changed: %+v", res)
+	}
+	if res := s.Ignored(filepath.Join(root, "sub/a.bak")); res.Ignored {
+		t.Errorf("sub/a.bak is still ignored after the global patterns changed: %+v", res)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package client
+
+import "os"
+
+// fileInode isn't available here, renames are only paired by content.
+func fileInode(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
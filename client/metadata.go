@@ -0,0 +1,84 @@
+package client
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync_server/share"
+	"time"
+)
+
+// linkInsideRoot tells whether the symlink at path points inside the sync folder it's in.
+func (s *SyncService) linkInsideRoot(path string, target string) bool {
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(path), target)
+	}
+	root, ok := s.syncRoot(path)
+	return ok && underPath(filepath.Clean(target), root)
+}
+
+// localMetadata reads what a change of path carries besides the content,
+// it tells false when the symlink policy leaves the path out of the sync.
+func (s *SyncService) localMetadata(path string) (*share.FileMetadata, bool) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, true
+	}
+	metadata := &share.FileMetadata{Mode: uint32(info.Mode().Perm()), ModTime: info.ModTime()}
+	if info.Mode()&os.ModeSymlink == 0 {
+		metadata.Size = info.Size()
+		return metadata, true
+	}
+	target, err := os.Readlink(path)
+	if err != nil {
+		return nil, false
+	}
+	if s.linkInsideRoot(path, target) || s.Cfg.SymlinkPolicy == share.SymlinkKeep {
+		metadata.LinkTarget = target
+		return metadata, true
+	}
+	if s.Cfg.SymlinkPolicy != share.SymlinkFollow {
+		return nil, false
+	}
+	info, err = os.Stat(path)
+	if err != nil || info.IsDir() {
+		return nil, false
+	}
+	return &share.FileMetadata{Mode: uint32(info.Mode().Perm()), ModTime: info.ModTime(), Size: info.Size()}, true
+}
+
+// applyMetadata restores the mode and modification time of a regular file.
+func applyMetadata(path string, metadata *share.FileMetadata) {
+	if metadata == nil || metadata.LinkTarget != "" {
+		return
+	}
+	if metadata.Mode != 0 {
+		if err := os.Chmod(path, os.FileMode(metadata.Mode)); err != nil {
+			slog.Error("Error changing file mode", "path", path, "err", err)
+		}
+	}
+	if !metadata.ModTime.IsZero() {
+		if err := os.Chtimes(path, time.Now(), metadata.ModTime); err != nil {
+			slog.Error("Error changing file time", "path", path, "err", err)
+		}
+	}
+}
+
+// applyLink creates the symlink in place of whatever is at path, links pointing outside
+// the sync folders are only created when the policy keeps them.
+func (s *SyncService) applyLink(path string, target string) error {
+	if !s.linkInsideRoot(path, target) && s.Cfg.SymlinkPolicy != share.SymlinkKeep {
+		slog.Info("Skipping symlink outside the sync folders", "path", path, "target", target)
+		return nil
+	}
+	if current, err := os.Readlink(path); err == nil && current == target {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(target, path)
+}
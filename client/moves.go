@@ -0,0 +1,181 @@
+package client
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync_server/share"
+	"time"
+)
+
+// fsnotify reports a rename as a RENAME of the old path followed by a CREATE of the new one,
+// a rename waits this long for its CREATE before it's sent as a removal.
+const renamePairWindow = time.Second
+
+type pendingRename struct {
+	path  string
+	inode uint64
+	// the inode of the path wasn't known, the rename can only be paired by its size and modification time
+	known   bool
+	stamp   fileStamp
+	stamped bool
+	dir     bool
+	at      time.Time
+}
+
+// fileStamp is what a rename keeps of a file where inodes aren't available.
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// moveDetector pairs the rename events of the watcher into moves so renamed files aren't uploaded again.
+// It only relies on what it saw locally, the watcher loop never waits for the server.
+type moveDetector struct {
+	service *SyncService
+	inodes  map[string]uint64
+	stamps  map[string]fileStamp
+	// the folders seen, once removed a path can't be told a folder anymore
+	dirs    map[string]bool
+	pending []pendingRename
+}
+
+func newMoveDetector(service *SyncService) *moveDetector {
+	return &moveDetector{
+		service: service,
+		inodes:  make(map[string]uint64),
+		stamps:  make(map[string]fileStamp),
+		dirs:    make(map[string]bool),
+	}
+}
+
+// index records the files and folders already in the sync folders, leaving out what the device doesn't sync.
+func (m *moveDetector) index(dirs []string) {
+	for _, dir := range dirs {
+		filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if path != dir && !m.service.syncs(path) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			m.seen(path)
+			return nil
+		})
+	}
+}
+
+func (m *moveDetector) seen(path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if info.IsDir() {
+		m.dirs[path] = true
+	} else {
+		m.stamps[path] = fileStamp{size: info.Size(), modTime: info.ModTime()}
+	}
+	if inode, ok := fileInode(info); ok {
+		m.inodes[path] = inode
+	}
+}
+
+func (m *moveDetector) isDir(path string) bool {
+	return m.dirs[path]
+}
+
+// forget drops the path and, for a folder, everything that was under it.
+func (m *moveDetector) forget(path string) {
+	delete(m.inodes, path)
+	delete(m.stamps, path)
+	if !m.dirs[path] {
+		return
+	}
+	for dir := range m.dirs {
+		if underPath(dir, path) {
+			delete(m.dirs, dir)
+		}
+	}
+	for file := range m.inodes {
+		if underPath(file, path) {
+			delete(m.inodes, file)
+		}
+	}
+	for file := range m.stamps {
+		if underPath(file, path) {
+			delete(m.stamps, file)
+		}
+	}
+}
+
+// renamed holds the rename of path until its new name shows up.
+func (m *moveDetector) renamed(path string) {
+	inode, known := m.inodes[path]
+	stamp, stamped := m.stamps[path]
+	m.pending = append(m.pending, pendingRename{path: path, inode: inode, known: known, stamp: stamp, stamped: stamped, dir: m.dirs[path], at: time.Now()})
+}
+
+// paired returns the old path of the file or folder created at path if it was renamed from one,
+// matching the inode first and, for a file, its size and modification time otherwise. A rename keeps both,
+// the server still checks the content digest of the move before it takes the stored file along.
+func (m *moveDetector) paired(path string) (string, bool) {
+	if len(m.pending) == 0 {
+		return "", false
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", false
+	}
+	inode, hasInode := fileInode(info)
+	for i, rename := range m.pending {
+		if rename.known && hasInode && rename.inode == inode && rename.dir == info.IsDir() {
+			m.pending = append(m.pending[:i], m.pending[i+1:]...)
+			m.forget(rename.path)
+			return rename.path, true
+		}
+	}
+	if info.IsDir() {
+		// a folder has nothing else to compare, without its inode it's synced as a new folder
+		return "", false
+	}
+	stamp := fileStamp{size: info.Size(), modTime: info.ModTime()}
+	for i, rename := range m.pending {
+		if rename.known && hasInode || rename.dir || !rename.stamped {
+			continue
+		}
+		if rename.stamp.size == stamp.size && rename.stamp.modTime.Equal(stamp.modTime) {
+			m.pending = append(m.pending[:i], m.pending[i+1:]...)
+			m.forget(rename.path)
+			return rename.path, true
+		}
+	}
+	return "", false
+}
+
+// expired returns the renames that found no new name in time, the files left the sync folders.
+func (m *moveDetector) expired() []string {
+	expired := []string{}
+	kept := m.pending[:0]
+	for _, rename := range m.pending {
+		if time.Since(rename.at) < renamePairWindow {
+			kept = append(kept, rename)
+			continue
+		}
+		expired = append(expired, rename.path)
+	}
+	m.pending = kept
+	return expired
+}
+
+// removed returns the removal of path, a folder removal takes everything under it along.
+func (m *moveDetector) removed(path string) share.ChangeRequestChange {
+	change := share.ChangeRequestChange{FileName: filepath.Base(path), ChangeEvent: "REMOVE"}
+	if m.isDir(path) {
+		change.ChangeEvent = share.DirRemoveChange
+	}
+	m.forget(path)
+	return change
+}
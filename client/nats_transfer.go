@@ -0,0 +1,245 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync_server/share"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const natsChunkTimeout = 10 * time.Second
+
+// uploadFileNats sends the file as ordered chunks and waits for the server to acknowledge each one before sending the next.
+// The first message only announces the size, the server answers it with the offset to resume from.
+func (s *SyncService) uploadFileNats(filePath string, info share.TransferInfo) error {
+	subject := info.Subject
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fileSize, err := share.GetSize(filePath)
+	if err != nil {
+		return err
+	}
+	digest, err := share.FileDigest(filePath)
+	if err != nil {
+		return err
+	}
+	compress := info.Compression != "" && fileCompressible(file)
+	msg := nats.NewMsg(subject)
+	msg.Header.Set(share.TransferSeqHeader, "0")
+	msg.Header.Set(share.TransferSizeHeader, strconv.FormatInt(fileSize, 10))
+	msg.Header.Set(share.TransferDigestHeader, digest)
+	if compress {
+		msg.Header.Set(share.TransferCompressionHeader, share.ZstdCompression)
+	}
+	resp, err := s.requestChunk(msg, 0)
+	if err != nil {
+		return err
+	}
+	offset, err := strconv.ParseInt(resp.Header.Get(share.TransferOffsetHeader), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid upload offset: %w", err)
+	}
+	var source io.Reader = file
+	if info.Delta {
+		delta := deltaSource(file, s.remoteSignature(filePath, fileSize))
+		defer delta.Close()
+		source = delta
+	} else if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if compress {
+		compressed := share.NewCompressReader(source)
+		defer compressed.Close()
+		source = compressed
+	}
+	buf := make([]byte, share.TransferChunkSize)
+	for seq := 1; ; seq++ {
+		n, err := io.ReadFull(source, buf)
+		eof := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !eof {
+			return err
+		}
+		msg := nats.NewMsg(subject)
+		msg.Header.Set(share.TransferSeqHeader, strconv.Itoa(seq))
+		if eof {
+			msg.Header.Set(share.TransferEOFHeader, "true")
+		}
+		msg.Data = buf[:n]
+		if _, err := s.requestChunk(msg, seq); err != nil {
+			return err
+		}
+		if eof {
+			return nil
+		}
+	}
+}
+
+// downloadFileNats pulls the file from the server one chunk at a time, starting after what partial already holds.
+// It returns the digest the server stored for the file. With a base, the server sends a delta against it instead.
+func (s *SyncService) downloadFileNats(subject string, partial *os.File, base *deltaBase) (string, error) {
+	stat, err := partial.Stat()
+	if err != nil {
+		return "", err
+	}
+	var dst io.Writer = partial
+	// the writers stacked on top of partial, flushed in order once the last chunk arrived
+	var sinks []io.WriteCloser
+	var waits []func() error
+	stack := func(sink io.WriteCloser, wait func() error) {
+		sinks = append([]io.WriteCloser{sink}, sinks...)
+		waits = append([]func() error{wait}, waits...)
+		dst = sink
+	}
+	defer func() {
+		for _, sink := range sinks {
+			sink.Close()
+		}
+	}()
+	var digest string
+	for seq := 0; ; seq++ {
+		msg := nats.NewMsg(subject)
+		msg.Header.Set(share.TransferSeqHeader, strconv.Itoa(seq))
+		if seq == 0 && base != nil {
+			msg.Data, err = json.Marshal(base.sig)
+			if err != nil {
+				return "", err
+			}
+		} else if seq == 0 {
+			msg.Header.Set(share.TransferOffsetHeader, strconv.FormatInt(stat.Size(), 10))
+		}
+		resp, err := s.requestChunk(msg, seq)
+		if err != nil {
+			return "", err
+		}
+		if seq == 0 {
+			offset, err := strconv.ParseInt(resp.Header.Get(share.TransferOffsetHeader), 10, 64)
+			if err != nil {
+				return "", fmt.Errorf("invalid download offset: %w", err)
+			}
+			if err := resumeAt(partial, offset); err != nil {
+				return "", err
+			}
+			digest = resp.Header.Get(share.TransferDigestHeader)
+			if base != nil {
+				stack(deltaSink(partial, base))
+			}
+			if resp.Header.Get(share.TransferCompressionHeader) == share.ZstdCompression {
+				stack(share.NewDecompressWriter(dst))
+			}
+		}
+		if _, err := dst.Write(resp.Data); err != nil {
+			return "", err
+		}
+		if resp.Header.Get(share.TransferEOFHeader) == "" {
+			continue
+		}
+		for i, sink := range sinks {
+			sink.Close()
+			if err := waits[i](); err != nil {
+				return "", err
+			}
+		}
+		return digest, nil
+	}
+}
+
+// requestChunk sends a chunk and waits for the answer, both held to the bandwidth limits.
+func (s *SyncService) requestChunk(msg *nats.Msg, seq int) (*nats.Msg, error) {
+	s.bandwidth.upload.take(len(msg.Data))
+	resp, err := s.NatsConn.RequestMsg(msg, natsChunkTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %d: %w", seq, err)
+	}
+	s.bandwidth.download.take(len(resp.Data))
+	if transferErr := resp.Header.Get(share.TransferErrorHeader); transferErr != "" {
+		return nil, fmt.Errorf("chunk %d: %w", seq, errors.New(transferErr))
+	}
+	if resp.Header.Get(share.TransferSeqHeader) != strconv.Itoa(seq) {
+		return nil, fmt.Errorf("chunk %d: out of order response", seq)
+	}
+	return resp, nil
+}
+
+// uploadFileChunks sends the manifest of the file, then only the chunks the server doesn't have and finally commits the manifest.
+func (s *SyncService) uploadFileChunks(filePath string, info share.TransferInfo) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	manifest, err := share.BuildManifest(file)
+	if err != nil {
+		return err
+	}
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	seq := 0
+	msg := nats.NewMsg(info.Subject)
+	msg.Header.Set(share.TransferSeqHeader, strconv.Itoa(seq))
+	msg.Header.Set(share.TransferOpHeader, share.ChunkOpMissing)
+	msg.Data = manifestBytes
+	resp, err := s.requestChunk(msg, seq)
+	if err != nil {
+		return err
+	}
+	var missing []string
+	if err := json.Unmarshal(resp.Data, &missing); err != nil {
+		return fmt.Errorf("invalid missing chunks: %w", err)
+	}
+	wanted := make(map[string]bool, len(missing))
+	for _, hash := range missing {
+		wanted[hash] = true
+	}
+	var offset int64
+	for _, chunk := range manifest.Chunks {
+		if wanted[chunk.Hash] {
+			data := make([]byte, chunk.Size)
+			if _, err := file.ReadAt(data, offset); err != nil {
+				return err
+			}
+			seq++
+			msg := nats.NewMsg(info.Subject)
+			msg.Header.Set(share.TransferSeqHeader, strconv.Itoa(seq))
+			msg.Header.Set(share.TransferOpHeader, share.ChunkOpPut)
+			msg.Header.Set(share.TransferChunkHeader, chunk.Hash)
+			msg.Data = data
+			if info.Compression != "" && share.Compressible(data[:min(len(data), share.CompressionSampleSize)]) {
+				msg.Header.Set(share.TransferCompressionHeader, share.ZstdCompression)
+				msg.Data = share.CompressBytes(data)
+			}
+			if _, err := s.requestChunk(msg, seq); err != nil {
+				return err
+			}
+			delete(wanted, chunk.Hash)
+		}
+		offset += chunk.Size
+	}
+	seq++
+	msg = nats.NewMsg(info.Subject)
+	msg.Header.Set(share.TransferSeqHeader, strconv.Itoa(seq))
+	msg.Header.Set(share.TransferOpHeader, share.ChunkOpCommit)
+	msg.Data = manifestBytes
+	_, err = s.requestChunk(msg, seq)
+	return err
+}
+
+// fileCompressible samples the start of the file, the seq 0 handshake has to tell the server before any content is read.
+func fileCompressible(file *os.File) bool {
+	sample := make([]byte, share.CompressionSampleSize)
+	n, err := file.ReadAt(sample, 0)
+	if err != nil && err != io.EOF {
+		return false
+	}
+	return share.Compressible(sample[:n])
+}
@@ -0,0 +1,47 @@
+package client
+
+import (
+	"log/slog"
+	"sync_server/share"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// with change notifications the ticker only catches what they missed, it doesn't run more often than this
+const safetySyncInterval = time.Minute
+
+// subscribeChanges syncs as soon as the server announces changes of the account, and once more after a reconnect
+// since the announcements sent meanwhile are lost.
+func (s *SyncService) subscribeChanges() bool {
+	_, err := s.NatsConn.Subscribe(share.ChangeNotifySubject(s.Cfg.ClientId), func(*nats.Msg) {
+		s.retrieve()
+	})
+	if err != nil {
+		slog.Error("Error subscribing to change notifications, polling instead", "err", err)
+		return false
+	}
+	s.NatsConn.OnReconnect(s.retrieve)
+	return true
+}
+
+// retrieve fetches the changes of the other devices without blocking, a request arriving while
+// a retrieval runs makes it fetch once more when it's done.
+func (s *SyncService) retrieve() {
+	s.refetch.Store(true)
+	if !s.retrieving.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		for {
+			for s.refetch.Swap(false) {
+				s.retrieveChanges()
+			}
+			s.retrieving.Store(false)
+			// a request may have come in right before the retrieval stopped
+			if !s.refetch.Load() || !s.retrieving.CompareAndSwap(false, true) {
+				return
+			}
+		}
+	}()
+}
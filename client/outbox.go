@@ -0,0 +1,144 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sync_server/share"
+	"time"
+)
+
+const (
+	// the changes the server didn't acknowledge yet, kept next to client.yaml
+	outboxPath = "outbox.json"
+	// retries of a batch the server couldn't be reached for start here and double up to the max
+	minRetryBackoff = time.Second
+	maxRetryBackoff = time.Minute
+)
+
+// outbox is what the outbox file holds, an outbox of an earlier release is a plain list of changes.
+type outbox struct {
+	Changes []ChangeEvent `json:"changes"`
+	// files whose change the server recorded but whose upload didn't complete yet
+	Uploads []string `json:"uploads,omitempty"`
+}
+
+// loadOutbox queues the changes a previous run didn't get acknowledged and returns the uploads it didn't complete.
+func (q *changeQueue) loadOutbox() ([]string, error) {
+	file, err := os.ReadFile(outboxPath)
+	if err != nil || len(file) == 0 {
+		return nil, nil
+	}
+	var saved outbox
+	if err := json.Unmarshal(file, &saved); err != nil {
+		if err := json.Unmarshal(file, &saved.Changes); err != nil {
+			return nil, fmt.Errorf("failed to load outbox: %w", err)
+		}
+	}
+	for _, change := range saved.Changes {
+		q.add(change)
+	}
+	return saved.Uploads, nil
+}
+
+// save writes the changes being sent, the queued ones and the uploads still running to the outbox,
+// replacing it at once so a crash can't truncate it. Listen, the flusher and the uploads all save,
+// saveMu keeps an older state from being written over a newer one.
+func (q *changeQueue) save() error {
+	q.saveMu.Lock()
+	defer q.saveMu.Unlock()
+	q.Lock()
+	saved := outbox{Changes: append([]ChangeEvent{}, q.inflight...)}
+	for _, change := range q.changes {
+		saved.Changes = append(saved.Changes, *change)
+	}
+	for path := range q.uploads {
+		saved.Uploads = append(saved.Uploads, path)
+	}
+	q.Unlock()
+	slices.Sort(saved.Uploads)
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return fmt.Errorf("failed to marshal outbox: %w", err)
+	}
+	if err := share.WriteFileAtomic(outboxPath, data); err != nil {
+		return fmt.Errorf("failed to write outbox: %w", err)
+	}
+	return nil
+}
+
+// uploading keeps the upload of the file in the outbox until it's done, the next save writes it.
+func (q *changeQueue) uploading(path string) {
+	q.Lock()
+	defer q.Unlock()
+	q.uploads[path] = true
+}
+
+// uploaded takes the completed upload of the file out of the outbox.
+func (q *changeQueue) uploaded(path string) {
+	q.Lock()
+	_, ok := q.uploads[path]
+	delete(q.uploads, path)
+	q.Unlock()
+	if !ok {
+		return
+	}
+	if err := q.save(); err != nil {
+		slog.Error("Error saving outbox", "err", err)
+	}
+}
+
+// ack drops the batch being sent once the server acknowledged it, the changes it didn't are queued again
+// ahead of the ones that arrived meanwhile.
+func (q *changeQueue) ack(failed []ChangeEvent) {
+	q.Lock()
+	queued := q.changes
+	q.inflight = nil
+	q.changes = nil
+	q.latest = make(map[string]int)
+	for _, change := range failed {
+		q.addLocked(change)
+	}
+	for _, change := range queued {
+		q.addLocked(*change)
+	}
+	q.Unlock()
+	if err := q.save(); err != nil {
+		slog.Error("Error saving outbox", "err", err)
+	}
+}
+
+// flusher is the only goroutine sending changes, changes keep being merged into the queue while it sends.
+// A batch the server couldn't be reached for stays in the outbox and is sent again after a backoff.
+func (s *SyncService) flusher(queue *changeQueue, flush <-chan struct{}) {
+	backoff := minRetryBackoff
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-flush:
+			if retry != nil {
+				// the backoff decides when to try again
+				continue
+			}
+		case <-retry:
+			retry = nil
+		case <-s.done:
+			return
+		}
+		batch := queue.drain()
+		if len(batch) == 0 {
+			continue
+		}
+		failed := s.syncChanges(batch)
+		queue.ack(failed)
+		if len(failed) == 0 {
+			backoff = minRetryBackoff
+			continue
+		}
+		slog.Warn("Changes not acknowledged, retrying", "changes", len(failed), "in", backoff)
+		retry = time.After(backoff)
+		backoff = min(backoff*2, maxRetryBackoff)
+	}
+}
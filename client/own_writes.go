@@ -0,0 +1,68 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+// the watcher reports the changes the client makes a little later, they are told apart for this long after the write
+const ownWriteWindow = 2 * time.Second
+
+// ownWrites holds the paths the client is changing to apply the changes of other devices,
+// the watcher events they cause aren't changes of this device and aren't sent back.
+type ownWrites struct {
+	mu    sync.Mutex
+	paths map[string]*ownWrite
+}
+
+type ownWrite struct {
+	// writes still running
+	active int
+	// the events of the last finished write arrive until then
+	until time.Time
+}
+
+func newOwnWrites() *ownWrites {
+	return &ownWrites{paths: make(map[string]*ownWrite)}
+}
+
+// begin marks the paths as written by the client until the returned func is called.
+func (w *ownWrites) begin(paths ...string) func() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, path := range paths {
+		write, ok := w.paths[path]
+		if !ok {
+			write = &ownWrite{}
+			w.paths[path] = write
+		}
+		write.active++
+	}
+	return func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		until := time.Now().Add(ownWriteWindow)
+		for _, path := range paths {
+			write := w.paths[path]
+			write.active--
+			write.until = until
+		}
+	}
+}
+
+// owns tells whether the client is writing path or was shortly before, a folder the client writes
+// covers everything under it.
+func (w *ownWrites) owns(path string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := time.Now()
+	owned := false
+	for written, write := range w.paths {
+		if write.active == 0 && now.After(write.until) {
+			delete(w.paths, written)
+			continue
+		}
+		owned = owned || underPath(path, written)
+	}
+	return owned
+}
@@ -0,0 +1,195 @@
+package client
+
+import (
+	"strings"
+	"sync"
+	"sync_server/share"
+	"time"
+)
+
+const (
+	// changes are sent once no new one arrived for this long
+	debounceWindow = 500 * time.Millisecond
+	// a steady stream of changes is still sent at least this often
+	maxFlushDelay = 5 * time.Second
+	// a queue this long is sent without waiting for the debounce
+	flushBatchSize = 100
+)
+
+// changeKind reduces the events fsnotify combines, like CREATE|WRITE, to the one that matters.
+func changeKind(event string) string {
+	switch {
+	case strings.Contains(event, "REMOVE"):
+		return "REMOVE"
+	case strings.Contains(event, "CREATE"):
+		return "CREATE"
+	case strings.Contains(event, "WRITE"):
+		return "WRITE"
+	}
+	return event
+}
+
+// changeQueue holds the changes waiting to be sent, merging the ones of the same path in arrival order.
+type changeQueue struct {
+	sync.Mutex
+	changes []*ChangeEvent
+	// the batch being sent, it stays in the outbox until the server acknowledged it
+	inflight []ChangeEvent
+	// the uploads of acknowledged changes, they stay in the outbox until their transfer succeeded
+	uploads map[string]bool
+	// latest queued change of every path
+	latest map[string]int
+	first  time.Time
+	// serialises the writes of the outbox
+	saveMu sync.Mutex
+}
+
+func newChangeQueue() *changeQueue {
+	return &changeQueue{latest: make(map[string]int), uploads: make(map[string]bool)}
+}
+
+func changePath(change ChangeEvent) string {
+	return change.Dir + "/" + change.File.FileName
+}
+
+// add queues the change, merged into the previous change of its path when one says it all:
+// a created file that's modified is still created, a created file that's removed never was.
+func (q *changeQueue) add(change ChangeEvent) {
+	q.Lock()
+	defer q.Unlock()
+	q.addLocked(change)
+}
+
+// addLocked is add with the queue already locked.
+func (q *changeQueue) addLocked(change ChangeEvent) {
+	change.File.ChangeEvent = changeKind(change.File.ChangeEvent)
+	if len(q.changes) == 0 {
+		q.first = time.Now()
+	}
+	path := changePath(change)
+	next := change.File.ChangeEvent
+
+	if next == share.MoveChange && change.File.Dir {
+		q.moveDir(change)
+		return
+	}
+	// a file moved before it was ever sent is simply created under its new name
+	if next == share.MoveChange {
+		if i, ok := q.latest[change.File.OldPath]; ok && q.changes[i].File.ChangeEvent == "CREATE" {
+			q.drop(change.File.OldPath)
+			change.File.ChangeEvent, change.File.OldPath, change.File.Digest = "CREATE", "", ""
+			next = "CREATE"
+		}
+	}
+
+	i, ok := q.latest[path]
+	if !ok {
+		q.push(path, change)
+		return
+	}
+	prev := q.changes[i]
+	switch kind := prev.File.ChangeEvent; {
+	case kind == "CREATE" && next == "REMOVE", kind == share.DirCreateChange && next == share.DirRemoveChange:
+		q.drop(path)
+	case kind == "CREATE" && (next == "CREATE" || next == "WRITE" || next == share.MetadataChange):
+		prev.File.Metadata = change.File.Metadata
+	case kind == "WRITE" && next == share.MetadataChange:
+		prev.File.Metadata = change.File.Metadata
+	case (kind == "WRITE" || kind == share.MetadataChange) && (next == "WRITE" || next == share.MetadataChange || next == "REMOVE"),
+		kind == "REMOVE" && next == "CREATE":
+		// the newer change replaces it, a file removed and created again overwrites the one the server has
+		prev.File = change.File
+		prev.Time = change.Time
+		if kind == "REMOVE" {
+			prev.File.ChangeEvent = "WRITE"
+		}
+	default:
+		q.push(path, change)
+	}
+}
+
+// moveDir queues the move of a folder, the queued changes under it follow it to its new path.
+// A folder created before it was ever sent is simply created under its new name, otherwise the move
+// goes before the changes under it so the server moves what it stores first.
+func (q *changeQueue) moveDir(change ChangeEvent) {
+	oldPath, newPath := change.File.OldPath, changePath(change)
+	pos, created := -1, false
+	for i, queued := range q.changes {
+		path := changePath(*queued)
+		if underPath(path, newPath) {
+			// whatever happened at the new path before has to come first
+			pos = max(pos, i+1)
+		}
+		if !underPath(path, oldPath) {
+			continue
+		}
+		if pos < 0 {
+			pos = i
+		}
+		if path == oldPath {
+			created = created || queued.File.ChangeEvent == share.DirCreateChange
+			queued.Dir, queued.File.FileName = change.Dir, change.File.FileName
+		} else {
+			queued.Dir = newPath + strings.TrimPrefix(queued.Dir, oldPath)
+		}
+		if underPath(queued.File.OldPath, oldPath) {
+			queued.File.OldPath = newPath + strings.TrimPrefix(queued.File.OldPath, oldPath)
+		}
+	}
+	if !created {
+		if pos < 0 {
+			pos = len(q.changes)
+		}
+		q.changes = append(q.changes[:pos], append([]*ChangeEvent{&change}, q.changes[pos:]...)...)
+	}
+	q.reindex()
+}
+
+func (q *changeQueue) push(path string, change ChangeEvent) {
+	q.changes = append(q.changes, &change)
+	q.latest[path] = len(q.changes) - 1
+}
+
+// drop removes the latest change of path, the previous one of the path becomes the latest.
+func (q *changeQueue) drop(path string) {
+	i := q.latest[path]
+	q.changes = append(q.changes[:i], q.changes[i+1:]...)
+	q.reindex()
+}
+
+func (q *changeQueue) reindex() {
+	q.latest = make(map[string]int, len(q.changes))
+	for j, change := range q.changes {
+		q.latest[changePath(*change)] = j
+	}
+}
+
+func (q *changeQueue) len() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.changes)
+}
+
+// due returns how long until the queue has to be sent, counting from the last change that arrived.
+func (q *changeQueue) due() time.Duration {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.changes) >= flushBatchSize {
+		return 0
+	}
+	return max(min(debounceWindow, maxFlushDelay-time.Since(q.first)), 0)
+}
+
+// drain takes the queued changes to send them, until they are acknowledged they stay in flight.
+func (q *changeQueue) drain() []ChangeEvent {
+	q.Lock()
+	defer q.Unlock()
+	batch := make([]ChangeEvent, len(q.changes))
+	for i, change := range q.changes {
+		batch[i] = *change
+	}
+	q.changes = nil
+	q.latest = make(map[string]int)
+	q.inflight = batch
+	return batch
+}
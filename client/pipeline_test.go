@@ -0,0 +1,142 @@
+package client
+
+import (
+	"path/filepath"
+	"slices"
+	"sync_server/share"
+	"testing"
+)
+
+// queued is a change of the test sequences, path is the full path of the file.
+type queued struct {
+	kind    string
+	path    string
+	oldPath string
+	dir     bool
+}
+
+func (c queued) event() ChangeEvent {
+	return ChangeEvent{
+		Dir: filepath.Dir(c.path),
+		File: share.ChangeRequestChange{
+			FileName:    filepath.Base(c.path),
+			ChangeEvent: c.kind,
+			OldPath:     c.oldPath,
+			Dir:         c.dir,
+		},
+	}
+}
+
+func TestChangeQueueAdd(t *testing.T) {
+	tests := []struct {
+		name    string
+		changes []queued
+		want    []queued
+	}{
+		{
+			name:    "single change",
+			changes: []queued{{kind: "CREATE", path: "/s/f"}},
+			want:    []queued{{kind: "CREATE", path: "/s/f"}},
+		},
+		{
+			name:    "combined fsnotify events",
+			changes: []queued{{kind: "CREATE|WRITE", path: "/s/f"}},
+			want:    []queued{{kind: "CREATE", path: "/s/f"}},
+		},
+		{
+			name:    "created then written",
+			changes: []queued{{kind: "CREATE", path: "/s/f"}, {kind: "WRITE", path: "/s/f"}},
+			want:    []queued{{kind: "CREATE", path: "/s/f"}},
+		},
+		{
+			name:    "created then removed",
+			changes: []queued{{kind: "CREATE", path: "/s/f"}, {kind: "REMOVE", path: "/s/f"}},
+			want:    nil,
+		},
+		{
+			name:    "written twice",
+			changes: []queued{{kind: "WRITE", path: "/s/f"}, {kind: "WRITE", path: "/s/f"}},
+			want:    []queued{{kind: "WRITE", path: "/s/f"}},
+		},
+		{
+			name:    "written then removed",
+			changes: []queued{{kind: "WRITE", path: "/s/f"}, {kind: "REMOVE", path: "/s/f"}},
+			want:    []queued{{kind: "REMOVE", path: "/s/f"}},
+		},
+		{
+			name:    "metadata then written",
+			changes: []queued{{kind: share.MetadataChange, path: "/s/f"}, {kind: "WRITE", path: "/s/f"}},
+			want:    []queued{{kind: "WRITE", path: "/s/f"}},
+		},
+		{
+			name:    "removed then created",
+			changes: []queued{{kind: "REMOVE", path: "/s/f"}, {kind: "CREATE", path: "/s/f"}},
+			want:    []queued{{kind: "WRITE", path: "/s/f"}},
+		},
+		{
+			name:    "removed, created and removed again",
+			changes: []queued{{kind: "REMOVE", path: "/s/f"}, {kind: "CREATE", path: "/s/f"}, {kind: "REMOVE", path: "/s/f"}},
+			want:    []queued{{kind: "REMOVE", path: "/s/f"}},
+		},
+		{
+			name:    "folder created then removed",
+			changes: []queued{{kind: share.DirCreateChange, path: "/s/d"}, {kind: share.DirRemoveChange, path: "/s/d"}},
+			want:    nil,
+		},
+		{
+			name:    "other paths stay apart",
+			changes: []queued{{kind: "CREATE", path: "/s/a"}, {kind: "CREATE", path: "/s/b"}, {kind: "REMOVE", path: "/s/a"}},
+			want:    []queued{{kind: "CREATE", path: "/s/b"}},
+		},
+		{
+			name:    "created file moved",
+			changes: []queued{{kind: "CREATE", path: "/s/a"}, {kind: share.MoveChange, path: "/s/b", oldPath: "/s/a"}},
+			want:    []queued{{kind: "CREATE", path: "/s/b"}},
+		},
+		{
+			name:    "stored file moved",
+			changes: []queued{{kind: "WRITE", path: "/s/a"}, {kind: share.MoveChange, path: "/s/b", oldPath: "/s/a"}},
+			want:    []queued{{kind: "WRITE", path: "/s/a"}, {kind: share.MoveChange, path: "/s/b", oldPath: "/s/a"}},
+		},
+		{
+			name: "created folder moved",
+			changes: []queued{
+				{kind: share.DirCreateChange, path: "/s/a"},
+				{kind: "CREATE", path: "/s/a/f"},
+				{kind: share.MoveChange, path: "/s/b", oldPath: "/s/a", dir: true},
+			},
+			want: []queued{{kind: share.DirCreateChange, path: "/s/b"}, {kind: "CREATE", path: "/s/b/f"}},
+		},
+		{
+			name: "stored folder moved",
+			changes: []queued{
+				{kind: "WRITE", path: "/s/a/f"},
+				{kind: share.MoveChange, path: "/s/b", oldPath: "/s/a", dir: true},
+			},
+			want: []queued{
+				{kind: share.MoveChange, path: "/s/b", oldPath: "/s/a", dir: true},
+				{kind: "WRITE", path: "/s/b/f"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newChangeQueue()
+			for _, change := range tt.changes {
+				q.add(change.event())
+			}
+			var got []queued
+			for _, change := range q.drain() {
+				got = append(got, queued{
+					kind:    change.File.ChangeEvent,
+					path:    changePath(change),
+					oldPath: change.File.OldPath,
+					dir:     change.File.Dir,
+				})
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("queued %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package client
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync_server/share"
+)
+
+// ListRemote lists what the server stores under the local path, without syncing anything.
+func (s *SyncService) ListRemote(path string) ([]share.FileEntry, error) {
+	var entries []share.FileEntry
+	_, err := s.request("list-files", share.ListFilesRequest{ClientRequest: s.clientRequest(), Path: path}, &entries)
+	return entries, err
+}
+
+// DownloadRemote fetches the given files, or every file stored under them when they are folders.
+// The files are downloaded ahead of the sync transfers, it returns the downloaded paths and the error of every path that failed.
+func (s *SyncService) DownloadRemote(paths []string) ([]string, map[string]string) {
+	downloaded := []string{}
+	failed := make(map[string]string)
+	// the downloads report back while the listing goes on, every access to the results goes through mu
+	var mu sync.Mutex
+	fail := func(path string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		failed[path] = err.Error()
+	}
+	var wg sync.WaitGroup
+	for _, path := range paths {
+		entries, err := s.ListRemote(path)
+		if err != nil {
+			fail(path, err)
+			continue
+		}
+		for _, entry := range entries {
+			if entry.Dir {
+				if err := os.MkdirAll(entry.Path, 0755); err != nil {
+					fail(entry.Path, err)
+				}
+				continue
+			}
+			if digest, err := share.FileDigest(entry.Path); err == nil && digest == entry.Hash {
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := s.downloadNow(entry.Path, entry.Size, func() error {
+					if err := os.MkdirAll(filepath.Dir(entry.Path), 0755); err != nil {
+						return err
+					}
+					return s.downloadPath(entry.Path)
+				})
+				if err != nil {
+					slog.Error("Error downloading remote file", "path", entry.Path, "err", err)
+					fail(entry.Path, err)
+					return
+				}
+				applyMetadata(entry.Path, entry.Metadata)
+				mu.Lock()
+				defer mu.Unlock()
+				downloaded = append(downloaded, entry.Path)
+			}()
+		}
+	}
+	wg.Wait()
+	return downloaded, failed
+}
@@ -0,0 +1,54 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync_server/share"
+	"time"
+)
+
+const requestTimeout = 3 * time.Second
+
+// errRemoteNotFound is returned for a file the server doesn't have anymore.
+var errRemoteNotFound = errors.New("not found on the server")
+
+func (s *SyncService) clientRequest() share.ClientRequest {
+	return share.ClientRequest{
+		ClientId:     s.Cfg.ClientId,
+		Time:         time.Now(),
+		Agent:        runtime.GOOS,
+		TransferMode: s.Cfg.TransferMode,
+		Compression:  s.compression(),
+		DeviceId:     s.Cfg.DeviceId,
+	}
+}
+
+// request sends req to the server subject and decodes the data of a successful response into res, if not nil.
+func (s *SyncService) request(subject string, req any, res any) (string, error) {
+	reqBytes, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	msg, err := s.NatsConn.RequestToSubject(subject, reqBytes, requestTimeout)
+	if err != nil {
+		return "", err
+	}
+	var serverResp share.ServerResponse
+	if err := json.Unmarshal(msg.Data, &serverResp); err != nil {
+		return "", fmt.Errorf("error unmarshaling %s response: %w", subject, err)
+	}
+	if serverResp.Status == share.NotFound {
+		return "", fmt.Errorf("%w: %s", errRemoteNotFound, serverResp.Data)
+	}
+	if serverResp.Status != share.Success {
+		return "", fmt.Errorf("failure response from server: %s", serverResp.Data)
+	}
+	if res != nil {
+		if err := json.Unmarshal([]byte(serverResp.Data), res); err != nil {
+			return "", fmt.Errorf("error unmarshaling %s response: %w", subject, err)
+		}
+	}
+	return serverResp.Data, nil
+}
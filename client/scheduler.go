@@ -0,0 +1,345 @@
+package client
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync_server/share"
+	"time"
+)
+
+type TransferKind string
+
+const (
+	UploadTransfer   TransferKind = "upload"
+	DownloadTransfer TransferKind = "download"
+)
+
+// transfer priorities, lower goes first and within a priority smaller files go first
+const (
+	// downloads a user asked for through the http api
+	userPriority = iota
+	syncPriority
+)
+
+const (
+	// transfers running at once when the client doesn't configure it
+	defaultTransferConcurrency = 4
+	maxTransferAttempts        = 5
+	minTransferBackoff         = time.Second
+	maxTransferBackoff         = time.Minute
+)
+
+// transferJob is an upload or download waiting for, or holding, one of the transfer slots.
+type transferJob struct {
+	Kind     TransferKind `json:"kind"`
+	Path     string       `json:"path"`
+	Size     int64        `json:"size"`
+	Priority int          `json:"priority"`
+	Attempts int          `json:"attempts"`
+	Error    string       `json:"error,omitempty"`
+	Failed   time.Time    `json:"failed,omitempty"`
+	run      func() error
+	// receives the outcome when someone waits for the job
+	done chan error
+	seq  uint64
+}
+
+type jobHeap []*transferJob
+
+func (h jobHeap) Len() int { return len(h) }
+func (h jobHeap) Less(i, j int) bool {
+	if h[i].Priority != h[j].Priority {
+		return h[i].Priority < h[j].Priority
+	}
+	if h[i].Size != h[j].Size {
+		return h[i].Size < h[j].Size
+	}
+	return h[i].seq < h[j].seq
+}
+func (h jobHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *jobHeap) Push(x any)   { *h = append(*h, x.(*transferJob)) }
+func (h *jobHeap) Pop() any {
+	old := *h
+	job := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return job
+}
+
+// TransferStatus is what the http api shows of the scheduler.
+type TransferStatus struct {
+	Active     []transferJob `json:"active"`
+	Queued     []transferJob `json:"queued"`
+	Retrying   []transferJob `json:"retrying"`
+	DeadLetter []transferJob `json:"dead_letter"`
+}
+
+// transferScheduler runs a bounded number of transfers at once in priority order. A failed transfer is retried
+// with an exponential backoff and ends up in the dead letter list once it runs out of attempts.
+type transferScheduler struct {
+	mu       sync.Mutex
+	ready    *sync.Cond
+	queue    jobHeap
+	active   []*transferJob
+	retrying []*transferJob
+	dead     []*transferJob
+	seq      uint64
+}
+
+func newTransferScheduler(concurrency int) *transferScheduler {
+	if concurrency <= 0 {
+		concurrency = defaultTransferConcurrency
+	}
+	t := &transferScheduler{}
+	t.ready = sync.NewCond(&t.mu)
+	for range concurrency {
+		go t.worker()
+	}
+	return t
+}
+
+// Submit queues the job, a sync job for a path that's already waiting or retrying isn't queued twice:
+// the waiting one takes over the transfer of the new one, which is the more recent.
+func (t *transferScheduler) Submit(job *transferJob) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if job.done == nil {
+		for i, waiting := range t.queue {
+			if waiting.done == nil && waiting.Kind == job.Kind && waiting.Path == job.Path {
+				waiting.replace(job)
+				heap.Fix(&t.queue, i)
+				return
+			}
+		}
+		for _, waiting := range t.retrying {
+			if waiting.done == nil && waiting.Kind == job.Kind && waiting.Path == job.Path {
+				waiting.replace(job)
+				return
+			}
+		}
+	}
+	t.push(job)
+}
+
+// replace runs the transfer of job instead, with a fresh set of attempts, t.mu has to be locked.
+func (job *transferJob) replace(newer *transferJob) {
+	job.run = newer.run
+	job.Size = newer.Size
+	job.Attempts = 0
+}
+
+// Start queues the job and returns where its outcome arrives, retries included.
+func (t *transferScheduler) Start(job *transferJob) <-chan error {
+	job.done = make(chan error, 1)
+	t.Submit(job)
+	return job.done
+}
+
+// Do runs the job and waits for its outcome.
+func (t *transferScheduler) Do(job *transferJob) error {
+	return <-t.Start(job)
+}
+
+// push queues the job, t.mu has to be locked.
+func (t *transferScheduler) push(job *transferJob) {
+	t.seq++
+	job.seq = t.seq
+	heap.Push(&t.queue, job)
+	t.ready.Signal()
+}
+
+func (t *transferScheduler) worker() {
+	for {
+		t.mu.Lock()
+		for len(t.queue) == 0 {
+			t.ready.Wait()
+		}
+		job := heap.Pop(&t.queue).(*transferJob)
+		t.active = append(t.active, job)
+		job.Attempts++
+		t.mu.Unlock()
+
+		err := job.run()
+
+		t.mu.Lock()
+		t.active = slices.DeleteFunc(t.active, func(active *transferJob) bool { return active == job })
+		t.finished(job, err)
+		t.mu.Unlock()
+	}
+}
+
+// finished retries a failed job after its backoff or gives up on it, t.mu has to be locked.
+func (t *transferScheduler) finished(job *transferJob, err error) {
+	if err == nil {
+		job.Error = ""
+		job.report(nil)
+		return
+	}
+	job.Error = err.Error()
+	job.Failed = time.Now()
+	if job.Attempts >= maxTransferAttempts {
+		slog.Error("Transfer failed, giving up", "kind", job.Kind, "path", job.Path, "attempts", job.Attempts, "err", err)
+		t.dead = append(t.dead, job)
+		job.report(err)
+		return
+	}
+	backoff := min(minTransferBackoff<<(job.Attempts-1), maxTransferBackoff)
+	slog.Warn("Transfer failed, retrying", "kind", job.Kind, "path", job.Path, "attempt", job.Attempts, "in", backoff, "err", err)
+	t.retrying = append(t.retrying, job)
+	time.AfterFunc(backoff, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.retrying = slices.DeleteFunc(t.retrying, func(retrying *transferJob) bool { return retrying == job })
+		t.push(job)
+	})
+}
+
+// report hands the outcome to whoever waits for the job, a dead letter retried after its waiter
+// gave up has nobody to report to.
+func (job *transferJob) report(err error) {
+	if job.done == nil {
+		return
+	}
+	select {
+	case job.done <- err:
+	default:
+	}
+}
+
+// Retry queues a dead letter again with a fresh set of attempts.
+func (t *transferScheduler) Retry(kind TransferKind, path string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, job := range t.dead {
+		if job.Kind == kind && job.Path == path {
+			t.dead = slices.Delete(t.dead, i, i+1)
+			job.Attempts = 0
+			t.push(job)
+			return nil
+		}
+	}
+	return fmt.Errorf("no failed %s of %s", kind, path)
+}
+
+func (t *transferScheduler) Status() TransferStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	queued := slices.Clone(t.queue)
+	slices.SortFunc(queued, func(a, b *transferJob) int {
+		if jobHeap([]*transferJob{a, b}).Less(0, 1) {
+			return -1
+		}
+		return 1
+	})
+	return TransferStatus{
+		Active:     jobValues(t.active),
+		Queued:     jobValues(queued),
+		Retrying:   jobValues(t.retrying),
+		DeadLetter: jobValues(t.dead),
+	}
+}
+
+// jobValues copies the jobs so they can be shown while the workers keep updating them, t.mu has to be locked.
+func jobValues(jobs []*transferJob) []transferJob {
+	values := make([]transferJob, len(jobs))
+	for i, job := range jobs {
+		values[i] = *job
+	}
+	return values
+}
+
+func localSize(path string) int64 {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// scheduleUpload queues the upload the server asked for, without a transfer yet and on later attempts it asks
+// the server for a new one. The upload stays in the outbox until it succeeded so a restart resumes it.
+func (s *SyncService) scheduleUpload(filePath string, info *share.TransferInfo) {
+	s.queue.uploading(filePath)
+	s.transfers.Submit(&transferJob{
+		Kind:     UploadTransfer,
+		Path:     filePath,
+		Size:     localSize(filePath),
+		Priority: syncPriority,
+		run: func() error {
+			if _, err := os.Lstat(filePath); os.IsNotExist(err) {
+				// removed since, the removal is synced on its own
+				s.queue.uploaded(filePath)
+				return nil
+			}
+			if info == nil {
+				requested, err := s.requestUpload(filePath)
+				if err != nil {
+					return err
+				}
+				info = &requested
+			}
+			transfer := *info
+			info = nil
+			if err := s.upload(filePath, transfer); err != nil {
+				return err
+			}
+			s.queue.uploaded(filePath)
+			return nil
+		},
+	})
+}
+
+// requestUpload asks the server for a new transfer of the file, the change it belongs to is already recorded.
+func (s *SyncService) requestUpload(filePath string) (share.TransferInfo, error) {
+	req := share.UploadRequest{ClientRequest: s.clientRequest(), FilePath: s.remotePath(filePath)}
+	var res share.UploadResponse
+	if _, err := s.request("upload-file", req, &res); err != nil {
+		return share.TransferInfo{}, err
+	}
+	return res.TransferInfo, nil
+}
+
+// scheduleDownload queues the download of a changed file, its metadata is restored once it's complete.
+// The outcome arrives on the returned channel.
+func (s *SyncService) scheduleDownload(filePath string, metadata *share.FileMetadata) <-chan error {
+	var size int64
+	if metadata != nil {
+		size = metadata.Size
+	}
+	return s.transfers.Start(&transferJob{
+		Kind:     DownloadTransfer,
+		Path:     filePath,
+		Size:     size,
+		Priority: syncPriority,
+		run: func() error {
+			if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+				return err
+			}
+			if err := s.downloadPath(filePath); errors.Is(err, errRemoteNotFound) {
+				// removed or moved since, the change that did it follows in the feed
+				slog.Info("Download superseded", "path", filePath)
+				return nil
+			} else if err != nil {
+				return err
+			}
+			applyMetadata(filePath, metadata)
+			return nil
+		},
+	})
+}
+
+// downloadNow runs a download a user asked for ahead of the sync transfers and waits for it.
+func (s *SyncService) downloadNow(filePath string, size int64, download func() error) error {
+	return s.transfers.Do(&transferJob{
+		Kind:     DownloadTransfer,
+		Path:     filePath,
+		Size:     size,
+		Priority: userPriority,
+		run:      download,
+	})
+}
@@ -0,0 +1,110 @@
+package client
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync_server/share"
+)
+
+// selectiveSync holds the remote subtrees this device doesn't sync, the http api changes them while syncing runs.
+type selectiveSync struct {
+	sync.RWMutex
+	excluded []string
+}
+
+func underPath(path string, dir string) bool {
+	dir = strings.TrimSuffix(dir, "/")
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// Excluded tells whether the path is inside an excluded subtree.
+func (s *SyncService) Excluded(path string) bool {
+	s.selective.RLock()
+	defer s.selective.RUnlock()
+	for _, dir := range s.selective.excluded {
+		if underPath(path, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *SyncService) ExcludedPaths() []string {
+	s.selective.RLock()
+	defer s.selective.RUnlock()
+	return slices.Clone(s.selective.excluded)
+}
+
+func (s *SyncService) setExcluded(excluded []string) error {
+	s.selective.excluded = excluded
+	s.Cfg.SyncExclude = excluded
+	return share.SetClientConfig("sync_exclude", excluded)
+}
+
+// ExcludePath stops syncing the subtree to this device. Local copies are only removed when they match what
+// the server stores, the paths of the ones that don't are returned so nothing unsynced is lost.
+func (s *SyncService) ExcludePath(path string) ([]string, error) {
+	path = filepath.Clean(path)
+	s.selective.Lock()
+	if !slices.Contains(s.selective.excluded, path) {
+		if err := s.setExcluded(append(slices.Clone(s.selective.excluded), path)); err != nil {
+			s.selective.Unlock()
+			return nil, err
+		}
+	}
+	s.selective.Unlock()
+	entries, err := s.ListRemote(path)
+	if err != nil {
+		return nil, fmt.Errorf("error listing remote files: %w", err)
+	}
+	remote := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		remote[entry.Path] = entry.Hash
+	}
+	kept := []string{}
+	dirs := []string{}
+	err = filepath.WalkDir(path, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			dirs = append(dirs, filePath)
+			return nil
+		}
+		digest, err := share.FileDigest(filePath)
+		if err != nil || remote[filePath] == "" || remote[filePath] != digest {
+			kept = append(kept, filePath)
+			return nil
+		}
+		return os.Remove(filePath)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return kept, err
+	}
+	// deepest first, folders still holding unsynced files stay
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
+	return kept, nil
+}
+
+// IncludePath syncs the subtree to this device again and downloads what the server stores under it.
+func (s *SyncService) IncludePath(path string) ([]string, map[string]string, error) {
+	path = filepath.Clean(path)
+	s.selective.Lock()
+	excluded := slices.DeleteFunc(slices.Clone(s.selective.excluded), func(dir string) bool {
+		return dir == path
+	})
+	err := s.setExcluded(excluded)
+	s.selective.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	downloaded, failed := s.DownloadRemote([]string{path})
+	return downloaded, failed, nil
+}
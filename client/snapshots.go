@@ -0,0 +1,86 @@
+package client
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync_server/share"
+	"time"
+)
+
+func (s *SyncService) CreateSnapshot(name string, dir string, at time.Time) (share.Snapshot, error) {
+	var snapshot share.Snapshot
+	_, err := s.request("create-snapshot", share.SnapshotRequest{ClientRequest: s.clientRequest(), Name: name, Dir: dir, At: at}, &snapshot)
+	return snapshot, err
+}
+
+func (s *SyncService) ListSnapshots(dir string) ([]share.Snapshot, error) {
+	var snapshots []share.Snapshot
+	_, err := s.request("list-snapshots", share.SnapshotRequest{ClientRequest: s.clientRequest(), Dir: dir}, &snapshots)
+	return snapshots, err
+}
+
+// SnapshotFiles lists the files of a named snapshot, or of dir as it was at the given time when name is empty.
+func (s *SyncService) SnapshotFiles(name string, dir string, at time.Time) ([]share.SnapshotFile, error) {
+	var files []share.SnapshotFile
+	_, err := s.request("snapshot-files", share.SnapshotRequest{ClientRequest: s.clientRequest(), Name: name, Dir: dir, At: at}, &files)
+	return files, err
+}
+
+// RestoreSnapshot downloads the files of a snapshot back to their paths, or under target keeping their path
+// relative to the snapshot folder. Files that already have the snapshot content are skipped and files the
+// snapshot doesn't know about are left alone. Restoring into the live folder syncs the restored files as new changes.
+func (s *SyncService) RestoreSnapshot(name string, dir string, at time.Time, target string) (int, error) {
+	snapshotDir := dir
+	if name != "" {
+		snapshots, err := s.ListSnapshots("")
+		if err != nil {
+			return 0, err
+		}
+		snapshotDir = ""
+		for _, snapshot := range snapshots {
+			if snapshot.Name == name {
+				snapshotDir = snapshot.Dir
+			}
+		}
+		if snapshotDir == "" {
+			return 0, fmt.Errorf("snapshot %s not found", name)
+		}
+	}
+	files, err := s.SnapshotFiles(name, dir, at)
+	if err != nil {
+		return 0, err
+	}
+	restored := 0
+	for _, file := range files {
+		filePath := file.FilePath
+		if target != "" {
+			rel, err := filepath.Rel(snapshotDir, file.FilePath)
+			if err != nil {
+				return restored, err
+			}
+			filePath = filepath.Join(target, rel)
+		}
+		if digest, err := share.FileDigest(filePath); err == nil && digest == file.Digest {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			return restored, err
+		}
+		err := s.downloadNow(filePath, file.Size, func() error {
+			var res share.DownloadResponse
+			req := share.SnapshotRequest{ClientRequest: s.clientRequest(), Name: name, At: at, FilePath: file.FilePath}
+			if _, err := s.request("download-snapshot-file", req, &res); err != nil {
+				return err
+			}
+			return s.download(res.TransferInfo, filePath)
+		})
+		if err != nil {
+			return restored, fmt.Errorf("error restoring %s: %w", file.FilePath, err)
+		}
+		slog.Info("Restored file from snapshot", "path", filePath, "snapshot", name, "at", at)
+		restored++
+	}
+	return restored, nil
+}
@@ -0,0 +1,92 @@
+package client
+
+import (
+	"os"
+	"sync_server/share"
+	"time"
+)
+
+// quiet period when the client doesn't configure one
+const defaultQuietPeriod = 2 * time.Second
+
+type unstableFile struct {
+	change  share.ChangeRequestChange
+	size    int64
+	modTime time.Time
+	// since when size and modification time didn't change
+	since time.Time
+}
+
+// stabilityDetector holds back the changes of files still being written, a file is released once its size and
+// modification time stay the same for the quiet period or once its writer closes it. The events of a file
+// are coalesced so it's released exactly once.
+type stabilityDetector struct {
+	quiet   time.Duration
+	pending map[string]*unstableFile
+}
+
+func newStabilityDetector(quietPeriod int) *stabilityDetector {
+	quiet := time.Duration(quietPeriod) * time.Millisecond
+	if quiet <= 0 {
+		quiet = defaultQuietPeriod
+	}
+	return &stabilityDetector{quiet: quiet, pending: make(map[string]*unstableFile)}
+}
+
+// checkInterval is how often the pending files are looked at.
+func (d *stabilityDetector) checkInterval() time.Duration {
+	return max(d.quiet/4, 100*time.Millisecond)
+}
+
+// track holds the change back, a file created and written to is still released as created.
+func (d *stabilityDetector) track(path string, change share.ChangeRequestChange) {
+	file, ok := d.pending[path]
+	if !ok {
+		d.pending[path] = &unstableFile{change: change, since: time.Now()}
+		return
+	}
+	if file.change.ChangeEvent == "WRITE" {
+		file.change = change
+	}
+	file.since = time.Now()
+}
+
+func (d *stabilityDetector) tracked(path string) bool {
+	_, ok := d.pending[path]
+	return ok
+}
+
+func (d *stabilityDetector) forget(path string) {
+	delete(d.pending, path)
+}
+
+// closed releases the file its writer just closed.
+func (d *stabilityDetector) closed(path string) (share.ChangeRequestChange, bool) {
+	file, ok := d.pending[path]
+	if !ok {
+		return share.ChangeRequestChange{}, false
+	}
+	delete(d.pending, path)
+	return file.change, true
+}
+
+// stable releases the files that didn't change for the quiet period, files that are gone are dropped.
+func (d *stabilityDetector) stable() map[string]share.ChangeRequestChange {
+	stable := make(map[string]share.ChangeRequestChange)
+	for path, file := range d.pending {
+		info, err := os.Lstat(path)
+		if err != nil {
+			delete(d.pending, path)
+			continue
+		}
+		if info.Size() != file.size || !info.ModTime().Equal(file.modTime) {
+			file.size, file.modTime, file.since = info.Size(), info.ModTime(), time.Now()
+			continue
+		}
+		if time.Since(file.since) >= d.quiet {
+			stable[path] = file.change
+			delete(d.pending, path)
+		}
+	}
+	return stable
+}
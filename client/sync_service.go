@@ -1,19 +1,27 @@
 package client
 
 import (
-	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
 	"net"
 	"os"
-	"runtime"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
 	"sync_server/share"
 	"time"
 )
 
+const (
+	dialTimeout = 5 * time.Second
+)
+
 type ChangeEvent struct {
 	Dir  string
 	File share.ChangeRequestChange
@@ -21,232 +29,668 @@ type ChangeEvent struct {
 }
 
 type SyncService struct {
-	Cfg        *share.ClientConfig
-	NatsConn   *share.NatsConn
-	ChangeChan chan ChangeEvent
-	done       chan bool
+	Cfg      *share.ClientConfig
+	NatsConn *share.NatsConn
+	// changes of the watcher waiting to be sent, backed by the outbox on disk
+	queue  *changeQueue
+	queued chan struct{}
+	// uploads and downloads, a bounded number at once
+	transfers *transferScheduler
+	bandwidth *bandwidth
+	done      chan bool
+	// a retrieval still running when the next one is due is left to finish, refetch makes it run once more
+	retrieving atomic.Bool
+	refetch    atomic.Bool
+	selective  selectiveSync
+	ignore     ignoreRules
+	// paths the client is changing itself, the watcher leaves their events out
+	writes *ownWrites
 }
 
 func NewSyncService(cfg *share.ClientConfig) *SyncService {
-	service := &SyncService{
-		Cfg:        cfg,
-		NatsConn:   share.NewNatsConn(cfg.NatsUrl),
-		ChangeChan: make(chan ChangeEvent, 100),
-		done:       make(chan bool),
+	service := NewCommandService(cfg)
+	uploads, err := service.queue.loadOutbox()
+	if err != nil {
+		slog.Error("Error loading outbox", "err", err)
+	}
+	for _, path := range uploads {
+		// the change is recorded already, only its transfer is started again
+		service.scheduleUpload(path, nil)
 	}
 	go service.Listen()
 	return service
 }
 
+// NewCommandService is a sync service for a single command, it doesn't sync anything on its own.
+func NewCommandService(cfg *share.ClientConfig) *SyncService {
+	s := &SyncService{
+		Cfg:       cfg,
+		NatsConn:  share.NewNatsConn(cfg.NatsUrl),
+		queue:     newChangeQueue(),
+		queued:    make(chan struct{}, 1),
+		transfers: newTransferScheduler(cfg.TransferConcurrency),
+		bandwidth: newBandwidth(cfg.BandwidthLimit, cfg.SyncWindows),
+		done:      make(chan bool),
+		selective: selectiveSync{excluded: cfg.SyncExclude},
+		writes:    newOwnWrites(),
+	}
+	// compile the configured ignore patterns up front rather than on the first change
+	s.globalRules("")
+	return s
+}
+
+// Enqueue queues a change of the watcher, it never blocks: the queue grows in memory and spills to the outbox.
+func (s *SyncService) Enqueue(change ChangeEvent) {
+	s.queue.add(change)
+	select {
+	case s.queued <- struct{}{}:
+	default:
+	}
+}
+
+// Listen queues the changes of the watcher and hands them to the flusher once they settle,
+// and retrieves the changes of the other devices when the server announces them.
 func (s *SyncService) Listen() {
-	ticker := time.NewTicker(time.Duration(s.Cfg.SyncInterval) * time.Second)
+	interval := time.Duration(s.Cfg.SyncInterval) * time.Second
+	if s.subscribeChanges() {
+		interval = max(interval, safetySyncInterval)
+	}
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
+	// catch up with what changed while the client wasn't running
+	s.retrieve()
+	// the sync windows are checked every minute
+	windows := time.NewTicker(time.Minute)
+	defer windows.Stop()
+	queue := s.queue
+	flush := make(chan struct{}, 1)
+	go s.flusher(queue, flush)
+	debounce := time.NewTimer(queue.due())
 
 	for {
 		select {
+		case <-s.queued:
+			// a burst of changes is saved once
+			if err := queue.save(); err != nil {
+				slog.Error("Error saving outbox", "err", err)
+			}
+			debounce.Reset(queue.due())
+		case <-debounce.C:
+			if queue.len() == 0 {
+				continue
+			}
+			// a flush already waiting takes whatever is queued when the flusher gets to it
+			select {
+			case flush <- struct{}{}:
+			default:
+			}
 		case <-ticker.C:
-			go s.syncChanges()
-			go s.retrieveChanges()
+			s.retrieve()
+		case <-windows.C:
+			s.bandwidth.apply()
 		case <-s.done:
 			fmt.Println("Shutting down SyncService...")
 			return
-		default:
-
-			if len(s.ChangeChan) > 10 {
-				go s.syncChanges()
-			}
-			time.Sleep(100 * time.Millisecond)
 		}
 	}
 }
+
+// retrieveChanges applies the change feed of the device in order and acknowledges, for every server, the change logs
+// applied completely, downloads included. What wasn't acknowledged is delivered again by the next retrieval.
 func (s *SyncService) retrieveChanges() {
 	slog.Info("Retrieve changes")
-	runningSystem := runtime.GOOS
-	req, err := json.Marshal(share.ClientRequest{ClientId: s.Cfg.ClientId, Time: time.Now(), Agent: runningSystem})
-	if err != nil {
-		slog.Error("Retrieve changes parsing request", "err", err.Error())
-		return
-	}
-	msg, err := s.NatsConn.RequestToSubject("sync", req, time.Second)
-	if err != nil {
+	var res []share.SyncResponse
+	if _, err := s.request("sync", s.clientRequest(), &res); err != nil {
 		slog.Error("Retrieve changes request", "err", err.Error())
 		return
 	}
-	var serverResp share.ServerResponse
-	if err := json.Unmarshal(msg.Data, &serverResp); err != nil {
-		slog.Error("Error unmarshalling server response:", "err", err)
+
+	acks := make(map[string]int64)
+	for _, changeRes := range res {
+		if err := s.applyLog(changeRes); err != nil {
+			slog.Error("Error applying change log", "dir", changeRes.Dir, "server", changeRes.ServerId, "seq", changeRes.Seq, "err", err)
+			// the logs after it wait for their redelivery so they are applied in order
+			break
+		}
+		if changeRes.Seq != 0 {
+			acks[changeRes.ServerId] = changeRes.Seq
+		}
+	}
+	if len(acks) == 0 || s.Cfg.DeviceId == "" {
 		return
 	}
-
-	if serverResp.Status != "success" {
-		slog.Error("Failure response from server:", "Response", serverResp.Data)
+	if _, err := s.request("ack-changes", share.AckRequest{ClientRequest: s.clientRequest(), Seqs: acks}, nil); err != nil {
+		slog.Error("Error acknowledging changes", "seqs", acks, "err", err)
 		return
 	}
+	// the feed is sent in batches, more may be waiting
+	s.refetch.Store(true)
+}
 
-	var res []share.SyncResponse
-	json.Unmarshal([]byte(serverResp.Data), &res)
+// applyLog applies the changes of a change log and waits for the downloads they started,
+// so the file operations of the next log can't overtake them. The changes this device made are left alone.
+func (s *SyncService) applyLog(changeRes share.SyncResponse) error {
+	if changeRes.DeviceId != "" && changeRes.DeviceId == s.Cfg.DeviceId {
+		return nil
+	}
+	var downloads []<-chan error
+	for _, change := range changeRes.Changes {
+		download, err := s.applyChange(changeRes.Dir, change)
+		if err != nil {
+			return fmt.Errorf("%s of %s: %w", change.ChangeEvent, change.FileName, err)
+		}
+		if download != nil {
+			downloads = append(downloads, download)
+		}
+	}
+	return <-waitAll(downloads)
+}
 
-	// TODO: apply other device changes here
-	for _, changeRes := range res {
-		for _, change := range changeRes.Changes {
-			if change.Agent != runningSystem {
-				s.applyChange(changeRes.Dir, change)
-			}
+// applyChange applies the change of another device, the download it starts reports on the returned channel.
+func (s *SyncService) applyChange(dir string, change share.ChangeRequestChange) (<-chan error, error) {
+	filePath := fmt.Sprintf("%s/%s", dir, change.FileName)
+	written := []string{filePath}
+	if change.OldPath != "" {
+		written = append(written, change.OldPath)
+	}
+	defer s.writes.begin(written...)()
+	if change.ChangeEvent == share.MoveChange && change.Dir {
+		return s.applyDirMove(change.OldPath, filePath)
+	}
+	if change.ChangeEvent == share.MoveChange {
+		return s.applyMove(change.OldPath, filePath, change.Metadata)
+	}
+	if !s.syncs(filePath) {
+		return nil, nil
+	}
+	switch changeKind(change.ChangeEvent) {
+	case "CREATE", "WRITE":
+		return s.applyContent(filePath, change.Metadata)
+	case share.MetadataChange:
+		applyMetadata(filePath, change.Metadata)
+	case "CHMOD":
+		// recorded before metadata was synced, it carries nothing to apply
+	case "REMOVE", "RENAME":
+		// a renamed file recorded before moves were paired left its path, the new one arrives as a change of its own
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("error removing file: %w", err)
+		}
+	case share.DirCreateChange:
+		if err := os.MkdirAll(filePath, 0755); err != nil {
+			return nil, fmt.Errorf("error creating folder: %w", err)
 		}
+	case share.DirRemoveChange:
+		if err := s.removeDir(filePath); err != nil {
+			return nil, fmt.Errorf("error removing folder: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown change %s", change.ChangeEvent)
 	}
+	return nil, nil
 }
-func (s *SyncService) applyChange(dir string, change share.ChangeRequestChange) {
 
-	switch change.ChangeEvent {
-	case "CREATE":
-		// TODO: download file from storage
-		req, _ := json.Marshal(share.DownloadRequest{ClientRequest: share.ClientRequest{ClientId: s.Cfg.ClientId, Time: time.Now(), Agent: runtime.GOOS}, FilePath: fmt.Sprintf("%s%s/%s", s.Cfg.ClientId, dir, change.FileName)})
-		msg, err := s.NatsConn.RequestToSubject("download-file", req, time.Second)
+// removeDir removes what the device syncs under the folder, deepest first. Ignored and excluded content
+// is left alone, and so are the folders still holding some.
+func (s *SyncService) removeDir(dir string) error {
+	paths := []string{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
-			slog.Error("Error downloading file", "err", err)
-			return
+			if path == dir && os.IsNotExist(err) {
+				return filepath.SkipAll
+			}
+			return err
 		}
-		var res share.ServerResponse
-		err = json.Unmarshal(msg.Data, &res)
-		if err != nil {
-			slog.Error("Error unmarshaling download response", "err", err)
-			return
+		if path != dir && !s.syncs(path) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
 		}
-		var downloadRes share.DownloadResponse
-		err = json.Unmarshal([]byte(res.Data), &downloadRes)
-		if err != nil {
-			slog.Error("Error unmarshaling download response", "err", err)
-			return
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// a folder is walked before what it holds
+	for i := len(paths) - 1; i >= 0; i-- {
+		err := os.Remove(paths[i])
+		if err == nil || os.IsNotExist(err) {
+			continue
 		}
-		fileBytes, err := s.downloadFile(downloadRes.Port)
-		if err != nil {
-			slog.Error("Error downloading file", "err", err)
-			return
+		if entries, readErr := os.ReadDir(paths[i]); readErr == nil && len(entries) > 0 {
+			continue
 		}
-		os.WriteFile(fmt.Sprintf("%s/%s", dir, change.FileName), fileBytes, 0644)
-	case "REMOVE":
-		os.Remove(fmt.Sprintf("%s/%s", dir, change.FileName))
+		return err
 	}
-	// todo: after applying the change we should record it and don't apply it later
+	return nil
+}
 
+// OwnWrite tells whether the watcher event of path comes from the client applying a change of another device.
+func (s *SyncService) OwnWrite(path string) bool {
+	return s.writes.owns(path)
 }
-func (s *SyncService) syncChanges() {
-	slog.Info("Syncing changes", "items in channel", len(s.ChangeChan))
 
-	dirMap := make(map[string][]share.ChangeRequestChange)
-	reqs := make([]share.ChangeRequest, 0)
+// syncs tells whether the device keeps a copy of the path.
+func (s *SyncService) syncs(path string) bool {
+	if s.Excluded(path) {
+		return false
+	}
+	if res := s.Ignored(path); res.Ignored {
+		slog.Debug("Ignoring change", "path", path, "rule", res.Rule, "source", res.Source)
+		return false
+	}
+	return true
+}
 
-	for {
-		select {
-		case change := <-s.ChangeChan:
-			dirMap[change.Dir] = append(dirMap[change.Dir], change.File)
-		default:
-			if len(dirMap) == 0 {
-				return
+// applyMove renames the local copy instead of downloading it again, the file is only downloaded
+// when the device has no copy under the old path.
+func (s *SyncService) applyMove(oldPath string, newPath string, metadata *share.FileMetadata) (<-chan error, error) {
+	if !s.syncs(newPath) {
+		if s.syncs(oldPath) {
+			os.Remove(oldPath)
+		}
+		return nil, nil
+	}
+	if _, err := os.Lstat(oldPath); err == nil && s.syncs(oldPath) {
+		err := os.MkdirAll(filepath.Dir(newPath), 0755)
+		if err == nil {
+			err = os.Rename(oldPath, newPath)
+		}
+		if err == nil {
+			applyMetadata(newPath, metadata)
+			return nil, nil
+		}
+		slog.Error("Error moving file", "from", oldPath, "to", newPath, "err", err)
+	}
+	return s.applyContent(newPath, metadata)
+}
+
+// applyDirMove renames the local folder, a device without a copy of it gets what the server stores under the new path.
+func (s *SyncService) applyDirMove(oldPath string, newPath string) (<-chan error, error) {
+	if !s.syncs(newPath) {
+		// the folder left what the device syncs, it goes the way of a removed one
+		return s.applyChange(filepath.Dir(oldPath), share.ChangeRequestChange{FileName: filepath.Base(oldPath), ChangeEvent: share.DirRemoveChange})
+	}
+	if info, err := os.Lstat(oldPath); err == nil && info.IsDir() && s.syncs(oldPath) {
+		err := os.MkdirAll(filepath.Dir(newPath), 0755)
+		if err == nil {
+			err = os.Rename(oldPath, newPath)
+		}
+		if err == nil {
+			return nil, nil
+		}
+		slog.Error("Error moving folder", "from", oldPath, "to", newPath, "err", err)
+	}
+	if err := os.MkdirAll(newPath, 0755); err != nil {
+		return nil, fmt.Errorf("error creating folder: %w", err)
+	}
+	entries, err := s.ListRemote(newPath)
+	if err != nil {
+		return nil, fmt.Errorf("error listing moved folder: %w", err)
+	}
+	downloads := []<-chan error{}
+	for _, entry := range entries {
+		if !s.syncs(entry.Path) {
+			continue
+		}
+		if entry.Dir {
+			if err := os.MkdirAll(entry.Path, 0755); err != nil {
+				return nil, fmt.Errorf("error creating folder: %w", err)
 			}
+			continue
+		}
+		download, err := s.applyContent(entry.Path, entry.Metadata)
+		if err != nil {
+			return nil, err
+		}
+		if download != nil {
+			downloads = append(downloads, download)
+		}
+	}
+	return waitAll(downloads), nil
+}
 
-			// Convert dirMap to requests
-			for dir, changedFiles := range dirMap {
-				reqs = append(reqs, share.ChangeRequest{
-					ClientRequest: share.ClientRequest{
-						ClientId: s.Cfg.ClientId,
-						Time:     time.Now(),
-						Agent:    runtime.GOOS,
-					},
-					Dir:     dir,
-					Changes: changedFiles,
-				})
+// waitAll reports the first error of the downloads once they all finished.
+func waitAll(downloads []<-chan error) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		var first error
+		for _, download := range downloads {
+			if err := <-download; err != nil && first == nil {
+				first = err
 			}
+		}
+		done <- first
+	}()
+	return done
+}
 
-			for _, req := range reqs {
-				reqJson, err := json.Marshal(req)
-				if err != nil {
-					slog.Error("Error marshaling change request:", "err", err)
-					continue
-				}
+// applyContent creates the symlink or queues the download of the file, which restores its metadata.
+func (s *SyncService) applyContent(filePath string, metadata *share.FileMetadata) (<-chan error, error) {
+	if metadata != nil && metadata.LinkTarget != "" {
+		if err := s.applyLink(filePath, metadata.LinkTarget); err != nil {
+			return nil, fmt.Errorf("error creating symlink to %s: %w", metadata.LinkTarget, err)
+		}
+		return nil, nil
+	}
+	return s.scheduleDownload(filePath, metadata), nil
+}
 
-				msg, err := s.NatsConn.RequestToSubject("change", reqJson, time.Second*3)
-				if err != nil {
-					slog.Error("Error sending message to NATS:", "err", err)
-					continue
-				}
+// downloadPath downloads the stored version of the local path.
+func (s *SyncService) downloadPath(filePath string) error {
+	defer s.writes.begin(filePath)()
+	req := share.DownloadRequest{ClientRequest: s.clientRequest(), FilePath: s.remotePath(filePath), Delta: hasDeltaBase(filePath)}
+	var downloadRes share.DownloadResponse
+	if _, err := s.request("download-file", req, &downloadRes); err != nil {
+		return err
+	}
+	return s.download(downloadRes.TransferInfo, filePath)
+}
 
-				var serverResp share.ServerResponse
-				if err := json.Unmarshal(msg.Data, &serverResp); err != nil {
-					slog.Error("Error unmarshalling server response:", "err", err)
-					continue
-				}
+// compression is the compression the client accepts for its transfers.
+func (s *SyncService) compression() string {
+	if s.Cfg.Compression {
+		return share.ZstdCompression
+	}
+	return ""
+}
 
-				if serverResp.Status != "success" {
-					slog.Error("Failure response from server:", "Response", serverResp.Data)
-					continue
-				}
+// remotePath is the key the server stores the local file under.
+func (s *SyncService) remotePath(filePath string) string {
+	return s.Cfg.ClientId + filePath
+}
 
-				var changeRes share.ChangeResponse
-				err = json.Unmarshal([]byte(serverResp.Data), &changeRes)
-				if err != nil {
-					slog.Error("Error unmarshaling change response:", "err", err)
-					continue
-				}
+// syncChanges sends a batch of changes, one request per folder in the order they happened, and uploads what the server asks for.
+// It returns the changes the server couldn't be reached for.
+func (s *SyncService) syncChanges(batch []ChangeEvent) []ChangeEvent {
+	slog.Info("Syncing changes", "changes", len(batch))
 
-				for fileName, port := range changeRes {
-					for parentDir, changes := range dirMap {
-						for _, change := range changes {
-							if change.FileName == fileName {
-								go s.uploadFile(fmt.Sprintf("%s/%s", parentDir, fileName), port)
-							}
-						}
-					}
+	reqs := make([]share.ChangeRequest, 0)
+	dirs := make(map[string]int)
+	for _, change := range batch {
+		i, ok := dirs[change.Dir]
+		if !ok {
+			i = len(reqs)
+			dirs[change.Dir] = i
+			reqs = append(reqs, share.ChangeRequest{
+				ClientRequest: s.clientRequest(),
+				Dir:           change.Dir,
+			})
+		}
+		reqs[i].Changes = append(reqs[i].Changes, change.File)
+	}
+	failed := []ChangeEvent{}
+	for _, req := range reqs {
+		reqJson, err := json.Marshal(req)
+		if err != nil {
+			slog.Error("Error marshaling change request:", "err", err)
+			continue
+		}
+
+		// the changes of a request the server didn't apply stay in the outbox to be sent again
+		retry := func() {
+			for _, change := range batch {
+				if change.Dir == req.Dir {
+					failed = append(failed, change)
 				}
 			}
+		}
+		msg, err := s.NatsConn.RequestToSubject("change", reqJson, time.Second*3)
+		if err != nil {
+			slog.Error("Error sending message to NATS:", "err", err)
+			retry()
+			continue
+		}
 
-			// Clear the map and slice
-			reqs = reqs[:0]
-			dirMap = make(map[string][]share.ChangeRequestChange)
-			return
+		var serverResp share.ServerResponse
+		if err := json.Unmarshal(msg.Data, &serverResp); err != nil {
+			slog.Error("Error unmarshalling server response:", "err", err)
+			retry()
+			continue
+		}
+
+		if serverResp.Status != "success" {
+			slog.Error("Failure response from server:", "Response", serverResp.Data)
+			retry()
+			continue
+		}
+
+		var changeRes share.ChangeResponse
+		err = json.Unmarshal([]byte(serverResp.Data), &changeRes)
+		if err != nil {
+			slog.Error("Error unmarshaling change response:", "err", err)
+			retry()
+			continue
+		}
+
+		// one transfer per file of the request, however many of its changes were coalesced
+		for fileName, info := range changeRes {
+			s.scheduleUpload(fmt.Sprintf("%s/%s", req.Dir, fileName), &info)
 		}
 	}
+	return failed
 }
 
-func (s *SyncService) uploadFile(filePath string, port int) {
-	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", port))
+func (s *SyncService) upload(filePath string, info share.TransferInfo) error {
+	switch info.Mode {
+	case share.NatsTransfer:
+		if err := s.uploadFileNats(filePath, info); err != nil {
+			return fmt.Errorf("error sending file over nats: %w", err)
+		}
+	case share.ChunkTransfer:
+		if err := s.uploadFileChunks(filePath, info); err != nil {
+			return fmt.Errorf("error sending file chunks: %w", err)
+		}
+	default:
+		return s.uploadFile(filePath, info)
+	}
+	return nil
+}
+
+// download streams the file into filePath.partial and only replaces filePath once the transfer is complete.
+// The partial file is kept when a transfer fails so the next attempt, even after a restart, resumes from where it stopped.
+// Delta transfers are rebuilt from the current filePath and always start over.
+func (s *SyncService) download(info share.TransferInfo, filePath string) error {
+	var base *deltaBase
+	if info.Delta {
+		var err error
+		base, err = openDeltaBase(filePath)
+		if err != nil {
+			return err
+		}
+		defer base.Close()
+	}
+	partialPath := filePath + share.PartialSuffix
+	partial, err := os.OpenFile(partialPath, os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		slog.Error("error dialing to %d: %s", port, err.Error())
-		return
+		return err
+	}
+	var digest string
+	if info.Mode == share.NatsTransfer {
+		digest, err = s.downloadFileNats(info.Subject, partial, base)
+	} else {
+		digest, err = s.downloadFile(info, partial, base)
+	}
+	if closeErr := partial.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := verifyDigest(partialPath, digest); err != nil {
+		os.Remove(partialPath)
+		return err
+	}
+	return os.Rename(partialPath, filePath)
+}
+
+// verifyDigest checks the downloaded file against the digest the server stored, objects stored without one are trusted.
+func verifyDigest(filePath string, digest string) error {
+	if digest == "" {
+		return nil
+	}
+	received, err := share.FileDigest(filePath)
+	if err != nil {
+		return err
+	}
+	if received != digest {
+		return fmt.Errorf("checksum mismatch for %s: expected %s, received %s", filePath, digest, received)
 	}
-	fileSize, _ := share.GetSize(filePath)
+	return nil
+}
+
+// resumeAt moves the partial file to the offset the server is going to send from.
+func resumeAt(partial *os.File, offset int64) error {
+	if err := partial.Truncate(offset); err != nil {
+		return err
+	}
+	_, err := partial.Seek(offset, io.SeekStart)
+	return err
+}
+
+// dialTransfer tries every address the server advertised until one of them answers.
+func dialTransfer(info share.TransferInfo) (net.Conn, error) {
+	hosts := info.Hosts
+	if len(hosts) == 0 {
+		hosts = []string{""}
+	}
+	var errs []error
+	for _, host := range hosts {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(info.Port)), dialTimeout)
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (s *SyncService) uploadFile(filePath string, info share.TransferInfo) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("error opening file: %w", err)
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("error opening file: %w", err)
+	}
+	conn, err := dialTransfer(info)
+	if err != nil {
+		return fmt.Errorf("error dialing to server: %w", err)
+	}
+	defer conn.Close()
+	conn = s.bandwidth.limited(conn)
+	digest, err := share.FileDigest(filePath)
+	if err != nil {
+		return fmt.Errorf("error hashing file: %w", err)
+	}
+	fileSize := stat.Size()
 	err = binary.Write(conn, binary.BigEndian, fileSize)
 	if err != nil {
-		slog.Error("error sending file to %d: %s", port, err.Error())
-		return
+		return fmt.Errorf("error sending file to server: %w", err)
 	}
-	fileByte, _ := os.ReadFile(filePath)
-	_, err = io.CopyN(conn, bytes.NewReader(fileByte), fileSize)
+	err = binary.Write(conn, binary.BigEndian, share.EncodeDigest(digest))
 	if err != nil {
-		slog.Error("error sending file to %d: %s", port, err.Error())
-		return
+		return fmt.Errorf("error sending file to server: %w", err)
+	}
+	var offset int64
+	err = binary.Read(conn, binary.BigEndian, &offset)
+	if err != nil {
+		return fmt.Errorf("error reading upload offset: %w", err)
+	}
+	var content io.Reader
+	if info.Delta {
+		delta := deltaSource(file, s.remoteSignature(filePath, fileSize))
+		defer delta.Close()
+		content = delta
+	} else if _, err = file.Seek(offset, io.SeekStart); err == nil {
+		content = io.LimitReader(file, fileSize-offset)
 	}
+	if err == nil {
+		err = share.WriteContent(conn, content, info.Compression != "")
+	}
+	if err != nil {
+		return fmt.Errorf("error sending file to server: %w", err)
+	}
+	var status byte
+	err = binary.Read(conn, binary.BigEndian, &status)
+	if err != nil || status != share.TransferOk {
+		return fmt.Errorf("server failed to store file %s", filePath)
+	}
+	return nil
 }
 
-func (s *SyncService) downloadFile(port int) ([]byte, error) {
-	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", port))
+func (s *SyncService) downloadFile(info share.TransferInfo, partial *os.File, base *deltaBase) (string, error) {
+	conn, err := dialTransfer(info)
 	if err != nil {
-		slog.Error("error dialing to %d: %s", port, err.Error())
-		return nil, err
+		slog.Error("error dialing to server", "port", info.Port, "err", err.Error())
+		return "", err
 	}
+	defer conn.Close()
+	conn = s.bandwidth.limited(conn)
 
-	buf := new(bytes.Buffer)
-	var size int64
-	err = binary.Read(conn, binary.BigEndian, &size)
+	if base != nil {
+		err = writeSignature(conn, base.sig)
+	} else {
+		err = sendDownloadOffset(conn, partial)
+	}
+	if err != nil {
+		slog.Error("Failed to send download offset", "err", err)
+		return "", err
+	}
+	header := make([]int64, 2)
+	err = binary.Read(conn, binary.BigEndian, header)
 	if err != nil {
 		slog.Error("Failed to read file size", "err", err)
-		return nil, err
+		return "", err
+	}
+	size, offset := header[0], header[1]
+	var rawDigest [sha256.Size]byte
+	err = binary.Read(conn, binary.BigEndian, &rawDigest)
+	if err != nil {
+		slog.Error("Failed to read file digest", "err", err)
+		return "", err
+	}
+	slog.Info("Size received", "size", size, "offset", offset)
+	if err := resumeAt(partial, offset); err != nil {
+		return "", err
+	}
+	wire, err := share.ReadContent(conn, info.Compression != "")
+	if err != nil {
+		slog.Error("Failed to read content compression", "err", err)
+		return "", err
+	}
+	defer wire.Close()
+	if base != nil {
+		err = share.ApplyDelta(partial, base.file, base.sig.BlockSize, wire)
+	} else {
+		_, err = io.CopyN(partial, wire, size-offset)
 	}
-	slog.Info("Size received", "size", size)
-	_, err = io.CopyN(buf, conn, size)
 	if err != nil {
 		slog.Error("File reception error", "err", err)
-		return nil, err
+		return "", err
+	}
+	return share.DecodeDigest(rawDigest), nil
+}
+
+func sendDownloadOffset(conn net.Conn, partial *os.File) error {
+	stat, err := partial.Stat()
+	if err != nil {
+		return err
+	}
+	return binary.Write(conn, binary.BigEndian, stat.Size())
+}
+
+func writeSignature(conn net.Conn, sig share.Signature) error {
+	data, err := json.Marshal(sig)
+	if err != nil {
+		return err
+	}
+	if err := binary.Write(conn, binary.BigEndian, uint32(len(data))); err != nil {
+		return err
 	}
-	return buf.Bytes(), nil
+	_, err = conn.Write(data)
+	return err
 }
@@ -0,0 +1,20 @@
+package client
+
+import "sync_server/share"
+
+func (s *SyncService) ListTrash() ([]share.TrashEntry, error) {
+	var entries []share.TrashEntry
+	_, err := s.request("list-trash", share.TrashRequest{ClientRequest: s.clientRequest()}, &entries)
+	return entries, err
+}
+
+// RestoreTrash asks the server to restore a deleted file, it comes back on every device as a new change.
+func (s *SyncService) RestoreTrash(id string) (share.TrashEntry, error) {
+	var entry share.TrashEntry
+	_, err := s.request("restore-trash", share.TrashRequest{ClientRequest: s.clientRequest(), Id: id}, &entry)
+	return entry, err
+}
+
+func (s *SyncService) PurgeTrash(id string) (string, error) {
+	return s.request("purge-trash", share.TrashRequest{ClientRequest: s.clientRequest(), Id: id}, nil)
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"os"
 	"sync_server/client"
 	"sync_server/share"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -10,15 +14,51 @@ import (
 func main() {
 	share.InitClientConfig()
 	cfg, err := share.GetClientConfig()
+	if err != nil {
+		panic(err)
+	}
 	if cfg.ClientId == "" {
 		id, _ := uuid.NewUUID()
 		cfg.ClientId = id.String()
 		share.WriteClientConfig()
 	}
-	if err != nil {
-		panic(err)
+	if cfg.DeviceId == "" {
+		id, _ := uuid.NewUUID()
+		cfg.DeviceId = id.String()
+		share.SetClientConfig("device_id", cfg.DeviceId)
 	}
 
+	if len(os.Args) > 1 {
+		if err := runCommand(cfg, os.Args[1], os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 	client.NewClient(cfg).Start()
 
 }
+
+// runCommand runs a one-off client command instead of the sync client.
+func runCommand(cfg *share.ClientConfig, command string, args []string) error {
+	switch command {
+	case "restore-snapshot":
+		flags := flag.NewFlagSet(command, flag.ExitOnError)
+		name := flags.String("name", "", "named snapshot to restore")
+		dir := flags.String("dir", "", "sync folder to restore as it was at -at")
+		at := flags.String("at", "", "RFC3339 time to restore -dir at")
+		target := flags.String("target", "", "folder to restore into instead of the live folder")
+		flags.Parse(args)
+		var atTime time.Time
+		if *at != "" {
+			var err error
+			if atTime, err = time.Parse(time.RFC3339, *at); err != nil {
+				return fmt.Errorf("invalid -at: %w", err)
+			}
+		}
+		restored, err := client.NewCommandService(cfg).RestoreSnapshot(*name, *dir, atTime, *target)
+		fmt.Printf("restored %d files\n", restored)
+		return err
+	}
+	return fmt.Errorf("unknown command %s", command)
+}
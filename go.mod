@@ -5,6 +5,8 @@ go 1.23.4
 require (
 	github.com/fsnotify/fsnotify v1.8.0
 	github.com/google/uuid v1.6.0
+	github.com/klauspost/compress v1.17.11
+	github.com/labstack/echo/v4 v4.13.3
 	github.com/minio/minio-go v6.0.14+incompatible
 	github.com/nats-io/nats.go v1.39.0
 	github.com/spf13/viper v1.19.0
@@ -13,8 +15,6 @@ require (
 require (
 	github.com/go-ini/ini v1.67.0 // indirect
 	github.com/hashicorp/hcl v1.0.0 // indirect
-	github.com/klauspost/compress v1.17.11 // indirect
-	github.com/labstack/echo/v4 v4.13.3 // indirect
 	github.com/labstack/gommon v0.4.2 // indirect
 	github.com/magiconair/properties v1.8.7 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
@@ -0,0 +1,522 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"sync_server/share"
+	"time"
+)
+
+const (
+	chunkPrefix    = "chunks/"
+	manifestPrefix = "manifests/"
+	chunkRefsFile  = "chunks.json"
+	// chunks the server doesn't reference are kept this long for the upload that stored them to commit
+	chunkLeasesFile      = "chunk_leases.json"
+	chunkLeaseTime       = time.Hour
+	chunkCollectInterval = 10 * time.Minute
+)
+
+// ChunkStore is implemented by storages that keep files as deduplicated chunks,
+// it lets clients upload only the chunks the server doesn't have yet.
+type ChunkStore interface {
+	MissingChunks(ctx context.Context, chunks []share.ChunkRef) ([]string, error)
+	PutChunk(ctx context.Context, hash string, data []byte) error
+	CommitManifest(ctx context.Context, fileName string, manifest share.Manifest) error
+}
+
+// objectStore is the part of the object storage chunks and manifests are kept in.
+type objectStore interface {
+	Init() error
+	Upload(ctx context.Context, fileName string, reader io.Reader, size int64) error
+	RemoveFile(fileName string) error
+	Download(ctx context.Context, fileName string) (io.ReadCloser, error)
+	Stat(ctx context.Context, fileName string) (FileInfo, error)
+}
+
+// ChunkStorage keeps every file as a manifest of content defined chunks, each chunk is stored once
+// under its hash no matter how many files, folders or clients share it.
+type ChunkStorage struct {
+	Cfg     *share.ServerConfig
+	objects objectStore
+	// how many manifests reference each chunk, a chunk is deleted once nothing references it
+	refs *jsonIndex[int]
+	// the chunks an upload may still commit and the chunks nothing references anymore, with the time
+	// they may be collected. It's always locked after refs.
+	leases *jsonIndex[time.Time]
+	// chunks being collected, an upload leasing one waits for it to be gone. refs guards it.
+	deletes map[string]chan struct{}
+	// serialises the changes of manifests, so two commits of a file can't both release its previous version
+	commits sync.Mutex
+}
+
+func NewChunkStorage(cfg *share.ServerConfig) *ChunkStorage {
+	storage := newChunkStorage(cfg, NewMinIoService(cfg))
+	go storage.collect()
+	return storage
+}
+
+func newChunkStorage(cfg *share.ServerConfig, objects objectStore) *ChunkStorage {
+	return &ChunkStorage{
+		Cfg:     cfg,
+		objects: objects,
+		refs:    newJSONIndex[int](cfg.LogPath(chunkRefsFile), "chunk references"),
+		leases:  newJSONIndex[time.Time](cfg.LogPath(chunkLeasesFile), "chunk leases"),
+		deletes: make(map[string]chan struct{}),
+	}
+}
+
+func (c *ChunkStorage) lock() {
+	c.refs.Lock()
+	c.leases.Lock()
+	c.refs.load()
+	c.leases.load()
+}
+
+func (c *ChunkStorage) unlock() {
+	c.leases.Unlock()
+	c.refs.Unlock()
+}
+
+func (c *ChunkStorage) Init() error {
+	return c.objects.Init()
+}
+
+// lease keeps the chunks of an upload from being collected until it had the time to commit them,
+// waiting first for the ones being collected right now.
+func (c *ChunkStorage) lease(hashes []string) error {
+	for {
+		c.lock()
+		var deleting chan struct{}
+		for _, hash := range hashes {
+			if done, ok := c.deletes[hash]; ok {
+				deleting = done
+				break
+			}
+		}
+		if deleting == nil {
+			expiry := time.Now().Add(chunkLeaseTime)
+			for _, hash := range hashes {
+				c.leases.entries[hash] = expiry
+			}
+			err := c.leases.save()
+			c.unlock()
+			return err
+		}
+		c.unlock()
+		<-deleting
+	}
+}
+
+func (c *ChunkStorage) hasChunk(ctx context.Context, hash string) bool {
+	c.refs.Lock()
+	c.refs.load()
+	refs := c.refs.entries[hash]
+	c.refs.Unlock()
+	if refs > 0 {
+		return true
+	}
+	// chunks of uploads that weren't committed yet aren't referenced but can still be reused
+	_, err := c.objects.Stat(ctx, chunkPrefix+hash)
+	return err == nil
+}
+
+// MissingChunks leases every chunk of the manifest and returns the ones the server doesn't have.
+func (c *ChunkStorage) MissingChunks(ctx context.Context, chunks []share.ChunkRef) ([]string, error) {
+	hashes := []string{}
+	seen := make(map[string]bool)
+	for _, chunk := range chunks {
+		if !seen[chunk.Hash] {
+			seen[chunk.Hash] = true
+			hashes = append(hashes, chunk.Hash)
+		}
+	}
+	if err := c.lease(hashes); err != nil {
+		return nil, err
+	}
+	missing := []string{}
+	for _, hash := range hashes {
+		if !c.hasChunk(ctx, hash) {
+			missing = append(missing, hash)
+		}
+	}
+	return missing, nil
+}
+
+func (c *ChunkStorage) PutChunk(ctx context.Context, hash string, data []byte) error {
+	if share.ChunkHash(data) != hash {
+		return fmt.Errorf("chunk content doesn't match its hash %s", hash)
+	}
+	if err := c.lease([]string{hash}); err != nil {
+		return err
+	}
+	if c.hasChunk(ctx, hash) {
+		return nil
+	}
+	return c.objects.Upload(ctx, chunkPrefix+hash, bytes.NewReader(data), int64(len(data)))
+}
+
+// CommitManifest points fileName at the chunks a client uploaded, once their content matches the digest of the manifest.
+func (c *ChunkStorage) CommitManifest(ctx context.Context, fileName string, manifest share.Manifest) error {
+	if err := c.verifyManifest(ctx, manifest); err != nil {
+		return fmt.Errorf("manifest of %s: %w", fileName, err)
+	}
+	return c.commit(ctx, fileName, manifest)
+}
+
+// verifyManifest reads the chunks back, they are leased by the upload so none is collected meanwhile.
+func (c *ChunkStorage) verifyManifest(ctx context.Context, manifest share.Manifest) error {
+	offsets := make([]int64, len(manifest.Chunks))
+	var offset int64
+	for i, chunk := range manifest.Chunks {
+		offsets[i] = offset
+		offset += chunk.Size
+	}
+	if offset != manifest.Size {
+		return fmt.Errorf("chunks hold %d bytes, expected %d", offset, manifest.Size)
+	}
+	reader := &chunkReader{ctx: ctx, storage: c, manifest: manifest, offsets: offsets}
+	h := sha256.New()
+	if _, err := io.Copy(h, reader); err != nil {
+		return fmt.Errorf("failed to read chunks: %w", err)
+	}
+	if digest := hex.EncodeToString(h.Sum(nil)); digest != manifest.Digest {
+		return fmt.Errorf("checksum mismatch: expected %s, chunks hold %s", manifest.Digest, digest)
+	}
+	return nil
+}
+
+// commit points fileName at the chunks of the manifest and releases the chunks of its previous version.
+func (c *ChunkStorage) commit(ctx context.Context, fileName string, manifest share.Manifest) error {
+	var size int64
+	for _, chunk := range manifest.Chunks {
+		size += chunk.Size
+	}
+	if size != manifest.Size {
+		return fmt.Errorf("manifest of %s lists %d bytes, expected %d", fileName, size, manifest.Size)
+	}
+	for _, chunk := range manifest.Chunks {
+		if !c.hasChunk(ctx, chunk.Hash) {
+			return fmt.Errorf("chunk %s of %s is missing", chunk.Hash, fileName)
+		}
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	c.commits.Lock()
+	defer c.commits.Unlock()
+	previous, hasPrevious := c.manifest(ctx, fileName)
+	if err := c.reference(manifest.Chunks); err != nil {
+		return err
+	}
+	if err := c.objects.Upload(ctx, manifestPrefix+fileName, bytes.NewReader(data), int64(len(data))); err != nil {
+		c.release(manifest.Chunks)
+		return err
+	}
+	if hasPrevious {
+		return c.release(previous.Chunks)
+	}
+	return nil
+}
+
+// reference adds a reference to every chunk.
+func (c *ChunkStorage) reference(chunks []share.ChunkRef) error {
+	c.refs.Lock()
+	defer c.refs.Unlock()
+	c.refs.load()
+	for _, chunk := range chunks {
+		c.refs.entries[chunk.Hash]++
+	}
+	return c.refs.save()
+}
+
+// release drops one reference per chunk, the chunks nothing references anymore are left to the collector.
+func (c *ChunkStorage) release(chunks []share.ChunkRef) error {
+	c.lock()
+	defer c.unlock()
+	now := time.Now()
+	for _, chunk := range chunks {
+		c.refs.entries[chunk.Hash]--
+		if c.refs.entries[chunk.Hash] > 0 {
+			continue
+		}
+		delete(c.refs.entries, chunk.Hash)
+		if expiry, ok := c.leases.entries[chunk.Hash]; !ok || expiry.Before(now) {
+			c.leases.entries[chunk.Hash] = now
+		}
+	}
+	if err := c.refs.save(); err != nil {
+		return err
+	}
+	return c.leases.save()
+}
+
+// collect periodically deletes the chunks nothing references once their lease ran out, the chunks of uploads
+// that were never committed included.
+func (c *ChunkStorage) collect() {
+	ticker := time.NewTicker(chunkCollectInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		c.sweep(now)
+	}
+}
+
+// sweep deletes the unreferenced chunks whose lease ran out by now and returns their hashes.
+func (c *ChunkStorage) sweep(now time.Time) []string {
+	c.lock()
+	collected := []string{}
+	for hash, expiry := range c.leases.entries {
+		if now.Before(expiry) {
+			continue
+		}
+		delete(c.leases.entries, hash)
+		if c.refs.entries[hash] > 0 {
+			continue
+		}
+		collected = append(collected, hash)
+		c.deletes[hash] = make(chan struct{})
+	}
+	if err := c.leases.save(); err != nil {
+		slog.Error("Failed to save chunk leases", "err", err.Error())
+	}
+	c.unlock()
+
+	for _, hash := range collected {
+		if err := c.objects.RemoveFile(chunkPrefix + hash); err != nil {
+			slog.Error("Failed to remove chunk", "hash", hash, "err", err.Error())
+		}
+	}
+
+	c.refs.Lock()
+	for _, hash := range collected {
+		close(c.deletes[hash])
+		delete(c.deletes, hash)
+	}
+	c.refs.Unlock()
+	return collected
+}
+
+func (c *ChunkStorage) manifest(ctx context.Context, fileName string) (share.Manifest, bool) {
+	reader, err := c.objects.Download(ctx, manifestPrefix+fileName)
+	if err != nil {
+		return share.Manifest{}, false
+	}
+	defer reader.Close()
+	var manifest share.Manifest
+	if err := json.NewDecoder(reader).Decode(&manifest); err != nil {
+		return share.Manifest{}, false
+	}
+	return manifest, true
+}
+
+// store chunks the content as it is read, uploads the chunks that aren't stored yet and commits the manifest.
+// Nothing is committed if the content doesn't match digest.
+func (c *ChunkStorage) store(ctx context.Context, fileName string, reader io.Reader, size int64, digest string) error {
+	h := sha256.New()
+	chunker := share.NewChunker(io.TeeReader(reader, h))
+	manifest := share.Manifest{Chunks: []share.ChunkRef{}}
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		hash := share.ChunkHash(chunk)
+		if err := c.PutChunk(ctx, hash, chunk); err != nil {
+			return err
+		}
+		manifest.Chunks = append(manifest.Chunks, share.ChunkRef{Hash: hash, Size: int64(len(chunk))})
+		manifest.Size += int64(len(chunk))
+	}
+	manifest.Digest = hex.EncodeToString(h.Sum(nil))
+	if manifest.Size != size {
+		return fmt.Errorf("received %d bytes of %s, expected %d", manifest.Size, fileName, size)
+	}
+	if digest != "" && manifest.Digest != digest {
+		return fmt.Errorf("checksum mismatch for %s: expected %s, received %s", fileName, digest, manifest.Digest)
+	}
+	return c.commit(ctx, fileName, manifest)
+}
+
+func (c *ChunkStorage) Upload(ctx context.Context, fileName string, reader io.Reader, size int64) error {
+	slog.Info("Uploading file", "filename", fileName)
+	return c.store(ctx, fileName, reader, size, "")
+}
+
+func (c *ChunkStorage) UploadPath(ctx context.Context, fileName string, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return c.Upload(ctx, fileName, file, stat.Size())
+}
+
+// UploadOffset is always 0, chunks stored by an interrupted upload are reused instead of resumed.
+func (c *ChunkStorage) UploadOffset(ctx context.Context, fileName string, size int64, digest string) (int64, error) {
+	return 0, nil
+}
+
+func (c *ChunkStorage) ResumeUpload(ctx context.Context, fileName string, reader io.Reader, offset int64, size int64, digest string) error {
+	if offset != 0 {
+		return fmt.Errorf("invalid offset %d for %s", offset, fileName)
+	}
+	slog.Info("Uploading file", "filename", fileName)
+	return c.store(ctx, fileName, reader, size, digest)
+}
+
+func (c *ChunkStorage) RemoveFile(fileName string) error {
+	slog.Info("Removing file", "filename", fileName)
+	ctx := context.Background()
+	c.commits.Lock()
+	defer c.commits.Unlock()
+	manifest, ok := c.manifest(ctx, fileName)
+	if !ok {
+		return fmt.Errorf("%s not found", fileName)
+	}
+	if err := c.objects.RemoveFile(manifestPrefix + fileName); err != nil {
+		return err
+	}
+	return c.release(manifest.Chunks)
+}
+
+// CopyFile only copies the manifest, the chunks are shared by both files.
+func (c *ChunkStorage) CopyFile(ctx context.Context, src string, dst string) error {
+	manifest, ok := c.manifest(ctx, src)
+	if !ok {
+		return fmt.Errorf("%s not found", src)
+	}
+	return c.commit(ctx, dst, manifest)
+}
+
+func (c *ChunkStorage) Stat(ctx context.Context, fileName string) (FileInfo, error) {
+	manifest, ok := c.manifest(ctx, fileName)
+	if !ok {
+		return FileInfo{}, fmt.Errorf("%s not found", fileName)
+	}
+	return FileInfo{Size: manifest.Size, Digest: manifest.Digest}, nil
+}
+
+func (c *ChunkStorage) Download(ctx context.Context, fileName string) (io.ReadCloser, error) {
+	return c.Open(ctx, fileName)
+}
+
+func (c *ChunkStorage) DownloadFrom(ctx context.Context, fileName string, offset int64) (io.ReadCloser, error) {
+	reader, err := c.Open(ctx, fileName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := reader.(*chunkReader).Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+func (c *ChunkStorage) Open(ctx context.Context, fileName string) (ObjectReader, error) {
+	manifest, ok := c.manifest(ctx, fileName)
+	if !ok {
+		return nil, fmt.Errorf("%s not found", fileName)
+	}
+	offsets := make([]int64, len(manifest.Chunks))
+	var offset int64
+	for i, chunk := range manifest.Chunks {
+		offsets[i] = offset
+		offset += chunk.Size
+	}
+	return &chunkReader{ctx: ctx, storage: c, manifest: manifest, offsets: offsets}, nil
+}
+
+// chunkReader reads a file back out of its chunks, keeping only the current chunk in memory.
+type chunkReader struct {
+	ctx      context.Context
+	storage  *ChunkStorage
+	manifest share.Manifest
+	offsets  []int64
+	pos      int64
+	current  int
+	data     []byte
+}
+
+func (r *chunkReader) chunk(i int) ([]byte, error) {
+	if r.data != nil && r.current == i {
+		return r.data, nil
+	}
+	reader, err := r.storage.objects.Download(r.ctx, chunkPrefix+r.manifest.Chunks[i].Hash)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	r.current, r.data = i, data
+	return data, nil
+}
+
+func (r *chunkReader) ReadAt(p []byte, off int64) (int, error) {
+	read := 0
+	for read < len(p) {
+		pos := off + int64(read)
+		if pos >= r.manifest.Size {
+			return read, io.EOF
+		}
+		i := sort.Search(len(r.offsets), func(i int) bool { return r.offsets[i] > pos }) - 1
+		data, err := r.chunk(i)
+		if err != nil {
+			return read, err
+		}
+		n := copy(p[read:], data[min(pos-r.offsets[i], int64(len(data))):])
+		if n == 0 {
+			return read, io.ErrUnexpectedEOF
+		}
+		read += n
+	}
+	return read, nil
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.pos)
+	r.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.manifest.Size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("invalid offset %d", offset)
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *chunkReader) Close() error {
+	r.data = nil
+	return nil
+}
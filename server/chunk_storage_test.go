@@ -0,0 +1,240 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"sync_server/share"
+	"testing"
+	"time"
+)
+
+// memStorage keeps objects in memory, it stands in for the object storage in tests.
+type memStorage struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{objects: make(map[string][]byte)}
+}
+
+type memObject struct {
+	*bytes.Reader
+}
+
+func (memObject) Close() error { return nil }
+
+func (s *memStorage) Init() error { return nil }
+
+func (s *memStorage) Upload(ctx context.Context, fileName string, reader io.Reader, size int64) error {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[fileName] = data
+	return nil
+}
+
+func (s *memStorage) UploadPath(ctx context.Context, fileName string, filePath string) error {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	return s.Upload(ctx, fileName, bytes.NewReader(data), int64(len(data)))
+}
+
+func (s *memStorage) RemoveFile(fileName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.objects[fileName]; !ok {
+		return fmt.Errorf("%s not found", fileName)
+	}
+	delete(s.objects, fileName)
+	return nil
+}
+
+func (s *memStorage) CopyFile(ctx context.Context, src string, dst string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[src]
+	if !ok {
+		return fmt.Errorf("%s not found", src)
+	}
+	s.objects[dst] = data
+	return nil
+}
+
+func (s *memStorage) object(fileName string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[fileName]
+	if !ok {
+		return nil, fmt.Errorf("%s not found", fileName)
+	}
+	return data, nil
+}
+
+func (s *memStorage) Download(ctx context.Context, fileName string) (io.ReadCloser, error) {
+	return s.Open(ctx, fileName)
+}
+
+func (s *memStorage) Stat(ctx context.Context, fileName string) (FileInfo, error) {
+	data, err := s.object(fileName)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{Size: int64(len(data)), Digest: share.ChunkHash(data)}, nil
+}
+
+func (s *memStorage) UploadOffset(ctx context.Context, fileName string, size int64, digest string) (int64, error) {
+	return 0, nil
+}
+
+func (s *memStorage) ResumeUpload(ctx context.Context, fileName string, reader io.Reader, offset int64, size int64, digest string) error {
+	return s.Upload(ctx, fileName, reader, size)
+}
+
+func (s *memStorage) DownloadFrom(ctx context.Context, fileName string, offset int64) (io.ReadCloser, error) {
+	data, err := s.object(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return memObject{bytes.NewReader(data[offset:])}, nil
+}
+
+func (s *memStorage) Open(ctx context.Context, fileName string) (ObjectReader, error) {
+	data, err := s.object(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return memObject{bytes.NewReader(data)}, nil
+}
+
+func TestChunkCollection(t *testing.T) {
+	ctx := context.Background()
+	upload := func(c *ChunkStorage, fileName string, content string) error {
+		return c.Upload(ctx, fileName, bytes.NewReader([]byte(content)), int64(len(content)))
+	}
+	tests := []struct {
+		name string
+		run  func(c *ChunkStorage) error
+		// how long after the changes the collector runs
+		after time.Duration
+		// contents whose chunk the collector deletes
+		collected []string
+	}{
+		{
+			name:  "referenced chunk kept",
+			run:   func(c *ChunkStorage) error { return upload(c, "a", "one") },
+			after: 2 * chunkLeaseTime,
+		},
+		{
+			name: "chunk of a removed file collected",
+			run: func(c *ChunkStorage) error {
+				if err := upload(c, "a", "one"); err != nil {
+					return err
+				}
+				return c.RemoveFile("a")
+			},
+			after:     2 * chunkLeaseTime,
+			collected: []string{"one"},
+		},
+		{
+			name: "chunk shared by another file kept",
+			run: func(c *ChunkStorage) error {
+				if err := upload(c, "a", "one"); err != nil {
+					return err
+				}
+				if err := upload(c, "b", "one"); err != nil {
+					return err
+				}
+				return c.RemoveFile("a")
+			},
+			after: 2 * chunkLeaseTime,
+		},
+		{
+			name: "copy shares the chunks",
+			run: func(c *ChunkStorage) error {
+				if err := upload(c, "a", "one"); err != nil {
+					return err
+				}
+				if err := c.CopyFile(ctx, "a", "b"); err != nil {
+					return err
+				}
+				return c.RemoveFile("a")
+			},
+			after: 2 * chunkLeaseTime,
+		},
+		{
+			name: "overwritten content released",
+			run: func(c *ChunkStorage) error {
+				if err := upload(c, "a", "one"); err != nil {
+					return err
+				}
+				return upload(c, "a", "two")
+			},
+			after:     2 * chunkLeaseTime,
+			collected: []string{"one"},
+		},
+		{
+			name: "uncommitted chunk kept while leased",
+			run: func(c *ChunkStorage) error {
+				return c.PutChunk(ctx, share.ChunkHash([]byte("one")), []byte("one"))
+			},
+			after: chunkLeaseTime / 2,
+		},
+		{
+			name: "uncommitted chunk collected once the lease ran out",
+			run: func(c *ChunkStorage) error {
+				return c.PutChunk(ctx, share.ChunkHash([]byte("one")), []byte("one"))
+			},
+			after:     2 * chunkLeaseTime,
+			collected: []string{"one"},
+		},
+		{
+			name: "released chunk leased again by an upload",
+			run: func(c *ChunkStorage) error {
+				if err := upload(c, "a", "one"); err != nil {
+					return err
+				}
+				if err := c.RemoveFile("a"); err != nil {
+					return err
+				}
+				_, err := c.MissingChunks(ctx, []share.ChunkRef{{Hash: share.ChunkHash([]byte("one")), Size: 3}})
+				return err
+			},
+			after: chunkLeaseTime / 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objects := newMemStorage()
+			c := newChunkStorage(&share.ServerConfig{LogDir: t.TempDir()}, objects)
+			if err := tt.run(c); err != nil {
+				t.Fatal(err)
+			}
+			collected := c.sweep(time.Now().Add(tt.after))
+			want := []string{}
+			for _, content := range tt.collected {
+				want = append(want, share.ChunkHash([]byte(content)))
+			}
+			slices.Sort(collected)
+			slices.Sort(want)
+			if !slices.Equal(collected, want) {
+				t.Errorf("collected %v, want %v", collected, want)
+			}
+			for _, hash := range want {
+				if _, err := objects.Stat(context.Background(), chunkPrefix+hash); err == nil {
+					t.Errorf("chunk %s still stored", hash)
+				}
+			}
+		})
+	}
+}
@@ -1,9 +1,13 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"math/rand/v2"
+	"path/filepath"
+	"slices"
 	"strings"
 	"sync_server/share"
 	"time"
@@ -12,32 +16,96 @@ import (
 )
 
 type MessageHandler struct {
-	Cfg               *share.ServerConfig
-	NatsConnection    *share.NatsConn
-	ReceiverService   *ReceiverService
-	DownloaderService *DownloaderService
-	ChangeStorage     Storage
-	fileStorage       FileStorage
+	Cfg                 *share.ServerConfig
+	NatsConnection      *share.NatsConn
+	ReceiverService     *ReceiverService
+	DownloaderService   *DownloaderService
+	NatsTransferService *NatsTransferService
+	ChangeStorage       Storage
+	changeLog           *ChangeLogFile
+	fileStorage         FileStorage
+	tree                *FileTree
+	versions            *VersionStore
+	trash               *TrashBin
+	snapshots           *SnapshotStore
+	notifier            *changeNotifier
+	replication         *replication
+	advertiseHosts      []string
+	// per account, device and server, the last change log of that server the device acknowledged.
+	// Every server keeps a copy, an acknowledgement is replicated to the others through feed-ack.
+	feedCursors *jsonIndex[map[string]map[string]int64]
 }
 
 func NewMessageHandler(cfg *share.ServerConfig) *MessageHandler {
+	natsConn := share.NewNatsConn(cfg.NatsUrl)
+	fileStorage := NewFileStorage(cfg)
+	versions := NewVersionStore(cfg, fileStorage)
+	trash := NewTrashBin(cfg, fileStorage, versions)
+	changeLog := NewChangeLogFile(cfg)
+	tree := NewFileTree(cfg, fileStorage, changeLog.Load)
+	notifier := newChangeNotifier(natsConn)
+	// an upload updates the tree before the change it belongs to is announced
+	stored := func(ctx context.Context, fileName string) {
+		tree.Stored(ctx, fileName)
+		notifier.stored(fileName)
+	}
 	return &MessageHandler{
-		Cfg:               cfg,
-		NatsConnection:    share.NewNatsConn(cfg.NatsUrl),
-		ReceiverService:   NewReceiverService(cfg),
-		DownloaderService: NewDownloaderService(cfg),
-		ChangeStorage:     NewChangeStorage(),
-		fileStorage:       NewMinIoService(cfg),
+		Cfg:                 cfg,
+		NatsConnection:      natsConn,
+		ReceiverService:     NewReceiverService(cfg, fileStorage, stored),
+		DownloaderService:   NewDownloaderService(cfg, fileStorage),
+		NatsTransferService: NewNatsTransferService(cfg, natsConn, fileStorage, stored),
+		ChangeStorage:       NewChangeStorage(changeLog),
+		changeLog:           changeLog,
+		fileStorage:         fileStorage,
+		tree:                tree,
+		versions:            versions,
+		trash:               trash,
+		snapshots:           NewSnapshotStore(cfg, fileStorage, versions, trash, changeLog.Load),
+		notifier:            notifier,
+		replication:         newReplication(cfg),
+		advertiseHosts:      advertiseHosts(cfg),
+		feedCursors:         newJSONIndex[map[string]map[string]int64](cfg.LogPath(feedCursorsFile), "feed cursors"),
+	}
+}
+
+// advertiseHosts returns the addresses clients should dial for tcp transfers,
+// the configured ones if any, otherwise every address this machine can be reached on.
+func advertiseHosts(cfg *share.ServerConfig) []string {
+	if len(cfg.AdvertiseHosts) > 0 {
+		return cfg.AdvertiseHosts
+	}
+	hosts, err := share.GetHostAddrs()
+	if err != nil {
+		slog.Error("Failed to detect advertise hosts", "err", err.Error())
 	}
+	return hosts
 }
 
 func (m *MessageHandler) GetHandlerFunc(sbj string) (func(msg *nats.Msg) (*share.ServerResponse, error), error) {
 	handlers := map[string]func(msg *nats.Msg) (*share.ServerResponse, error){
-		"health":        m.Health,
-		"change":        m.Change,
-		"server-change": m.ServerChange,
-		"sync":          m.Sync,
-		"download-file": m.DownloadFile,
+		"health":                 m.Health,
+		"change":                 m.Change,
+		"server-change":          m.ServerChange,
+		"sync":                   m.Sync,
+		"ack-changes":            m.AckChanges,
+		"feed-ack":               m.FeedAck,
+		catchUpSubject:           m.CatchUp,
+		"upload-file":            m.UploadFile,
+		"download-file":          m.DownloadFile,
+		"file-signature":         m.FileSignature,
+		"list-versions":          m.ListVersions,
+		"download-version":       m.DownloadVersion,
+		"restore-version":        m.RestoreVersion,
+		"list-trash":             m.ListTrash,
+		"restore-trash":          m.RestoreTrash,
+		"purge-trash":            m.PurgeTrash,
+		"create-snapshot":        m.CreateSnapshot,
+		"list-snapshots":         m.ListSnapshots,
+		"snapshot-files":         m.SnapshotFiles,
+		"download-snapshot-file": m.DownloadSnapshotFile,
+		"rebuild-file-tree":      m.RebuildFileTree,
+		"list-files":             m.ListFiles,
 	}
 	handler, ok := handlers[sbj]
 	if !ok {
@@ -46,39 +114,369 @@ func (m *MessageHandler) GetHandlerFunc(sbj string) (func(msg *nats.Msg) (*share
 	return handler, nil
 }
 
+// UploadFile starts another transfer of a file whose change was already recorded, it leaves the change log,
+// the versions and the other devices alone so a retried upload is just a transfer.
+func (m *MessageHandler) UploadFile(msg *nats.Msg) (*share.ServerResponse, error) {
+	var req share.UploadRequest
+	err := json.Unmarshal(msg.Data, &req)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing upload request %s", err.Error())
+	}
+	if err := accountFile(req.ClientId, req.FilePath); err != nil {
+		return nil, err
+	}
+	info, err := m.initReceiver(m.transferMode(req.TransferMode), req.FilePath, m.canReceiveDelta(req.FilePath), m.compression(req.Compression))
+	if err != nil {
+		return nil, err
+	}
+	resBytes, err := json.Marshal(share.UploadResponse{TransferInfo: info})
+	if err != nil {
+		return nil, err
+	}
+	return &share.ServerResponse{
+		Status: share.Success,
+		Data:   string(resBytes),
+	}, nil
+}
+
+// accountFile makes sure a storage key a request names belongs to the account of the request, local paths
+// are absolute so the key of a file of the account starts with the account id and a slash.
+func accountFile(clientId string, fileName string) error {
+	if clientId == "" || !strings.HasPrefix(fileName, clientId+"/") || slices.Contains(strings.Split(fileName, "/"), "..") {
+		return fmt.Errorf("%s isn't a file of the account", fileName)
+	}
+	return nil
+}
+
 func (m *MessageHandler) DownloadFile(msg *nats.Msg) (*share.ServerResponse, error) {
 	var req share.DownloadRequest
 	err := json.Unmarshal(msg.Data, &req)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing download request %s", err.Error())
 	}
-	var port int
-	for attempt := 0; attempt < retries; attempt++ {
-		port = rand.IntN(maxPort-minPort) + minPort
-		err := m.DownloaderService.InitDownloader(port, req.FilePath)
+	if err := accountFile(req.ClientId, req.FilePath); err != nil {
+		return nil, err
+	}
+	if clientId, path := splitFileName(req.FilePath); !m.tree.fileExists(clientId, path) {
+		return &share.ServerResponse{
+			Status: share.NotFound,
+			Data:   fmt.Sprintf("%s not found", req.FilePath),
+		}, nil
+	}
+	if m.notifier.uploading(req.FilePath) {
+		// the stored content is the one the change replaced, the device asks again once it arrived
+		return &share.ServerResponse{
+			Status: share.Failure,
+			Data:   fmt.Sprintf("%s is still being uploaded", req.FilePath),
+		}, nil
+	}
+	info, err := m.initDownloader(m.transferMode(req.TransferMode), req.FilePath, req.Delta, m.compression(req.Compression))
+	if err != nil {
+		return nil, err
+	}
+	res := share.DownloadResponse{
+		TransferInfo: info,
+	}
+	resBytes, err := json.Marshal(res)
+	return &share.ServerResponse{
+		Status: share.Success,
+		Data:   string(resBytes),
+	}, nil
+}
 
-		if err == nil {
-			break
-		}
-		if !strings.Contains(err.Error(), "address already in use") {
-			return nil, err
-		}
+func (m *MessageHandler) FileSignature(msg *nats.Msg) (*share.ServerResponse, error) {
+	var req share.SignatureRequest
+	err := json.Unmarshal(msg.Data, &req)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing signature request %s", err.Error())
+	}
+	if err := accountFile(req.ClientId, req.FilePath); err != nil {
+		return nil, err
+	}
+	sig, err := fileSignature(context.Background(), m.fileStorage, req.FilePath)
+	if err != nil {
+		return nil, fmt.Errorf("error computing signature of %s: %s", req.FilePath, err.Error())
+	}
+	resBytes, err := json.Marshal(sig)
+	if err != nil {
+		return nil, err
+	}
+	return &share.ServerResponse{
+		Status: share.Success,
+		Data:   string(resBytes),
+	}, nil
+}
 
-		if attempt == retries-1 {
-			return nil, fmt.Errorf("failed to find an available port after %d attempts", retries)
-		}
+func (m *MessageHandler) ListVersions(msg *nats.Msg) (*share.ServerResponse, error) {
+	var req share.VersionRequest
+	err := json.Unmarshal(msg.Data, &req)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing versions request %s", err.Error())
 	}
-	res := share.DownloadResponse{
+	if err := accountFile(req.ClientId, req.ClientId+req.FilePath); err != nil {
+		return nil, err
+	}
+	versions, err := m.versions.List(context.Background(), req.ClientId, req.ClientId+req.FilePath)
+	if err != nil {
+		return nil, fmt.Errorf("error listing versions of %s: %s", req.FilePath, err.Error())
+	}
+	resBytes, err := json.Marshal(versions)
+	if err != nil {
+		return nil, err
+	}
+	return &share.ServerResponse{
+		Status: share.Success,
+		Data:   string(resBytes),
+	}, nil
+}
 
-		Port: port,
+func (m *MessageHandler) DownloadVersion(msg *nats.Msg) (*share.ServerResponse, error) {
+	var req share.VersionRequest
+	err := json.Unmarshal(msg.Data, &req)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing version download request %s", err.Error())
+	}
+	if err := accountFile(req.ClientId, req.ClientId+req.FilePath); err != nil {
+		return nil, err
+	}
+	key, err := m.versions.Key(req.ClientId+req.FilePath, req.VersionId)
+	if err != nil {
+		return nil, err
+	}
+	info, err := m.initDownloader(m.transferMode(req.TransferMode), key, false, m.compression(req.Compression))
+	if err != nil {
+		return nil, err
+	}
+	resBytes, err := json.Marshal(share.DownloadResponse{TransferInfo: info})
+	if err != nil {
+		return nil, err
+	}
+	return &share.ServerResponse{
+		Status: share.Success,
+		Data:   string(resBytes),
+	}, nil
+}
+
+// RestoreVersion makes a version the current content again and records it as a change so every device downloads it.
+func (m *MessageHandler) RestoreVersion(msg *nats.Msg) (*share.ServerResponse, error) {
+	var req share.VersionRequest
+	err := json.Unmarshal(msg.Data, &req)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing version restore request %s", err.Error())
+	}
+	if err := accountFile(req.ClientId, req.ClientId+req.FilePath); err != nil {
+		return nil, err
+	}
+	err = m.versions.Restore(context.Background(), req.ClientId, req.ClientId+req.FilePath, req.VersionId)
+	if err != nil {
+		return nil, fmt.Errorf("error restoring %s: %s", req.FilePath, err.Error())
+	}
+	m.tree.Stored(context.Background(), req.ClientId+req.FilePath)
+	err = m.recordRestore(req.ClientRequest, req.FilePath)
+	if err != nil {
+		return nil, err
+	}
+	return &share.ServerResponse{
+		Status: share.Success,
+		Data:   "version restored",
+	}, nil
+}
+
+// recordRestore records the restored file as created by the server, so every device downloads it including the one asking.
+func (m *MessageHandler) recordRestore(req share.ClientRequest, localPath string) error {
+	req.Agent, req.DeviceId = share.ServerAgent, share.ServerAgent
+	return m.recordServerChange(share.ChangeRequest{
+		ClientRequest: req,
+		Dir:           filepath.Dir(localPath),
+		Changes: []share.ChangeRequestChange{{
+			FileName:    filepath.Base(localPath),
+			ChangeEvent: "CREATE",
+			Agent:       share.ServerAgent,
+		}},
+	}, nil)
+}
+
+func (m *MessageHandler) ListTrash(msg *nats.Msg) (*share.ServerResponse, error) {
+	var req share.TrashRequest
+	err := json.Unmarshal(msg.Data, &req)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing trash request %s", err.Error())
+	}
+	entries, err := m.trash.List(context.Background(), req.ClientId)
+	if err != nil {
+		return nil, fmt.Errorf("error listing trash %s", err.Error())
+	}
+	resBytes, err := json.Marshal(entries)
+	if err != nil {
+		return nil, err
+	}
+	return &share.ServerResponse{
+		Status: share.Success,
+		Data:   string(resBytes),
+	}, nil
+}
+
+func (m *MessageHandler) RestoreTrash(msg *nats.Msg) (*share.ServerResponse, error) {
+	var req share.TrashRequest
+	err := json.Unmarshal(msg.Data, &req)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing trash request %s", err.Error())
+	}
+	ctx := context.Background()
+	entry, err := m.trash.Restore(ctx, req.ClientId, req.Id)
+	if err != nil {
+		return nil, err
+	}
+	m.tree.Stored(ctx, req.ClientId+entry.FilePath)
+	err = m.recordRestore(req.ClientRequest, entry.FilePath)
+	if err != nil {
+		return nil, err
+	}
+	resBytes, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	return &share.ServerResponse{
+		Status: share.Success,
+		Data:   string(resBytes),
+	}, nil
+}
+
+func (m *MessageHandler) PurgeTrash(msg *nats.Msg) (*share.ServerResponse, error) {
+	var req share.TrashRequest
+	err := json.Unmarshal(msg.Data, &req)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing trash request %s", err.Error())
+	}
+	purged, err := m.trash.Purge(context.Background(), req.ClientId, req.Id)
+	if err != nil {
+		return nil, err
+	}
+	return &share.ServerResponse{
+		Status: share.Success,
+		Data:   fmt.Sprintf("%d files purged", purged),
+	}, nil
+}
+
+func (m *MessageHandler) CreateSnapshot(msg *nats.Msg) (*share.ServerResponse, error) {
+	var req share.SnapshotRequest
+	err := json.Unmarshal(msg.Data, &req)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing snapshot request %s", err.Error())
+	}
+	snapshot, err := m.snapshots.Create(context.Background(), req.ClientId, req.Name, req.Dir, req.At)
+	if err != nil {
+		return nil, fmt.Errorf("error creating snapshot %s: %s", req.Name, err.Error())
+	}
+	snapshot.Files = nil
+	resBytes, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return &share.ServerResponse{
+		Status: share.Success,
+		Data:   string(resBytes),
+	}, nil
+}
+
+func (m *MessageHandler) ListSnapshots(msg *nats.Msg) (*share.ServerResponse, error) {
+	var req share.SnapshotRequest
+	err := json.Unmarshal(msg.Data, &req)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing snapshot request %s", err.Error())
+	}
+	resBytes, err := json.Marshal(m.snapshots.List(req.ClientId, req.Dir))
+	if err != nil {
+		return nil, err
+	}
+	return &share.ServerResponse{
+		Status: share.Success,
+		Data:   string(resBytes),
+	}, nil
+}
+
+func (m *MessageHandler) SnapshotFiles(msg *nats.Msg) (*share.ServerResponse, error) {
+	var req share.SnapshotRequest
+	err := json.Unmarshal(msg.Data, &req)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing snapshot request %s", err.Error())
+	}
+	files, err := m.snapshots.Files(context.Background(), req.ClientId, req)
+	if err != nil {
+		return nil, err
+	}
+	resBytes, err := json.Marshal(files)
+	if err != nil {
+		return nil, err
+	}
+	return &share.ServerResponse{
+		Status: share.Success,
+		Data:   string(resBytes),
+	}, nil
+}
+
+func (m *MessageHandler) DownloadSnapshotFile(msg *nats.Msg) (*share.ServerResponse, error) {
+	var req share.SnapshotRequest
+	err := json.Unmarshal(msg.Data, &req)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing snapshot request %s", err.Error())
+	}
+	if err := accountFile(req.ClientId, req.ClientId+req.FilePath); err != nil {
+		return nil, err
+	}
+	key, err := m.snapshots.Key(context.Background(), req.ClientId, req)
+	if err != nil {
+		return nil, err
+	}
+	info, err := m.initDownloader(m.transferMode(req.TransferMode), key, false, m.compression(req.Compression))
+	if err != nil {
+		return nil, err
+	}
+	resBytes, err := json.Marshal(share.DownloadResponse{TransferInfo: info})
+	if err != nil {
+		return nil, err
+	}
+	return &share.ServerResponse{
+		Status: share.Success,
+		Data:   string(resBytes),
+	}, nil
+}
+
+func (m *MessageHandler) ListFiles(msg *nats.Msg) (*share.ServerResponse, error) {
+	var req share.ListFilesRequest
+	err := json.Unmarshal(msg.Data, &req)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing list files request %s", err.Error())
+	}
+	resBytes, err := json.Marshal(m.tree.Entries(req.ClientId, req.Path, req.Deleted))
+	if err != nil {
+		return nil, err
 	}
-	resBytes, err := json.Marshal(res)
 	return &share.ServerResponse{
 		Status: share.Success,
 		Data:   string(resBytes),
 	}, nil
 }
 
+// RebuildFileTree throws the file tree of the account away and builds it again out of the change log and the storage.
+func (m *MessageHandler) RebuildFileTree(msg *nats.Msg) (*share.ServerResponse, error) {
+	var req share.ClientRequest
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		return nil, fmt.Errorf("error parsing rebuild request %s", err.Error())
+	}
+	if req.ClientId == "" {
+		return nil, fmt.Errorf("rebuilding the file tree requires a client id")
+	}
+	err := m.tree.Rebuild(context.Background(), req.ClientId)
+	if err != nil {
+		return nil, fmt.Errorf("error rebuilding file tree %s", err.Error())
+	}
+	return &share.ServerResponse{
+		Status: share.Success,
+		Data:   "file tree rebuilt",
+	}, nil
+}
+
 func (m *MessageHandler) Health(msg *nats.Msg) (*share.ServerResponse, error) {
 	return &share.ServerResponse{
 		Status: share.Success,
@@ -98,37 +496,112 @@ func (m *MessageHandler) Change(msg *nats.Msg) (*share.ServerResponse, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error parsing change request %s", err.Error())
 	}
+	for _, change := range req.Changes {
+		if err := accountFile(req.ClientId, fmt.Sprintf("%s%s/%s", req.ClientId, req.Dir, change.FileName)); err != nil {
+			return nil, err
+		}
+		if change.OldPath != "" {
+			if err := accountFile(req.ClientId, req.ClientId+change.OldPath); err != nil {
+				return nil, err
+			}
+		}
+	}
 	res := make(share.ChangeResponse, len(req.Changes))
+	recorded := make([]share.ChangeRequestChange, 0, len(req.Changes))
 	for _, change := range req.Changes {
-		if change.ChangeEvent == "REMOVE" {
-			// TODO: remove file
-			err := m.fileStorage.RemoveFile(fmt.Sprintf("%s%s/%s", req.ClientId, req.Dir, change.FileName))
+		filePath := fmt.Sprintf("%s%s/%s", req.ClientId, req.Dir, change.FileName)
+		if change.ChangeEvent == share.MoveChange && change.Dir {
+			localPath := fmt.Sprintf("%s/%s", req.Dir, change.FileName)
+			moved, err := m.moveDir(context.Background(), req.ClientId, change.OldPath, localPath)
+			if err != nil {
+				return nil, fmt.Errorf("error moving directory %s: %s", change.OldPath, err.Error())
+			}
+			if moved {
+				recorded = append(recorded, change)
+				continue
+			}
+			if m.tree.dirExists(req.ClientId, localPath) {
+				// a device applying the move renamed its copy too, the server already moved it
+				continue
+			}
+			// the old folder never reached the server, its content follows as changes of its own
+			change.ChangeEvent, change.OldPath, change.Dir = share.DirCreateChange, "", false
+		}
+		if change.ChangeEvent == share.MoveChange {
+			moved, err := m.move(context.Background(), req.ClientId, change.OldPath, fmt.Sprintf("%s/%s", req.Dir, change.FileName))
 			if err != nil {
-				return nil, fmt.Errorf("error removing file %s", change.FileName)
+				return nil, fmt.Errorf("error moving file %s: %s", change.OldPath, err.Error())
+			}
+			info, statErr := m.fileStorage.Stat(context.Background(), filePath)
+			switch {
+			case moved && (statErr != nil || change.Digest == "" || info.Digest == "" || info.Digest == change.Digest):
+				recorded = append(recorded, change)
+				continue
+			case moved:
+				// the device paired the rename by size and modification time, the content differs after all and is received again
+				recorded = append(recorded, change)
+				change.ChangeEvent, change.OldPath = "WRITE", ""
+			case statErr == nil && info.Digest == change.Digest:
+				// a device applying the move renamed its copy too, the server already moved it
+				continue
+			default:
+				// the old path never reached the server, the file is received under its new name
+				change.ChangeEvent, change.OldPath = "CREATE", ""
+			}
+		}
+		if change.ChangeEvent == share.DirCreateChange || change.ChangeEvent == share.DirRemoveChange {
+			localPath := fmt.Sprintf("%s/%s", req.Dir, change.FileName)
+			changed, err := m.changeDir(context.Background(), req.ClientId, localPath, change.ChangeEvent)
+			if err != nil {
+				return nil, fmt.Errorf("error changing directory %s: %s", localPath, err.Error())
+			}
+			if changed {
+				recorded = append(recorded, change)
 			}
 			continue
 		}
-		var port int
-		for attempt := 0; attempt < retries; attempt++ {
-			port = rand.IntN(maxPort-minPort) + minPort
-			err := m.ReceiverService.InitReceiver(port, fmt.Sprintf("%s%s/%s", req.ClientId, req.Dir, change.FileName))
-
-			if err == nil {
-				break
+		if change.ChangeEvent == share.MetadataChange {
+			if m.metadataChanged(req.ClientId, fmt.Sprintf("%s/%s", req.Dir, change.FileName), change.Metadata) {
+				recorded = append(recorded, change)
 			}
-			if !strings.Contains(err.Error(), "address already in use") {
-				return nil, err
+			continue
+		}
+		if change.ChangeEvent != "REMOVE" && change.Metadata != nil && change.Metadata.LinkTarget != "" {
+			// a symlink has no content of its own, what was stored under its path is kept as a version
+			if err := m.versions.Archive(context.Background(), req.ClientId, filePath); err != nil {
+				slog.Error("Failed to archive file version", "path", filePath, "err", err.Error())
 			}
-
-			if attempt == retries-1 {
-				return nil, fmt.Errorf("failed to find an available port after %d attempts", retries)
+			m.fileStorage.RemoveFile(filePath)
+			recorded = append(recorded, change)
+			continue
+		}
+		recorded = append(recorded, change)
+		if change.ChangeEvent == "REMOVE" {
+			err := m.trash.Move(context.Background(), req.ClientId, fmt.Sprintf("%s/%s", req.Dir, change.FileName))
+			if err != nil {
+				return nil, fmt.Errorf("error removing file %s: %s", change.FileName, err.Error())
 			}
+			continue
 		}
-
-		res[change.FileName] = port
+		if err := m.versions.Archive(context.Background(), req.ClientId, filePath); err != nil {
+			slog.Error("Failed to archive file version", "path", filePath, "err", err.Error())
+		}
+		info, err := m.initReceiver(m.transferMode(req.TransferMode), filePath, m.canReceiveDelta(filePath), m.compression(req.Compression))
+		if err != nil {
+			return nil, err
+		}
+		res[change.FileName] = info
 	}
 	resBytes, err := json.Marshal(res)
-	err = m.recordServerChange(req)
+	if len(recorded) == 0 {
+		return &share.ServerResponse{Status: share.Success, Data: string(resBytes)}, nil
+	}
+	req.Changes = recorded
+	uploads := make([]string, 0, len(res))
+	for fileName := range res {
+		uploads = append(uploads, fmt.Sprintf("%s%s/%s", req.ClientId, req.Dir, fileName))
+	}
+	err = m.recordServerChange(req, uploads)
 	if err != nil {
 		return nil, err
 	}
@@ -137,6 +610,146 @@ func (m *MessageHandler) Change(msg *nats.Msg) (*share.ServerResponse, error) {
 		Data:   string(resBytes),
 	}, nil
 }
+
+// metadataChanged tells whether the metadata differs from what the tree knows of the file,
+// a device applying a metadata change reports it back unchanged.
+func (m *MessageHandler) metadataChanged(clientId string, localPath string, metadata *share.FileMetadata) bool {
+	entry, ok := m.tree.entry(clientId, localPath)
+	return metadata != nil && !(ok && entry.Metadata.Equal(metadata))
+}
+
+// changeDir creates or removes a folder, the files of a removed folder go to the trash one by one so each stays restorable.
+// It tells false when the folder already is in that state, typically because a device applying the change reported it back.
+func (m *MessageHandler) changeDir(ctx context.Context, clientId string, dir string, change string) (bool, error) {
+	exists := m.tree.dirExists(clientId, dir)
+	if change == share.DirCreateChange {
+		return !exists, nil
+	}
+	entries := m.tree.Entries(clientId, dir, false)
+	if !exists && len(entries) == 0 {
+		return false, nil
+	}
+	for _, entry := range entries {
+		if entry.Dir {
+			continue
+		}
+		if err := m.trash.Move(ctx, clientId, entry.Path); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// move renames the stored file without transferring it again, it tells false when nothing is stored under the old path.
+// Both the moved content and the content it replaces are kept as versions so earlier states can still be restored.
+func (m *MessageHandler) move(ctx context.Context, clientId string, oldPath string, newPath string) (bool, error) {
+	src, dst := clientId+oldPath, clientId+newPath
+	if _, err := m.fileStorage.Stat(ctx, src); err != nil {
+		return false, nil
+	}
+	for _, fileName := range []string{src, dst} {
+		if err := m.versions.Archive(ctx, clientId, fileName); err != nil {
+			slog.Error("Failed to archive file version", "path", fileName, "err", err.Error())
+		}
+	}
+	if err := m.fileStorage.CopyFile(ctx, src, dst); err != nil {
+		return false, err
+	}
+	if err := m.fileStorage.RemoveFile(src); err != nil {
+		return false, err
+	}
+	m.tree.Stored(ctx, dst)
+	return true, nil
+}
+
+// moveDir moves every file stored under the old folder, it tells false when the server doesn't know the folder.
+func (m *MessageHandler) moveDir(ctx context.Context, clientId string, oldPath string, newPath string) (bool, error) {
+	entries := m.tree.Entries(clientId, oldPath, false)
+	if !m.tree.dirExists(clientId, oldPath) && len(entries) == 0 {
+		return false, nil
+	}
+	for _, entry := range entries {
+		if entry.Dir {
+			continue
+		}
+		if _, err := m.move(ctx, clientId, entry.Path, newPath+strings.TrimPrefix(entry.Path, oldPath)); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// transferMode picks the mode the client asked for and falls back to the server default.
+// Chunk transfers need a chunked storage, without one the chunks go over nats as a plain stream.
+func (m *MessageHandler) transferMode(requested share.TransferMode) share.TransferMode {
+	mode := share.ResolveTransferMode(m.Cfg.TransferMode)
+	if requested != "" {
+		mode = share.ResolveTransferMode(requested)
+	}
+	if _, ok := m.fileStorage.(ChunkStore); mode == share.ChunkTransfer && !ok {
+		return share.NatsTransfer
+	}
+	return mode
+}
+
+// compression agrees on the compression the client accepts if the server compresses transfers at all.
+func (m *MessageHandler) compression(requested string) string {
+	if m.Cfg.Compression && requested == share.ZstdCompression {
+		return share.ZstdCompression
+	}
+	return ""
+}
+
+// canReceiveDelta tells whether there is a stored version of filePath big enough to send the new one as a delta against it.
+func (m *MessageHandler) canReceiveDelta(filePath string) bool {
+	info, err := m.fileStorage.Stat(context.Background(), filePath)
+	return err == nil && info.Size >= share.DeltaMinSize
+}
+
+func (m *MessageHandler) initReceiver(mode share.TransferMode, filePath string, delta bool, compression string) (share.TransferInfo, error) {
+	if mode == share.ChunkTransfer {
+		subject, err := m.NatsTransferService.InitChunkReceiver(filePath)
+		return share.TransferInfo{Mode: mode, Subject: subject, Compression: compression}, err
+	}
+	if mode == share.NatsTransfer {
+		subject, err := m.NatsTransferService.InitReceiver(filePath, delta, compression != "")
+		return share.TransferInfo{Mode: mode, Subject: subject, Delta: delta, Compression: compression}, err
+	}
+	port, err := listenOnRandomPort(func(port int) error {
+		return m.ReceiverService.InitReceiver(port, filePath, delta, compression != "")
+	})
+	return share.TransferInfo{Mode: mode, Hosts: m.advertiseHosts, Port: port, Delta: delta, Compression: compression}, err
+}
+
+func (m *MessageHandler) initDownloader(mode share.TransferMode, filePath string, delta bool, compression string) (share.TransferInfo, error) {
+	// the client already has every chunk it needs to keep, downloads are plain nats streams
+	if mode == share.ChunkTransfer {
+		mode = share.NatsTransfer
+	}
+	if mode == share.NatsTransfer {
+		subject, err := m.NatsTransferService.InitDownloader(filePath, delta, compression != "")
+		return share.TransferInfo{Mode: mode, Subject: subject, Delta: delta, Compression: compression}, err
+	}
+	port, err := listenOnRandomPort(func(port int) error {
+		return m.DownloaderService.InitDownloader(port, filePath, delta, compression != "")
+	})
+	return share.TransferInfo{Mode: mode, Hosts: m.advertiseHosts, Port: port, Delta: delta, Compression: compression}, err
+}
+
+func listenOnRandomPort(listen func(port int) error) (int, error) {
+	for attempt := 0; attempt < retries; attempt++ {
+		port := rand.IntN(maxPort-minPort) + minPort
+		err := listen(port)
+		if err == nil {
+			return port, nil
+		}
+		if !strings.Contains(err.Error(), "address already in use") {
+			return 0, err
+		}
+	}
+	return 0, fmt.Errorf("failed to find an available port after %d attempts", retries)
+}
+
 func (m *MessageHandler) ServerChange(msg *nats.Msg) (*share.ServerResponse, error) {
 	var log ChangeLog
 	err := json.Unmarshal(msg.Data, &log)
@@ -144,8 +757,7 @@ func (m *MessageHandler) ServerChange(msg *nats.Msg) (*share.ServerResponse, err
 		return nil, fmt.Errorf("error parsing change log %s", err.Error())
 	}
 	if log.ServerId != m.Cfg.ServerId {
-		err := recordChangeLog(log)
-		if err != nil {
+		if err := m.replicate(log); err != nil {
 			return nil, err
 		}
 	}
@@ -155,32 +767,39 @@ func (m *MessageHandler) ServerChange(msg *nats.Msg) (*share.ServerResponse, err
 	}, nil
 }
 
-func (m *MessageHandler) recordServerChange(req share.ChangeRequest) error {
+func (m *MessageHandler) recordServerChange(req share.ChangeRequest, uploads []string) error {
 	changes := []ChangeLogChanges{}
 	for _, change := range req.Changes {
 		changes = append(changes, ChangeLogChanges{
 			FileName: change.FileName,
 			Change:   change.ChangeEvent,
 			Agent:    req.Agent,
+			OldPath:  change.OldPath,
+			Metadata: change.Metadata,
+			Dir:      change.Dir,
 		})
 	}
 	changeLog := ChangeLog{
 		ClientId:  req.ClientId,
+		DeviceId:  req.DeviceId,
 		ServerId:  m.Cfg.ServerId,
 		ChangeDir: req.Dir,
 		Changes:   changes,
 		Time:      time.Now(),
 	}
-	err := recordChangeLog(changeLog)
-	if err != nil {
-		return err
-	}
-	log, _ := json.Marshal(changeLog)
-	m.ChangeStorage.Set(req.ClientId, log)
-	err = m.NatsConnection.PublishToSubject("server-change", log)
+	_, err := m.recordChangeLog(changeLog, func(changeLog ChangeLog) error {
+		log, _ := json.Marshal(changeLog)
+		return m.NatsConnection.PublishToSubject("server-change", log)
+	})
 	if err != nil {
 		return err
 	}
+	m.notifier.notify(share.ChangeNotification{
+		ClientId: req.ClientId,
+		Dir:      req.Dir,
+		Agent:    req.Agent,
+		Time:     time.Now(),
+	}, uploads)
 	return nil
 }
 
@@ -190,26 +809,10 @@ func (m *MessageHandler) Sync(msg *nats.Msg) (*share.ServerResponse, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error parsing sync request %s", err.Error())
 	}
-	var res []share.SyncResponse
-	clientChanges, err := m.ChangeStorage.Get(req.ClientId)
+	res, err := m.changeFeed(req.ClientId, req.DeviceId)
 	if err != nil {
 		return nil, fmt.Errorf("error fetching client changes %s", err.Error())
 	}
-	changemap := map[string][]share.ChangeRequestChange{}
-	for _, ch := range clientChanges.([]ChangeLog) {
-		respChanges := []share.ChangeRequestChange{}
-		for _, a := range ch.Changes {
-			respChanges = append(respChanges, share.ChangeRequestChange{
-				FileName:    a.FileName,
-				ChangeEvent: a.Change,
-				Agent:       a.Agent,
-			})
-		}
-		changemap[ch.ChangeDir] = append(changemap[ch.ChangeDir], respChanges...)
-	}
-	for dir, changes := range changemap {
-		res = append(res, share.SyncResponse{Dir: dir, Changes: changes})
-	}
 	resBytes, _ := json.Marshal(res)
 	return &share.ServerResponse{
 		Status: share.Success,
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"sync_server/share"
+
+	"github.com/minio/minio-go"
+	"github.com/nats-io/nats.go"
+)
+
+// compressed objects are marked with these metadata, the size is the one of the uncompressed content
+const (
+	compressionMetadata = "Compression"
+	sizeMetadata        = "Size"
+)
+
+// objects bigger than this are stored as is, they are uploaded in parts so they can be resumed
+const maxCompressedObjectSize = uploadPartSize
+
+type byteObject struct {
+	*bytes.Reader
+}
+
+func (byteObject) Close() error {
+	return nil
+}
+
+func (m *MiniOStorage) compressStorage(size int64) bool {
+	return m.Cfg.CompressStorage && size >= 0 && size <= maxCompressedObjectSize
+}
+
+// putObject stores data compressed when the storage is configured for it and the content shrinks enough.
+func (m *MiniOStorage) putObject(ctx context.Context, fileName string, data []byte, metadata map[string]string) error {
+	if m.Cfg.CompressStorage && share.Compressible(data[:min(len(data), share.CompressionSampleSize)]) {
+		compressed := share.CompressBytes(data)
+		if len(compressed) < len(data) {
+			metadata[compressionMetadata] = share.ZstdCompression
+			metadata[sizeMetadata] = strconv.Itoa(len(data))
+			slog.Info("Storing compressed file", "filename", fileName, "size", len(data), "compressed", len(compressed))
+			_, err := m.client.PutObjectWithContext(ctx, "syncher", fileName, bytes.NewReader(compressed), int64(len(compressed)), minio.PutObjectOptions{UserMetadata: metadata})
+			return err
+		}
+	}
+	_, err := m.client.PutObjectWithContext(ctx, "syncher", fileName, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{UserMetadata: metadata})
+	return err
+}
+
+// putVerified reads the whole content, checks it against digest and stores it.
+func (m *MiniOStorage) putVerified(ctx context.Context, fileName string, reader io.Reader, size int64, digest string) error {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	if received := hex.EncodeToString(sum[:]); digest != "" && received != digest {
+		return fmt.Errorf("checksum mismatch for %s: expected %s, received %s", fileName, digest, received)
+	}
+	return m.putObject(ctx, fileName, data, map[string]string{digestMetadata: digest})
+}
+
+func compressedObject(info minio.ObjectInfo) bool {
+	return info.Metadata.Get("X-Amz-Meta-"+compressionMetadata) == share.ZstdCompression
+}
+
+// openObject returns the uncompressed content of the object, compressed objects are small enough to be decompressed in memory.
+func (m *MiniOStorage) openObject(ctx context.Context, fileName string) (ObjectReader, error) {
+	obj, err := m.client.GetObjectWithContext(ctx, "syncher", fileName, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, err
+	}
+	if !compressedObject(info) {
+		return obj, nil
+	}
+	defer obj.Close()
+	compressed, err := io.ReadAll(obj)
+	if err != nil {
+		return nil, err
+	}
+	data, err := share.DecompressBytes(compressed, maxCompressedObjectSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress %s: %w", fileName, err)
+	}
+	return byteObject{bytes.NewReader(data)}, nil
+}
+
+// compressedReader closes the compressed stream along with the content it reads from.
+type compressedReader struct {
+	io.ReadCloser
+	content io.Closer
+}
+
+func (c compressedReader) Close() error {
+	c.ReadCloser.Close()
+	return c.content.Close()
+}
+
+// compressContent compresses the content when that shrinks it and tells the receiver through the response headers.
+func compressContent(content io.ReadCloser, resp *nats.Msg) io.ReadCloser {
+	source, compressed := share.CompressSource(content)
+	if compressed {
+		resp.Header.Set(share.TransferCompressionHeader, share.ZstdCompression)
+	}
+	return compressedReader{source, content}
+}
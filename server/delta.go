@@ -0,0 +1,48 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync_server/share"
+)
+
+// openDeltaBase opens the stored version of fileName a delta is applied to, with the block size its signature was built with.
+func openDeltaBase(ctx context.Context, fileStorage FileStorage, fileName string) (ObjectReader, int, error) {
+	info, err := fileStorage.Stat(ctx, fileName)
+	if err != nil {
+		return nil, 0, fmt.Errorf("delta base %s: %w", fileName, err)
+	}
+	base, err := fileStorage.Open(ctx, fileName)
+	if err != nil {
+		return nil, 0, fmt.Errorf("delta base %s: %w", fileName, err)
+	}
+	return base, share.DeltaBlockSize(info.Size), nil
+}
+
+func fileSignature(ctx context.Context, fileStorage FileStorage, fileName string) (share.Signature, error) {
+	info, err := fileStorage.Stat(ctx, fileName)
+	if err != nil {
+		return share.Signature{}, err
+	}
+	reader, err := fileStorage.Download(ctx, fileName)
+	if err != nil {
+		return share.Signature{}, err
+	}
+	defer reader.Close()
+	return share.ComputeSignature(reader, share.DeltaBlockSize(info.Size))
+}
+
+// deltaStream computes the delta of the stored fileName against sig while it is being read.
+func deltaStream(ctx context.Context, fileStorage FileStorage, fileName string, sig share.Signature) (io.ReadCloser, error) {
+	reader, err := fileStorage.Download(ctx, fileName)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		defer reader.Close()
+		pw.CloseWithError(share.WriteDelta(pw, sig, reader))
+	}()
+	return pr, nil
+}
@@ -1,9 +1,10 @@
 package server
 
 import (
-	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
@@ -19,22 +20,24 @@ type ReceiverService struct {
 		Transfers map[int]string
 	}
 	fileStorage FileStorage
+	// called once a received file is stored
+	stored func(ctx context.Context, fileName string)
 }
 
-func NewReceiverService(Cfg *share.ServerConfig) *ReceiverService {
+func NewReceiverService(Cfg *share.ServerConfig, fileStorage FileStorage, stored func(ctx context.Context, fileName string)) *ReceiverService {
 	var ActiveTransfers = struct {
 		sync.Mutex
 		Transfers map[int]string
 	}{Transfers: make(map[int]string)}
-	fileStorage := NewMinIoService(Cfg)
 	return &ReceiverService{
 		Cfg,
 		ActiveTransfers,
 		fileStorage,
+		stored,
 	}
 }
 
-func (r *ReceiverService) InitReceiver(port int, filePath string) error {
+func (r *ReceiverService) InitReceiver(port int, filePath string, delta bool, compress bool) error {
 	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return fmt.Errorf("failed to start listener: %w", err)
@@ -55,7 +58,7 @@ func (r *ReceiverService) InitReceiver(port int, filePath string) error {
 				slog.Error("Failed to accept connection", "err", err)
 				break
 			}
-			go r.handleConnection(conn, filePath, port)
+			go r.handleConnection(conn, filePath, port, delta, compress)
 		}
 
 		// Remove completed transfer
@@ -67,34 +70,77 @@ func (r *ReceiverService) InitReceiver(port int, filePath string) error {
 	return nil
 }
 
-func (r *ReceiverService) handleConnection(conn net.Conn, filePath string, port int) {
+func (r *ReceiverService) handleConnection(conn net.Conn, filePath string, port int, delta bool, compress bool) {
 	defer conn.Close()
-	if err := r.handleUpload(conn, filePath); err != nil {
+	if err := r.handleUpload(conn, filePath, delta, compress); err != nil {
 		slog.Error("Upload failed", "err", err)
 	}
 	slog.Info("Transfer completed", "port", port, "path", filePath)
 }
 
-func (r *ReceiverService) handleUpload(conn net.Conn, fileName string) error {
-	buf := new(bytes.Buffer)
+func (r *ReceiverService) handleUpload(conn net.Conn, fileName string, delta bool, compress bool) error {
 	var size int64
 	err := binary.Read(conn, binary.BigEndian, &size)
 	if err != nil {
 		slog.Error("Failed to read file size", "err", err)
 		return err
 	}
-	slog.Info("Size received", "size", size)
-	_, err = io.CopyN(buf, conn, size)
+	var rawDigest [sha256.Size]byte
+	err = binary.Read(conn, binary.BigEndian, &rawDigest)
 	if err != nil {
-		slog.Error("File reception error", "err", err)
+		slog.Error("Failed to read file digest", "err", err)
 		return err
 	}
-	err = r.fileStorage.Upload(context.Background(), fileName, buf, size)
+	digest := share.DecodeDigest(rawDigest)
+	slog.Info("Size received", "size", size, "digest", digest)
+	var offset int64
+	var base ObjectReader
+	var blockSize int
+	if delta {
+		base, blockSize, err = openDeltaBase(context.Background(), r.fileStorage, fileName)
+		if err != nil {
+			slog.Error("Failed to open delta base", "err", err)
+			return err
+		}
+		defer base.Close()
+	} else {
+		offset, err = r.fileStorage.UploadOffset(context.Background(), fileName, size, digest)
+		if err != nil {
+			slog.Error("Failed to get upload offset", "err", err)
+			return err
+		}
+	}
+	err = binary.Write(conn, binary.BigEndian, offset)
+	if err != nil {
+		slog.Error("Failed to send upload offset", "err", err)
+		return err
+	}
+	wire, err := share.ReadContent(conn, compress)
+	if err != nil {
+		slog.Error("Failed to read content compression", "err", err)
+		return err
+	}
+	defer wire.Close()
+	var content io.Reader = wire
+	if delta {
+		deltaReader := share.NewDeltaReader(base, blockSize, wire)
+		defer deltaReader.Close()
+		content = deltaReader
+	}
+	err = r.fileStorage.ResumeUpload(context.Background(), fileName, io.LimitReader(content, size-offset), offset, size, digest)
+	status := share.TransferOk
+	if err != nil {
+		status = share.TransferFailed
+	}
+	if writeErr := binary.Write(conn, binary.BigEndian, status); writeErr != nil {
+		slog.Error("Failed to send upload status", "err", writeErr)
+	}
 	if err != nil {
 		slog.Error("Failed to save file", "err", err)
 		return err
 	}
 	slog.Info("File saved successfully", "path", fileName)
+	r.stored(context.Background(), fileName)
 	return nil
 }
 
@@ -103,13 +149,13 @@ type DownloaderService struct {
 	fileStorage FileStorage
 }
 
-func NewDownloaderService(Cfg *share.ServerConfig) *DownloaderService {
+func NewDownloaderService(Cfg *share.ServerConfig, fileStorage FileStorage) *DownloaderService {
 	return &DownloaderService{
 		Cfg,
-		NewMinIoService(Cfg),
+		fileStorage,
 	}
 }
-func (d *DownloaderService) InitDownloader(port int, filePath string) error {
+func (d *DownloaderService) InitDownloader(port int, filePath string, delta bool, compress bool) error {
 	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		slog.Error("Failed to start listener", "err", err)
@@ -126,39 +172,102 @@ func (d *DownloaderService) InitDownloader(port int, filePath string) error {
 				slog.Error("Failed to accept connection", "err", err)
 				break
 			}
-			go d.handleConnection(conn, filePath, port)
+			go d.handleConnection(conn, filePath, port, delta, compress)
 		}
 
 	}()
 	return nil
 }
-func (d *DownloaderService) handleConnection(conn net.Conn, filePath string, port int) {
+func (d *DownloaderService) handleConnection(conn net.Conn, filePath string, port int, delta bool, compress bool) {
 	defer conn.Close()
-	if err := d.handleDownload(conn, filePath); err != nil {
+	var err error
+	if delta {
+		err = d.handleDeltaDownload(conn, filePath, compress)
+	} else {
+		err = d.handleDownload(conn, filePath, compress)
+	}
+	if err != nil {
 		slog.Error("Download failed", "err", err)
 	}
 	slog.Info("Transfer completed", "port", port, "path", filePath)
 }
 
-func (d *DownloaderService) handleDownload(conn net.Conn, fileName string) error {
-	reader, err := d.fileStorage.Download(context.Background(), fileName)
+func (d *DownloaderService) handleDownload(conn net.Conn, fileName string, compress bool) error {
+	var offset int64
+	err := binary.Read(conn, binary.BigEndian, &offset)
+	if err != nil {
+		slog.Error("Failed to read download offset", "err", err)
+		return err
+	}
+	info, err := d.fileStorage.Stat(context.Background(), fileName)
 	if err != nil {
 		slog.Error("Failed to get file size", "err", err)
 		return err
 	}
+	fileSize := info.Size
+	if offset < 0 || offset >= fileSize {
+		offset = 0
+	}
+	reader, err := d.fileStorage.DownloadFrom(context.Background(), fileName, offset)
+	if err != nil {
+		slog.Error("Failed to read file", "err", err)
+		return err
+	}
 	defer reader.Close()
-	fileBytes, err := io.ReadAll(reader)
+	err = binary.Write(conn, binary.BigEndian, []int64{fileSize, offset})
+	if err != nil {
+		slog.Error("Failed to send file size", "err", err)
+		return err
+	}
+	err = binary.Write(conn, binary.BigEndian, share.EncodeDigest(info.Digest))
+	if err != nil {
+		slog.Error("Failed to send file digest", "err", err)
+		return err
+	}
+	err = share.WriteContent(conn, io.LimitReader(reader, fileSize-offset), compress)
+	if err != nil {
+		slog.Error("error downloading file", "err", err.Error())
+		return err
+	}
+	return nil
+}
+
+// handleDeltaDownload reads the signature of the receiver's copy and answers with the delta to the stored version.
+func (d *DownloaderService) handleDeltaDownload(conn net.Conn, fileName string, compress bool) error {
+	var sigLen uint32
+	err := binary.Read(conn, binary.BigEndian, &sigLen)
+	if err != nil {
+		slog.Error("Failed to read signature size", "err", err)
+		return err
+	}
+	var sig share.Signature
+	err = json.NewDecoder(io.LimitReader(conn, int64(sigLen))).Decode(&sig)
+	if err != nil {
+		slog.Error("Failed to read signature", "err", err)
+		return err
+	}
+	info, err := d.fileStorage.Stat(context.Background(), fileName)
+	if err != nil {
+		slog.Error("Failed to get file size", "err", err)
+		return err
+	}
+	reader, err := deltaStream(context.Background(), d.fileStorage, fileName, sig)
 	if err != nil {
 		slog.Error("Failed to read file", "err", err)
 		return err
 	}
-	fileSize := int64(len(fileBytes))
-	err = binary.Write(conn, binary.BigEndian, fileSize)
+	defer reader.Close()
+	err = binary.Write(conn, binary.BigEndian, []int64{info.Size, 0})
 	if err != nil {
 		slog.Error("Failed to send file size", "err", err)
 		return err
 	}
-	_, err = io.CopyN(conn, bytes.NewReader(fileBytes), fileSize)
+	err = binary.Write(conn, binary.BigEndian, share.EncodeDigest(info.Digest))
+	if err != nil {
+		slog.Error("Failed to send file digest", "err", err)
+		return err
+	}
+	err = share.WriteContent(conn, reader, compress)
 	if err != nil {
 		slog.Error("error downloading file", "err", err.Error())
 		return err
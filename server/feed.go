@@ -0,0 +1,136 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"sync_server/share"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// a cursor per server for every device, cursors.json held a single one when only one server numbered the logs
+	feedCursorsFile = "feed_cursors.json"
+	// most change logs a device gets per sync, the rest follows once these are acknowledged
+	feedBatchSize = 200
+)
+
+func (m *MessageHandler) feedCursor(clientId string, deviceId string) map[string]int64 {
+	m.feedCursors.Lock()
+	defer m.feedCursors.Unlock()
+	m.feedCursors.load()
+	return maps.Clone(m.feedCursors.entries[clientId][deviceId])
+}
+
+// changeFeed returns the change logs the device didn't acknowledge yet, in the order this server recorded them.
+// The logs of another server are only recorded once every log it numbered before is, see replicate, so each
+// server's logs come in order and acknowledging one never skips a log still on its way.
+// A request without a device gets every change of the account, as before the feed existed.
+func (m *MessageHandler) changeFeed(clientId string, deviceId string) ([]share.SyncResponse, error) {
+	res := []share.SyncResponse{}
+	clientChanges, err := m.ChangeStorage.Get(clientId)
+	if err != nil {
+		// nothing recorded for the account yet
+		return res, nil
+	}
+	logs := clientChanges.([]ChangeLog)
+	var cursor map[string]int64
+	if deviceId != "" {
+		cursor = m.feedCursor(clientId, deviceId)
+	}
+	for _, log := range logs {
+		if log.Seq <= cursor[log.ServerId] {
+			continue
+		}
+		if deviceId != "" && len(res) == feedBatchSize {
+			break
+		}
+		changes := []share.ChangeRequestChange{}
+		for _, change := range log.Changes {
+			changes = append(changes, share.ChangeRequestChange{
+				FileName:    change.FileName,
+				ChangeEvent: change.Change,
+				Agent:       change.Agent,
+				OldPath:     change.OldPath,
+				Metadata:    change.Metadata,
+				Dir:         change.Dir,
+			})
+		}
+		res = append(res, share.SyncResponse{Dir: log.ChangeDir, Changes: changes, ServerId: log.ServerId, Seq: log.Seq, DeviceId: log.DeviceId})
+	}
+	return res, nil
+}
+
+// AckChanges moves the feed of the device past the changes it applied, the ones it didn't are delivered again.
+// The other servers get the acknowledgement too, so the device can sync with any of them.
+func (m *MessageHandler) AckChanges(msg *nats.Msg) (*share.ServerResponse, error) {
+	var req share.AckRequest
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		return nil, fmt.Errorf("error parsing ack request %s", err.Error())
+	}
+	if req.DeviceId == "" {
+		return nil, fmt.Errorf("acknowledging changes requires a device id")
+	}
+	cursor, err := m.ackFeed(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.NatsConnection.PublishToSubject("feed-ack", msg.Data); err != nil {
+		slog.Error("Failed to replicate feed acknowledgement", "client", req.ClientId, "device", req.DeviceId, "err", err.Error())
+	}
+	resBytes, err := json.Marshal(cursor)
+	if err != nil {
+		return nil, err
+	}
+	return &share.ServerResponse{
+		Status: share.Success,
+		Data:   string(resBytes),
+	}, nil
+}
+
+// FeedAck records an acknowledgement another server got, acknowledging twice changes nothing.
+func (m *MessageHandler) FeedAck(msg *nats.Msg) (*share.ServerResponse, error) {
+	var req share.AckRequest
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		return nil, fmt.Errorf("error parsing ack request %s", err.Error())
+	}
+	if _, err := m.ackFeed(req); err != nil {
+		return nil, err
+	}
+	return &share.ServerResponse{
+		Status: share.Success,
+		Data:   "ack applied",
+	}, nil
+}
+
+// ackFeed moves the cursors of the device forward, never back, and returns them.
+func (m *MessageHandler) ackFeed(req share.AckRequest) (map[string]int64, error) {
+	m.feedCursors.Lock()
+	defer m.feedCursors.Unlock()
+	m.feedCursors.load()
+	devices, ok := m.feedCursors.entries[req.ClientId]
+	if !ok {
+		devices = make(map[string]map[string]int64)
+		m.feedCursors.entries[req.ClientId] = devices
+	}
+	cursor, ok := devices[req.DeviceId]
+	if !ok {
+		cursor = make(map[string]int64)
+		devices[req.DeviceId] = cursor
+	}
+	moved := false
+	for serverId, seq := range req.Seqs {
+		if seq > cursor[serverId] {
+			cursor[serverId] = seq
+			moved = true
+		}
+	}
+	if moved {
+		if err := m.feedCursors.save(); err != nil {
+			return nil, err
+		}
+	}
+	return maps.Clone(cursor), nil
+}
@@ -2,8 +2,11 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"log/slog"
+	"os"
+	"strconv"
 	"sync_server/share"
 
 	"github.com/minio/minio-go"
@@ -14,33 +17,72 @@ type FileStorage interface {
 	Upload(ctx context.Context, fileName string, reader io.Reader, size int64) error
 	UploadPath(ctx context.Context, fileName string, filePath string) error
 	RemoveFile(fileName string) error
+	// CopyFile stores the content of src under dst as well, without going through the server.
+	CopyFile(ctx context.Context, src string, dst string) error
 	Download(ctx context.Context, fileName string) (io.ReadCloser, error)
+	Stat(ctx context.Context, fileName string) (FileInfo, error)
+	// UploadOffset reports how many bytes of an interrupted upload of fileName with the given size and digest are already stored.
+	UploadOffset(ctx context.Context, fileName string, size int64, digest string) (int64, error)
+	// ResumeUpload stores the rest of fileName from offset and fails without replacing the object if the content doesn't match digest.
+	ResumeUpload(ctx context.Context, fileName string, reader io.Reader, offset int64, size int64, digest string) error
+	DownloadFrom(ctx context.Context, fileName string, offset int64) (io.ReadCloser, error)
+	// Open gives random access to the stored object, it's the base delta transfers are applied to.
+	Open(ctx context.Context, fileName string) (ObjectReader, error)
+}
+
+type ObjectReader interface {
+	io.ReadCloser
+	io.ReaderAt
+}
+
+// sha256 of the whole content, kept as object metadata
+const digestMetadata = "Sha256"
+
+type FileInfo struct {
+	Size   int64
+	Digest string
 }
 
 type MiniOStorage struct {
 	Cfg    *share.ServerConfig
 	client *minio.Client
+	core   *minio.Core
+	// multipart uploads that were interrupted, kept so they survive restarts
+	uploads *jsonIndex[PendingUpload]
 }
 
 func NewMinIoService(cfg *share.ServerConfig) *MiniOStorage {
 	server := &MiniOStorage{
-		Cfg: cfg,
+		Cfg:     cfg,
+		uploads: newJSONIndex[PendingUpload](cfg.LogPath(pendingUploadsFile), "pending uploads"),
 	}
 	server.Init()
 	return server
 }
 
+// NewFileStorage returns the storage selected in the server config.
+func NewFileStorage(cfg *share.ServerConfig) FileStorage {
+	if cfg.Storage == share.ChunkedStorage {
+		return NewChunkStorage(cfg)
+	}
+	return NewMinIoService(cfg)
+}
+
 func (m *MiniOStorage) Init() error {
 	minioClient, err := minio.New(m.Cfg.Endpoint, m.Cfg.MinIO.AccessKeyID, m.Cfg.MinIO.SecretAccessKey, m.Cfg.MinIO.UseSSL)
 	if err != nil {
 		return err
 	}
 	m.client = minioClient
+	m.core = &minio.Core{Client: minioClient}
 	return nil
 }
 
 func (m *MiniOStorage) Upload(ctx context.Context, fileName string, reader io.Reader, size int64) error {
 	slog.Info("Uploading file", "filename", fileName)
+	if m.compressStorage(size) {
+		return m.putVerified(ctx, fileName, reader, size, "")
+	}
 	_, err := m.client.PutObjectWithContext(ctx, "syncher", fileName, reader, size, minio.PutObjectOptions{})
 	if err != nil {
 		return err
@@ -50,6 +92,20 @@ func (m *MiniOStorage) Upload(ctx context.Context, fileName string, reader io.Re
 
 func (m *MiniOStorage) UploadPath(ctx context.Context, fileName string, filePath string) error {
 	slog.Info("Uploading file", "filename", fileName, "filePath", filePath)
+	if m.Cfg.CompressStorage {
+		file, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		stat, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		if m.compressStorage(stat.Size()) {
+			return m.putVerified(ctx, fileName, file, stat.Size(), "")
+		}
+	}
 	_, err := m.client.FPutObjectWithContext(ctx, "syncher", fileName, filePath, minio.PutObjectOptions{})
 	if err != nil {
 		return err
@@ -65,6 +121,38 @@ func (m *MiniOStorage) RemoveFile(fileName string) error {
 	return nil
 }
 
+func (m *MiniOStorage) CopyFile(ctx context.Context, src string, dst string) error {
+	slog.Info("Copying file", "src", src, "dst", dst)
+	// without user metadata the copy keeps the digest and compression markers of the source
+	dstInfo, err := minio.NewDestinationInfo("syncher", dst, nil, nil)
+	if err != nil {
+		return err
+	}
+	return m.client.CopyObject(dstInfo, minio.NewSourceInfo("syncher", src, nil))
+}
+
 func (m *MiniOStorage) Download(ctx context.Context, fileName string) (io.ReadCloser, error) {
-	return m.client.GetObjectWithContext(ctx, "syncher", fileName, minio.GetObjectOptions{})
+	return m.openObject(ctx, fileName)
+}
+
+func (m *MiniOStorage) Stat(ctx context.Context, fileName string) (FileInfo, error) {
+	info, err := m.client.StatObject("syncher", fileName, minio.StatObjectOptions{})
+	if err != nil {
+		return FileInfo{}, err
+	}
+	size := info.Size
+	if compressedObject(info) {
+		size, err = strconv.ParseInt(info.Metadata.Get("X-Amz-Meta-"+sizeMetadata), 10, 64)
+		if err != nil {
+			return FileInfo{}, fmt.Errorf("invalid size of compressed %s: %w", fileName, err)
+		}
+	}
+	return FileInfo{
+		Size:   size,
+		Digest: info.Metadata.Get("X-Amz-Meta-" + digestMetadata),
+	}, nil
+}
+
+func (m *MiniOStorage) Open(ctx context.Context, fileName string) (ObjectReader, error) {
+	return m.openObject(ctx, fileName)
 }
@@ -0,0 +1,360 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync_server/share"
+)
+
+const (
+	fileTreeFile = "tree.json"
+	// the entries changed since tree.json was written, one json line each
+	fileTreeJournalFile = "tree.journal"
+	// the journal is folded into tree.json once it holds this many entries
+	fileTreeCompactSize = 1000
+)
+
+type journalEntry struct {
+	ClientId string          `json:"client_id"`
+	Entry    share.FileEntry `json:"entry"`
+}
+
+// FileTree is the current state of every file of every account, kept up to date by every recorded change
+// so nobody has to replay the change log to know what a folder holds.
+type FileTree struct {
+	index *jsonIndex[map[string]share.FileEntry]
+	// where a tree replayed from the change log reads the size and hash of the files
+	storage FileStorage
+	// loads the change log a missing tree is rebuilt from
+	logs        func() (map[string][]ChangeLog, error)
+	journalPath string
+	// the entries changed since the tree was last persisted, the index guards it
+	journal struct {
+		pending []journalEntry
+		// entries already in the journal file
+		size int
+	}
+}
+
+// NewFileTree loads the tree before the server takes requests, so a replay reading the storage doesn't hold up any.
+func NewFileTree(cfg *share.ServerConfig, storage FileStorage, logs func() (map[string][]ChangeLog, error)) *FileTree {
+	tree := &FileTree{
+		index:       newJSONIndex[map[string]share.FileEntry](cfg.LogPath(fileTreeFile), "file tree"),
+		storage:     storage,
+		logs:        logs,
+		journalPath: cfg.LogPath(fileTreeJournalFile),
+	}
+	tree.index.Lock()
+	defer tree.index.Unlock()
+	tree.load()
+	return tree
+}
+
+// load tells whether the tree had to be rebuilt from the change log, the index has to be locked.
+func (t *FileTree) load() bool {
+	if t.index.loaded {
+		return false
+	}
+	if t.index.load() {
+		t.replayJournal()
+		return false
+	}
+	slog.Info("Rebuilding the file tree from the change log")
+	logs, err := t.logs()
+	if err != nil {
+		logs = map[string][]ChangeLog{}
+	}
+	for clientId, clientLogs := range logs {
+		t.index.entries[clientId] = t.replay(context.Background(), clientId, clientLogs)
+	}
+	if err := t.compact(); err != nil {
+		slog.Error("Failed to save file tree", "err", err.Error())
+	}
+	return true
+}
+
+// replayJournal applies the entries changed after tree.json was written, the index has to be locked.
+// A line cut short by a crash is skipped, the entry it held is lost the same way an unsaved tree would be.
+func (t *FileTree) replayJournal() {
+	file, err := os.Open(t.journalPath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var line journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			slog.Warn("Skipping a damaged file tree journal entry", "err", err.Error())
+			continue
+		}
+		t.namespace(line.ClientId)[line.Entry.Path] = line.Entry
+		t.journal.size++
+	}
+}
+
+// replay builds the entries of an account out of its change logs and reads the size and hash
+// of every existing file from the storage, it doesn't touch the tree so it needs no lock.
+func (t *FileTree) replay(ctx context.Context, clientId string, logs []ChangeLog) map[string]share.FileEntry {
+	namespace := make(map[string]share.FileEntry)
+	for _, log := range logs {
+		applyChangeLog(namespace, log)
+	}
+	if t.storage == nil {
+		return namespace
+	}
+	for path, entry := range namespace {
+		if entry.Deleted || entry.Dir {
+			continue
+		}
+		info, err := t.storage.Stat(ctx, clientId+path)
+		if err != nil {
+			continue
+		}
+		entry.Size = info.Size
+		entry.Hash = info.Digest
+		namespace[path] = entry
+	}
+	return namespace
+}
+
+// namespace returns the entries of the account, the index has to be locked.
+func (t *FileTree) namespace(clientId string) map[string]share.FileEntry {
+	namespace, ok := t.index.entries[clientId]
+	if !ok {
+		namespace = make(map[string]share.FileEntry)
+		t.index.entries[clientId] = namespace
+	}
+	return namespace
+}
+
+// set updates an entry and queues it for the journal, the index has to be locked.
+func (t *FileTree) set(clientId string, entry share.FileEntry) {
+	t.namespace(clientId)[entry.Path] = entry
+	t.journal.pending = append(t.journal.pending, journalEntry{ClientId: clientId, Entry: entry})
+}
+
+// persist appends the changed entries to the journal, or folds everything into tree.json once
+// the journal grew long enough, so a change costs a line rather than a rewrite of the whole tree.
+// The index has to be locked.
+func (t *FileTree) persist() error {
+	if len(t.journal.pending) == 0 {
+		return nil
+	}
+	if t.journal.size+len(t.journal.pending) >= fileTreeCompactSize {
+		return t.compact()
+	}
+	var buf bytes.Buffer
+	for _, line := range t.journal.pending {
+		data, err := json.Marshal(line)
+		if err != nil {
+			return fmt.Errorf("failed to marshal file tree entry: %w", err)
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	file, err := os.OpenFile(t.journalPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open file tree journal: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write file tree journal: %w", err)
+	}
+	t.journal.size += len(t.journal.pending)
+	t.journal.pending = nil
+	return nil
+}
+
+// compact writes the whole tree and empties the journal, the index has to be locked.
+func (t *FileTree) compact() error {
+	if err := t.index.save(); err != nil {
+		return err
+	}
+	t.journal.pending = nil
+	t.journal.size = 0
+	if err := os.Remove(t.journalPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove file tree journal: %w", err)
+	}
+	return nil
+}
+
+// applyChangeLog applies a change log to the entries of an account and returns the ones it changed.
+func applyChangeLog(namespace map[string]share.FileEntry, log ChangeLog) []share.FileEntry {
+	changed := []share.FileEntry{}
+	set := func(entry share.FileEntry) {
+		namespace[entry.Path] = entry
+		changed = append(changed, entry)
+	}
+	for _, change := range log.Changes {
+		path := log.ChangeDir + "/" + change.FileName
+		entry := namespace[path]
+		entry.Path = path
+		entry.Version++
+		entry.ModifiedBy = log.DeviceId
+		entry.Modified = log.Time
+		entry.Deleted = removedChange(change.Change)
+		entry.Dir = entry.Dir || change.Change == share.DirCreateChange || change.Change == share.DirRemoveChange || change.Dir
+		if change.Metadata != nil {
+			entry.Metadata = change.Metadata
+			if change.Metadata.LinkTarget != "" {
+				entry.Size, entry.Hash = 0, ""
+			}
+		}
+		if change.Change == share.DirRemoveChange {
+			for subPath, sub := range namespace {
+				if strings.HasPrefix(subPath, path+"/") && !sub.Deleted {
+					sub.Version++
+					sub.ModifiedBy = log.DeviceId
+					sub.Modified = log.Time
+					sub.Deleted = true
+					set(sub)
+				}
+			}
+		}
+		if change.Change == share.MoveChange && change.Dir {
+			moved := []share.FileEntry{}
+			for subPath, sub := range namespace {
+				if strings.HasPrefix(subPath, change.OldPath+"/") && !sub.Deleted {
+					moved = append(moved, sub)
+				}
+			}
+			for _, sub := range moved {
+				target := namespace[path+strings.TrimPrefix(sub.Path, change.OldPath)]
+				target.Path = path + strings.TrimPrefix(sub.Path, change.OldPath)
+				target.Version++
+				target.ModifiedBy = log.DeviceId
+				target.Modified = log.Time
+				target.Deleted = false
+				target.Dir, target.Size, target.Hash, target.Metadata = sub.Dir, sub.Size, sub.Hash, sub.Metadata
+				set(target)
+				sub.Version++
+				sub.ModifiedBy = log.DeviceId
+				sub.Modified = log.Time
+				sub.Deleted = true
+				set(sub)
+			}
+		}
+		if change.Change == share.MoveChange {
+			moved := namespace[change.OldPath]
+			entry.Size, entry.Hash = moved.Size, moved.Hash
+			if moved.Path != "" {
+				moved.Version++
+				moved.ModifiedBy = log.DeviceId
+				moved.Modified = log.Time
+				moved.Deleted = true
+				set(moved)
+			}
+		}
+		set(entry)
+	}
+	return changed
+}
+
+// record applies a change log that was just recorded.
+// The content of a changed file is only known once it's stored, so its size and hash are left to Stored.
+func (t *FileTree) record(log ChangeLog) error {
+	t.index.Lock()
+	defer t.index.Unlock()
+	if !t.load() {
+		// a rebuilt tree already replayed it
+		for _, entry := range applyChangeLog(t.namespace(log.ClientId), log) {
+			t.set(log.ClientId, entry)
+		}
+	}
+	return t.persist()
+}
+
+// splitFileName splits a storage key into the account it belongs to and the local path of the file,
+// local paths are absolute so the account id ends at the first slash.
+func splitFileName(fileName string) (string, string) {
+	i := strings.Index(fileName, "/")
+	if i < 0 {
+		return fileName, ""
+	}
+	return fileName[:i], fileName[i:]
+}
+
+// Stored records the size and hash of a file once its content is stored.
+func (t *FileTree) Stored(ctx context.Context, fileName string) {
+	info, err := t.storage.Stat(ctx, fileName)
+	if err != nil {
+		slog.Error("Failed to stat stored file", "filename", fileName, "err", err.Error())
+		return
+	}
+	clientId, path := splitFileName(fileName)
+	t.index.Lock()
+	defer t.index.Unlock()
+	t.load()
+	entry := t.index.entries[clientId][path]
+	entry.Path = path
+	entry.Size = info.Size
+	entry.Hash = info.Digest
+	entry.Deleted = false
+	t.set(clientId, entry)
+	if err := t.persist(); err != nil {
+		slog.Error("Failed to save file tree", "err", err.Error())
+	}
+}
+
+// Rebuild replays the change log of the account and reads the size and hash of its existing files from the storage.
+// The other accounts are left alone.
+func (t *FileTree) Rebuild(ctx context.Context, clientId string) error {
+	logs, err := t.logs()
+	if err != nil {
+		return err
+	}
+	namespace := t.replay(ctx, clientId, logs[clientId])
+	t.index.Lock()
+	defer t.index.Unlock()
+	t.load()
+	t.index.entries[clientId] = namespace
+	return t.compact()
+}
+
+// entry returns what the tree knows of path.
+func (t *FileTree) entry(clientId string, path string) (share.FileEntry, bool) {
+	t.index.Lock()
+	defer t.index.Unlock()
+	t.load()
+	entry, ok := t.index.entries[clientId][path]
+	return entry, ok
+}
+
+// dirExists tells whether the tree knows dir as an existing folder of the account.
+func (t *FileTree) dirExists(clientId string, dir string) bool {
+	entry, ok := t.entry(clientId, dir)
+	return ok && entry.Dir && !entry.Deleted
+}
+
+// fileExists tells whether the tree knows path as an existing file of the account.
+func (t *FileTree) fileExists(clientId string, path string) bool {
+	entry, ok := t.entry(clientId, path)
+	return ok && !entry.Dir && !entry.Deleted
+}
+
+// Entries returns the entries of the account inside dir sorted by path, deleted ones only if asked for.
+func (t *FileTree) Entries(clientId string, dir string, deleted bool) []share.FileEntry {
+	t.index.Lock()
+	defer t.index.Unlock()
+	t.load()
+	entries := []share.FileEntry{}
+	for path, entry := range t.index.entries[clientId] {
+		if dir != "" && !inDir(path, dir) || entry.Deleted && !deleted {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+	return entries
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"sync_server/share"
+	"testing"
+	"time"
+)
+
+// treeEntry is what the tests check of a file entry.
+type treeEntry struct {
+	path       string
+	deleted    bool
+	dir        bool
+	version    int64
+	modifiedBy string
+	hash       string
+}
+
+func treeEntries(entries []share.FileEntry) []treeEntry {
+	got := []treeEntry{}
+	for _, entry := range entries {
+		got = append(got, treeEntry{
+			path:       entry.Path,
+			deleted:    entry.Deleted,
+			dir:        entry.Dir,
+			version:    entry.Version,
+			modifiedBy: entry.ModifiedBy,
+			hash:       entry.Hash,
+		})
+	}
+	slices.SortFunc(got, func(a, b treeEntry) int {
+		if a.path < b.path {
+			return -1
+		}
+		return 1
+	})
+	return got
+}
+
+func TestApplyChangeLog(t *testing.T) {
+	log := func(device string, dir string, changes ...ChangeLogChanges) ChangeLog {
+		return ChangeLog{ClientId: "c", DeviceId: device, ChangeDir: dir, Changes: changes, Time: time.Now()}
+	}
+	tests := []struct {
+		name string
+		logs []ChangeLog
+		want []treeEntry
+	}{
+		{
+			name: "created",
+			logs: []ChangeLog{log("d1", "/s", ChangeLogChanges{FileName: "f", Change: "CREATE"})},
+			want: []treeEntry{{path: "/s/f", version: 1, modifiedBy: "d1"}},
+		},
+		{
+			name: "written by another device",
+			logs: []ChangeLog{
+				log("d1", "/s", ChangeLogChanges{FileName: "f", Change: "CREATE"}),
+				log("d2", "/s", ChangeLogChanges{FileName: "f", Change: "WRITE"}),
+			},
+			want: []treeEntry{{path: "/s/f", version: 2, modifiedBy: "d2"}},
+		},
+		{
+			name: "removed",
+			logs: []ChangeLog{
+				log("d1", "/s", ChangeLogChanges{FileName: "f", Change: "CREATE"}),
+				log("d1", "/s", ChangeLogChanges{FileName: "f", Change: "REMOVE"}),
+			},
+			want: []treeEntry{{path: "/s/f", deleted: true, version: 2, modifiedBy: "d1"}},
+		},
+		{
+			name: "moved",
+			logs: []ChangeLog{
+				log("d1", "/s", ChangeLogChanges{FileName: "f", Change: "CREATE"}),
+				log("d2", "/s", ChangeLogChanges{FileName: "g", Change: share.MoveChange, OldPath: "/s/f"}),
+			},
+			want: []treeEntry{
+				{path: "/s/f", deleted: true, version: 2, modifiedBy: "d2"},
+				{path: "/s/g", version: 1, modifiedBy: "d2"},
+			},
+		},
+		{
+			name: "folder moved",
+			logs: []ChangeLog{
+				log("d1", "/s", ChangeLogChanges{FileName: "a", Change: share.DirCreateChange}),
+				log("d1", "/s/a", ChangeLogChanges{FileName: "f", Change: "CREATE"}),
+				log("d1", "/s", ChangeLogChanges{FileName: "b", Change: share.MoveChange, OldPath: "/s/a", Dir: true}),
+			},
+			want: []treeEntry{
+				{path: "/s/a", deleted: true, dir: true, version: 2, modifiedBy: "d1"},
+				{path: "/s/a/f", deleted: true, version: 2, modifiedBy: "d1"},
+				{path: "/s/b", dir: true, version: 1, modifiedBy: "d1"},
+				{path: "/s/b/f", version: 1, modifiedBy: "d1"},
+			},
+		},
+		{
+			name: "folder removed",
+			logs: []ChangeLog{
+				log("d1", "/s", ChangeLogChanges{FileName: "a", Change: share.DirCreateChange}),
+				log("d1", "/s/a", ChangeLogChanges{FileName: "f", Change: "CREATE"}),
+				log("d2", "/s", ChangeLogChanges{FileName: "a", Change: share.DirRemoveChange}),
+			},
+			want: []treeEntry{
+				{path: "/s/a", deleted: true, dir: true, version: 2, modifiedBy: "d2"},
+				{path: "/s/a/f", deleted: true, version: 2, modifiedBy: "d2"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			namespace := make(map[string]share.FileEntry)
+			for _, log := range tt.logs {
+				applyChangeLog(namespace, log)
+			}
+			entries := []share.FileEntry{}
+			for _, entry := range namespace {
+				entries = append(entries, entry)
+			}
+			if got := treeEntries(entries); !slices.Equal(got, tt.want) {
+				t.Errorf("tree %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileTreeJournal(t *testing.T) {
+	tests := []struct {
+		name    string
+		records int
+		// a crash cut the last line of the journal short
+		damaged bool
+		// the journal was folded into tree.json
+		compacted bool
+	}{
+		{name: "journaled", records: 3},
+		// the stored file is the first line of the journal
+		{name: "compacted", records: fileTreeCompactSize - 1, compacted: true},
+		{name: "damaged last line skipped", records: 3, damaged: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &share.ServerConfig{LogDir: t.TempDir()}
+			storage := newMemStorage()
+			logs := func() (map[string][]ChangeLog, error) { return map[string][]ChangeLog{}, nil }
+			tree := NewFileTree(cfg, storage, logs)
+			storage.objects["c/s/f0"] = []byte("content")
+			tree.Stored(context.Background(), "c/s/f0")
+			for i := range tt.records {
+				log := ChangeLog{
+					ClientId:  "c",
+					DeviceId:  "d1",
+					ChangeDir: "/s",
+					Changes:   []ChangeLogChanges{{FileName: fmt.Sprintf("f%d", i), Change: "CREATE"}},
+					Time:      time.Now(),
+				}
+				if err := tree.record(log); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, err := os.Stat(cfg.LogPath(fileTreeJournalFile))
+			if journaled := err == nil; journaled == tt.compacted {
+				t.Errorf("journal kept %v after %d records", journaled, tt.records)
+			}
+			want := treeEntries(tree.Entries("c", "", true))
+			if tt.damaged {
+				file, err := os.OpenFile(cfg.LogPath(fileTreeJournalFile), os.O_APPEND|os.O_WRONLY, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				file.WriteString(`{"client_id":"c","entry":{"Pa`)
+				file.Close()
+			}
+
+			reloaded := NewFileTree(cfg, storage, logs)
+			if got := treeEntries(reloaded.Entries("c", "", true)); !slices.Equal(got, want) {
+				t.Errorf("reloaded tree %v, want %v", got, want)
+			}
+			if entry, _ := reloaded.entry("c", "/s/f0"); entry.Hash != share.ChunkHash([]byte("content")) {
+				t.Errorf("stored hash %q not kept", entry.Hash)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"sync_server/share"
+)
+
+// jsonIndex is a map the server keeps in a json file of its log folder, loaded the first time it's used.
+// It's written through a temporary file so a crash mid-write leaves the previous version in place.
+type jsonIndex[V any] struct {
+	sync.Mutex
+	path    string
+	name    string
+	loaded  bool
+	entries map[string]V
+}
+
+func newJSONIndex[V any](path string, name string) *jsonIndex[V] {
+	return &jsonIndex[V]{path: path, name: name}
+}
+
+// load reads the index if it wasn't yet and tells whether the file held one, the index has to be locked.
+func (x *jsonIndex[V]) load() bool {
+	if x.loaded {
+		return true
+	}
+	x.loaded = true
+	x.entries = make(map[string]V)
+	file, err := os.ReadFile(x.path)
+	if err != nil || len(file) == 0 {
+		return false
+	}
+	if err := json.Unmarshal(file, &x.entries); err != nil {
+		slog.Error("Failed to load "+x.name, "err", err.Error())
+		x.entries = make(map[string]V)
+		return false
+	}
+	return true
+}
+
+// save writes the index, it has to be locked.
+func (x *jsonIndex[V]) save() error {
+	data, err := json.MarshalIndent(x.entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %w", x.name, err)
+	}
+	if err := share.WriteFileAtomic(x.path, data); err != nil {
+		return fmt.Errorf("failed to write %s: %w", x.name, err)
+	}
+	return nil
+}
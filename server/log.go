@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"sync"
+	"sync_server/share"
 	"time"
 )
 
@@ -43,9 +45,9 @@ func (s *Server) recordLog(log Log) error {
 	var logPath string
 	switch log.Event {
 	case Err:
-		logPath = "logs/error.log"
+		logPath = s.Cfg.LogPath("error.log")
 	case Warn, Info:
-		logPath = "logs/server.log"
+		logPath = s.Cfg.LogPath("server.log")
 	default:
 		return fmt.Errorf("unknown log event type")
 	}
@@ -67,40 +69,97 @@ func (s *Server) recordLog(log Log) error {
 type ChangeLogChanges struct {
 	FileName string `json:"file_name"`
 	Change   string `json:"change"`
-	Agent string
+	Agent    string
+	OldPath  string              `json:"old_path,omitempty"`
+	Metadata *share.FileMetadata `json:"metadata,omitempty"`
+	// a moved folder, everything under OldPath moved along
+	Dir bool `json:"dir,omitempty"`
 }
 
 type ChangeLog struct {
-	ClientId  string             `json:"client_id"`
+	ClientId string `json:"client_id"`
+	// device of the account the changes came from, the server for the changes it made itself
+	DeviceId  string             `json:"device_id,omitempty"`
 	ServerId  string             `json:"server_id"`
 	ChangeDir string             `json:"change_dir"`
 	Changes   []ChangeLogChanges `json:"changes"`
 	Time      time.Time          `json:"time"`
+	// position in the log of the server that recorded it, the change feed of a device acknowledges up to it
+	Seq int64 `json:"seq"`
 }
 
-func recordChangeLog(log ChangeLog) error {
-	logPath := "logs/changes.json"
+const changeLogFile = "changes.json"
 
+// ChangeLogFile holds the change logs of every account, the ones replicated from other servers included.
+type ChangeLogFile struct {
+	// serialises the recording of change logs, a log is numbered, written and stored before the next one
+	sync.Mutex
+	path string
+}
+
+func NewChangeLogFile(cfg *share.ServerConfig) *ChangeLogFile {
+	return &ChangeLogFile{path: cfg.LogPath(changeLogFile)}
+}
+
+// read returns every recorded change log in the order they were recorded, the log file has to be locked.
+func (f *ChangeLogFile) read() ([]ChangeLog, error) {
 	var logs []ChangeLog
-	file, err := os.ReadFile(logPath)
-	if err == nil {
-		if len(file) > 0 {
-			if err := json.Unmarshal(file, &logs); err != nil {
-				return fmt.Errorf("failed to unmarshal existing logs: %w", err)
-			}
-		}
+	file, err := os.ReadFile(f.path)
+	if err != nil || len(file) == 0 {
+		return logs, nil
 	}
+	if err := json.Unmarshal(file, &logs); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal existing logs: %w", err)
+	}
+	for i, log := range logs {
+		logs[i].Seq = logSeq(i, log)
+	}
+	return logs, nil
+}
 
-	logs = append(logs, log)
-
+// writeChangeLogs appends the logs to the log file and stores them for the change feed and the file tree,
+// the log file has to be locked.
+func (m *MessageHandler) writeChangeLogs(logs []ChangeLog, added ...ChangeLog) ([]ChangeLog, error) {
+	logs = append(logs, added...)
 	newData, err := json.MarshalIndent(logs, "", "  ")
 	if err != nil {
-		return fmt.Errorf("failed to marshal logs: %w", err)
+		return logs, fmt.Errorf("failed to marshal logs: %w", err)
+	}
+	if err := share.WriteFileAtomic(m.changeLog.path, newData); err != nil {
+		return logs, fmt.Errorf("failed to write log file: %w", err)
 	}
+	for _, log := range added {
+		if err := m.ChangeStorage.Set(log.ClientId, log); err != nil {
+			return logs, err
+		}
+		if err := m.tree.record(log); err != nil {
+			return logs, err
+		}
+	}
+	return logs, nil
+}
 
-	if err := os.WriteFile(logPath, newData, 0644); err != nil {
-		return fmt.Errorf("failed to write log file: %w", err)
+// recordChangeLog numbers the log after the previous ones of this server, records it and publishes it before
+// the next one is recorded, so the other servers receive the logs of this one in order.
+func (m *MessageHandler) recordChangeLog(log ChangeLog, publish func(log ChangeLog) error) (ChangeLog, error) {
+	m.changeLog.Lock()
+	defer m.changeLog.Unlock()
+	logs, err := m.changeLog.read()
+	if err != nil {
+		return log, err
 	}
+	log.Seq = lastSeq(logs, log.ServerId) + 1
+	if _, err := m.writeChangeLogs(logs, log); err != nil {
+		return log, err
+	}
+	return log, publish(log)
+}
 
-	return nil
+// logSeq is the number of the log at position i of the log file, logs recorded before they were numbered
+// are numbered by their position.
+func logSeq(i int, log ChangeLog) int64 {
+	if log.Seq == 0 {
+		return int64(i + 1)
+	}
+	return log.Seq
 }
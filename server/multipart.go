@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+
+	"github.com/minio/minio-go"
+)
+
+// parts have to be at least 5MB for s3, every part except the last one is exactly this size
+const uploadPartSize = 8 * 1024 * 1024
+
+const pendingUploadsFile = "uploads.json"
+
+type PendingUpload struct {
+	UploadId string `json:"upload_id"`
+	Size     int64  `json:"size"`
+	Digest   string `json:"digest"`
+	// hash state over the first HashedParts parts, so a resumed upload can still be verified as a whole
+	HashState   []byte `json:"hash_state"`
+	HashedParts int    `json:"hashed_parts"`
+}
+
+func (m *MiniOStorage) pendingUpload(fileName string) (PendingUpload, bool) {
+	m.uploads.Lock()
+	defer m.uploads.Unlock()
+	m.uploads.load()
+	upload, ok := m.uploads.entries[fileName]
+	return upload, ok
+}
+
+func (m *MiniOStorage) setPendingUpload(fileName string, upload *PendingUpload) error {
+	m.uploads.Lock()
+	defer m.uploads.Unlock()
+	m.uploads.load()
+	if upload == nil {
+		delete(m.uploads.entries, fileName)
+	} else {
+		m.uploads.entries[fileName] = *upload
+	}
+	return m.uploads.save()
+}
+
+// completedParts returns the leading run of parts that were fully stored and hashed for the upload.
+func (m *MiniOStorage) completedParts(fileName string, upload PendingUpload) ([]minio.CompletePart, error) {
+	result, err := m.core.ListObjectParts("syncher", fileName, upload.UploadId, 0, 10000)
+	if err != nil {
+		return nil, err
+	}
+	parts := []minio.CompletePart{}
+	for _, part := range result.ObjectParts {
+		if part.PartNumber != len(parts)+1 || part.Size != uploadPartSize || len(parts) == upload.HashedParts {
+			break
+		}
+		parts = append(parts, minio.CompletePart{PartNumber: part.PartNumber, ETag: part.ETag})
+	}
+	if len(parts) < upload.HashedParts {
+		// we can't verify the upload without the hash state of these exact parts
+		return []minio.CompletePart{}, nil
+	}
+	return parts, nil
+}
+
+func (m *MiniOStorage) UploadOffset(ctx context.Context, fileName string, size int64, digest string) (int64, error) {
+	upload, ok := m.pendingUpload(fileName)
+	if !ok || upload.Size != size || upload.Digest != digest {
+		return 0, nil
+	}
+	parts, err := m.completedParts(fileName, upload)
+	if err != nil {
+		slog.Error("Failed to list uploaded parts", "filename", fileName, "err", err.Error())
+		return 0, nil
+	}
+	return int64(len(parts)) * uploadPartSize, nil
+}
+
+// hash restores the digest computed over the stored parts of the upload.
+func (upload PendingUpload) hash() (hash.Hash, error) {
+	h := sha256.New()
+	if upload.HashedParts == 0 {
+		return h, nil
+	}
+	if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(upload.HashState); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (m *MiniOStorage) ResumeUpload(ctx context.Context, fileName string, reader io.Reader, offset int64, size int64, digest string) error {
+	if size <= uploadPartSize {
+		if offset != 0 {
+			return fmt.Errorf("invalid offset %d for %s", offset, fileName)
+		}
+		slog.Info("Uploading file", "filename", fileName)
+		if m.Cfg.CompressStorage {
+			return m.putVerified(ctx, fileName, reader, size, digest)
+		}
+		// the storage rejects the object itself when the content doesn't match the digest
+		_, err := m.core.PutObject("syncher", fileName, reader, size, "", digest, map[string]string{digestMetadata: digest}, nil)
+		return err
+	}
+	upload, ok := m.pendingUpload(fileName)
+	if ok && (upload.Size != size || upload.Digest != digest || offset == 0 && upload.HashedParts > 0) {
+		m.abortUpload(fileName, upload)
+		ok = false
+	}
+	if !ok {
+		uploadId, err := m.core.NewMultipartUpload("syncher", fileName, minio.PutObjectOptions{
+			UserMetadata: map[string]string{digestMetadata: digest},
+		})
+		if err != nil {
+			return err
+		}
+		upload = PendingUpload{UploadId: uploadId, Size: size, Digest: digest}
+		if err := m.setPendingUpload(fileName, &upload); err != nil {
+			return err
+		}
+	}
+	parts, err := m.completedParts(fileName, upload)
+	if err != nil {
+		return err
+	}
+	if offset != int64(len(parts))*uploadPartSize {
+		return fmt.Errorf("offset %d doesn't match the stored parts of %s", offset, fileName)
+	}
+	h, err := upload.hash()
+	if err != nil {
+		m.abortUpload(fileName, upload)
+		return fmt.Errorf("failed to restore upload digest of %s: %w", fileName, err)
+	}
+	slog.Info("Uploading file", "filename", fileName, "offset", offset)
+	for remaining := size - offset; remaining > 0; {
+		partSize := min(int64(uploadPartSize), remaining)
+		partNumber := len(parts) + 1
+		partReader := io.TeeReader(io.LimitReader(reader, partSize), h)
+		part, err := m.core.PutObjectPart("syncher", fileName, upload.UploadId, partNumber, partReader, partSize, "", "", nil)
+		if err != nil {
+			return err
+		}
+		parts = append(parts, minio.CompletePart{PartNumber: partNumber, ETag: part.ETag})
+		remaining -= partSize
+		upload.HashState, err = h.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return err
+		}
+		upload.HashedParts = len(parts)
+		if err := m.setPendingUpload(fileName, &upload); err != nil {
+			return err
+		}
+	}
+	if received := hex.EncodeToString(h.Sum(nil)); received != digest {
+		m.abortUpload(fileName, upload)
+		return fmt.Errorf("checksum mismatch for %s: expected %s, received %s", fileName, digest, received)
+	}
+	if _, err := m.core.CompleteMultipartUpload("syncher", fileName, upload.UploadId, parts); err != nil {
+		return err
+	}
+	return m.setPendingUpload(fileName, nil)
+}
+
+func (m *MiniOStorage) abortUpload(fileName string, upload PendingUpload) {
+	if err := m.core.AbortMultipartUpload("syncher", fileName, upload.UploadId); err != nil {
+		slog.Error("Failed to abort upload", "filename", fileName, "err", err.Error())
+	}
+	if err := m.setPendingUpload(fileName, nil); err != nil {
+		slog.Error("Failed to forget upload", "filename", fileName, "err", err.Error())
+	}
+}
+
+func (m *MiniOStorage) DownloadFrom(ctx context.Context, fileName string, offset int64) (io.ReadCloser, error) {
+	if info, err := m.client.StatObject("syncher", fileName, minio.StatObjectOptions{}); err == nil && compressedObject(info) {
+		obj, err := m.openObject(ctx, fileName)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := obj.(io.Seeker).Seek(offset, io.SeekStart); err != nil {
+			obj.Close()
+			return nil, err
+		}
+		return obj, nil
+	}
+	opts := minio.GetObjectOptions{}
+	if offset > 0 {
+		if err := opts.SetRange(offset, 0); err != nil {
+			return nil, err
+		}
+	}
+	return m.client.GetObjectWithContext(ctx, "syncher", fileName, opts)
+}
@@ -0,0 +1,366 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync_server/share"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+const natsTransferTimeout = 30 * time.Second
+
+type NatsTransferService struct {
+	Cfg         *share.ServerConfig
+	NatsConn    *share.NatsConn
+	fileStorage FileStorage
+	// called once a received file is stored
+	stored func(ctx context.Context, fileName string)
+}
+
+func NewNatsTransferService(cfg *share.ServerConfig, natsConn *share.NatsConn, fileStorage FileStorage, stored func(ctx context.Context, fileName string)) *NatsTransferService {
+	return &NatsTransferService{
+		Cfg:         cfg,
+		NatsConn:    natsConn,
+		fileStorage: fileStorage,
+		stored:      stored,
+	}
+}
+
+func transferSubject(direction string) string {
+	return fmt.Sprintf("transfer.%s.%s", direction, uuid.NewString())
+}
+
+// InitReceiver subscribes to a one-off subject and writes the ordered chunks sent to it into the file storage.
+// Every chunk is acknowledged only after it is handed to the storage, so the sender can't run ahead of us.
+// Once compression was negotiated the first message tells whether the chunks are compressed.
+func (t *NatsTransferService) InitReceiver(filePath string, delta bool, compress bool) (string, error) {
+	subject := transferSubject("upload")
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	expected := 0
+	var once sync.Once
+	var sub *nats.Subscription
+	var timer *time.Timer
+
+	finish := func(err error) {
+		once.Do(func() {
+			timer.Stop()
+			pw.CloseWithError(err)
+			if sub != nil {
+				sub.Unsubscribe()
+			}
+		})
+	}
+	timer = time.AfterFunc(natsTransferTimeout, func() {
+		slog.Error("Nats receiver timed out", "subject", subject, "path", filePath)
+		finish(errors.New("transfer timed out"))
+	})
+
+	sub, err := t.NatsConn.Subscribe(subject, func(msg *nats.Msg) {
+		timer.Reset(natsTransferTimeout)
+		seq, err := strconv.Atoi(msg.Header.Get(share.TransferSeqHeader))
+		if err != nil || seq != expected {
+			respondTransfer(msg, expected, fmt.Errorf("expected chunk %d", expected))
+			return
+		}
+		// the first message only carries the size, its reply tells the sender where to resume from
+		if seq == 0 {
+			size, err := strconv.ParseInt(msg.Header.Get(share.TransferSizeHeader), 10, 64)
+			if err != nil {
+				respondTransfer(msg, seq, fmt.Errorf("invalid transfer size: %w", err))
+				finish(err)
+				return
+			}
+			digest := msg.Header.Get(share.TransferDigestHeader)
+			var offset int64
+			var wire io.Reader = pr
+			closers := []io.Closer{}
+			cleanup := func() {
+				for _, closer := range closers {
+					closer.Close()
+				}
+			}
+			if msg.Header.Get(share.TransferCompressionHeader) == share.ZstdCompression {
+				if !compress {
+					err := errors.New("compression wasn't negotiated")
+					respondTransfer(msg, seq, err)
+					finish(err)
+					return
+				}
+				decompressed, err := share.NewDecompressReader(pr)
+				if err != nil {
+					respondTransfer(msg, seq, err)
+					finish(err)
+					return
+				}
+				wire = decompressed
+				closers = append(closers, decompressed)
+			}
+			content := wire
+			if delta {
+				base, blockSize, err := openDeltaBase(context.Background(), t.fileStorage, filePath)
+				if err != nil {
+					cleanup()
+					respondTransfer(msg, seq, err)
+					finish(err)
+					return
+				}
+				deltaReader := share.NewDeltaReader(base, blockSize, wire)
+				content = deltaReader
+				closers = append([]io.Closer{deltaReader, base}, closers...)
+			} else {
+				offset, err = t.fileStorage.UploadOffset(context.Background(), filePath, size, digest)
+				if err != nil {
+					cleanup()
+					respondTransfer(msg, seq, err)
+					finish(err)
+					return
+				}
+			}
+			go func() {
+				err := t.fileStorage.ResumeUpload(context.Background(), filePath, io.LimitReader(content, size-offset), offset, size, digest)
+				if err == nil {
+					// the end of a compressed stream follows the content, it's read until the last chunk arrived
+					_, err = io.Copy(io.Discard, wire)
+				}
+				cleanup()
+				pr.CloseWithError(err)
+				done <- err
+			}()
+			expected++
+			resp := nats.NewMsg(msg.Reply)
+			resp.Header.Set(share.TransferSeqHeader, strconv.Itoa(seq))
+			resp.Header.Set(share.TransferOffsetHeader, strconv.FormatInt(offset, 10))
+			if err := msg.RespondMsg(resp); err != nil {
+				slog.Error("Failed to acknowledge chunk", "subject", subject, "err", err)
+			}
+			return
+		}
+		if _, err := pw.Write(msg.Data); err != nil {
+			respondTransfer(msg, seq, err)
+			finish(err)
+			return
+		}
+		expected++
+		if msg.Header.Get(share.TransferEOFHeader) == "" {
+			respondTransfer(msg, seq, nil)
+			return
+		}
+		finish(nil)
+		err = <-done
+		if err != nil {
+			slog.Error("Failed to save file", "err", err)
+		} else {
+			slog.Info("File saved successfully", "path", filePath)
+			t.stored(context.Background(), filePath)
+		}
+		respondTransfer(msg, seq, err)
+	})
+	if err != nil {
+		timer.Stop()
+		return "", err
+	}
+	slog.Info("Nats receiver started", "subject", subject, "path", filePath)
+	return subject, nil
+}
+
+// InitChunkReceiver lets the sender ask which chunks of its manifest are missing, send only those and then commit the manifest.
+func (t *NatsTransferService) InitChunkReceiver(filePath string) (string, error) {
+	chunks, ok := t.fileStorage.(ChunkStore)
+	if !ok {
+		return "", errors.New("the file storage doesn't store chunks")
+	}
+	subject := transferSubject("chunks")
+	var once sync.Once
+	var sub *nats.Subscription
+	var timer *time.Timer
+
+	finish := func() {
+		once.Do(func() {
+			timer.Stop()
+			if sub != nil {
+				sub.Unsubscribe()
+			}
+		})
+	}
+	timer = time.AfterFunc(natsTransferTimeout, func() {
+		slog.Error("Nats chunk receiver timed out", "subject", subject, "path", filePath)
+		finish()
+	})
+
+	sub, err := t.NatsConn.Subscribe(subject, func(msg *nats.Msg) {
+		timer.Reset(natsTransferTimeout)
+		seq, _ := strconv.Atoi(msg.Header.Get(share.TransferSeqHeader))
+		switch msg.Header.Get(share.TransferOpHeader) {
+		case share.ChunkOpMissing:
+			var manifest share.Manifest
+			if err := json.Unmarshal(msg.Data, &manifest); err != nil {
+				respondTransfer(msg, seq, fmt.Errorf("invalid manifest: %w", err))
+				return
+			}
+			missing, err := chunks.MissingChunks(context.Background(), manifest.Chunks)
+			if err != nil {
+				respondTransfer(msg, seq, err)
+				return
+			}
+			data, _ := json.Marshal(missing)
+			resp := nats.NewMsg(msg.Reply)
+			resp.Header.Set(share.TransferSeqHeader, strconv.Itoa(seq))
+			resp.Data = data
+			if err := msg.RespondMsg(resp); err != nil {
+				slog.Error("Failed to send missing chunks", "subject", subject, "err", err)
+			}
+		case share.ChunkOpPut:
+			data := msg.Data
+			if msg.Header.Get(share.TransferCompressionHeader) == share.ZstdCompression {
+				var err error
+				if data, err = share.DecompressBytes(data, share.MaxChunkSize); err != nil {
+					respondTransfer(msg, seq, err)
+					return
+				}
+			}
+			respondTransfer(msg, seq, chunks.PutChunk(context.Background(), msg.Header.Get(share.TransferChunkHeader), data))
+		case share.ChunkOpCommit:
+			var manifest share.Manifest
+			err := json.Unmarshal(msg.Data, &manifest)
+			if err == nil {
+				err = chunks.CommitManifest(context.Background(), filePath, manifest)
+			}
+			if err != nil {
+				slog.Error("Failed to save file", "err", err)
+			} else {
+				slog.Info("File saved successfully", "path", filePath)
+				t.stored(context.Background(), filePath)
+			}
+			respondTransfer(msg, seq, err)
+			finish()
+		default:
+			respondTransfer(msg, seq, fmt.Errorf("unknown chunk operation %q", msg.Header.Get(share.TransferOpHeader)))
+		}
+	})
+	if err != nil {
+		timer.Stop()
+		return "", err
+	}
+	slog.Info("Nats chunk receiver started", "subject", subject, "path", filePath)
+	return subject, nil
+}
+
+// InitDownloader serves the file chunk by chunk, each one only when the receiver asks for it.
+// The first request may carry the offset the receiver already has, or for delta transfers the signature of its copy.
+// With compression the content is compressed when that's worth it, the first response tells the receiver.
+func (t *NatsTransferService) InitDownloader(filePath string, delta bool, compress bool) (string, error) {
+	subject := transferSubject("download")
+	var reader io.ReadCloser
+	var once sync.Once
+	var sub *nats.Subscription
+	var timer *time.Timer
+	expected := 0
+
+	finish := func() {
+		once.Do(func() {
+			timer.Stop()
+			if reader != nil {
+				reader.Close()
+			}
+			if sub != nil {
+				sub.Unsubscribe()
+			}
+		})
+	}
+	timer = time.AfterFunc(natsTransferTimeout, func() {
+		slog.Error("Nats downloader timed out", "subject", subject, "path", filePath)
+		finish()
+	})
+
+	sub, err := t.NatsConn.Subscribe(subject, func(msg *nats.Msg) {
+		timer.Reset(natsTransferTimeout)
+		seq, err := strconv.Atoi(msg.Header.Get(share.TransferSeqHeader))
+		if err != nil || seq != expected {
+			respondTransfer(msg, expected, fmt.Errorf("expected chunk %d", expected))
+			return
+		}
+		resp := nats.NewMsg(msg.Reply)
+		resp.Header.Set(share.TransferSeqHeader, strconv.Itoa(seq))
+		if reader == nil {
+			info, err := t.fileStorage.Stat(context.Background(), filePath)
+			if err == nil {
+				reader, err = t.openDownload(filePath, info, msg, resp, delta)
+			}
+			if err == nil && compress {
+				reader = compressContent(reader, resp)
+			}
+			if err != nil {
+				respondTransfer(msg, seq, err)
+				finish()
+				return
+			}
+		}
+		buf := make([]byte, share.TransferChunkSize)
+		n, err := io.ReadFull(reader, buf)
+		resp.Data = buf[:n]
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			resp.Header.Set(share.TransferEOFHeader, "true")
+			finish()
+		case err != nil:
+			slog.Error("Failed to read file", "err", err)
+			resp.Header.Set(share.TransferErrorHeader, err.Error())
+			finish()
+		}
+		expected++
+		if err := msg.RespondMsg(resp); err != nil {
+			slog.Error("Failed to send chunk", "subject", subject, "err", err)
+		}
+	})
+	if err != nil {
+		timer.Stop()
+		return "", err
+	}
+	slog.Info("Nats downloader started", "subject", subject, "path", filePath)
+	return subject, nil
+}
+
+func (t *NatsTransferService) openDownload(filePath string, info FileInfo, msg *nats.Msg, resp *nats.Msg, delta bool) (io.ReadCloser, error) {
+	resp.Header.Set(share.TransferDigestHeader, info.Digest)
+	if delta {
+		var sig share.Signature
+		if err := json.Unmarshal(msg.Data, &sig); err != nil {
+			return nil, fmt.Errorf("invalid signature: %w", err)
+		}
+		resp.Header.Set(share.TransferOffsetHeader, "0")
+		return deltaStream(context.Background(), t.fileStorage, filePath, sig)
+	}
+	offset := downloadOffset(info, msg.Header.Get(share.TransferOffsetHeader))
+	resp.Header.Set(share.TransferOffsetHeader, strconv.FormatInt(offset, 10))
+	return t.fileStorage.DownloadFrom(context.Background(), filePath, offset)
+}
+
+// downloadOffset validates the offset a receiver asked for, falling back to the start of the file.
+func downloadOffset(info FileInfo, requested string) int64 {
+	offset, err := strconv.ParseInt(requested, 10, 64)
+	if err != nil || offset < 0 || offset >= info.Size {
+		return 0
+	}
+	return offset
+}
+
+func respondTransfer(msg *nats.Msg, seq int, err error) {
+	resp := nats.NewMsg(msg.Reply)
+	resp.Header.Set(share.TransferSeqHeader, strconv.Itoa(seq))
+	if err != nil {
+		resp.Header.Set(share.TransferErrorHeader, err.Error())
+	}
+	if err := msg.RespondMsg(resp); err != nil {
+		slog.Error("Failed to acknowledge chunk", "subject", msg.Subject, "err", err)
+	}
+}
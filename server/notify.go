@@ -0,0 +1,106 @@
+package server
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"sync_server/share"
+	"time"
+)
+
+// a change whose uploads don't complete in time is announced anyway, devices then catch up on their next sync
+const notifyTimeout = 5 * time.Minute
+
+// pendingNotification is the announcement of a change waiting for the files it uploads.
+type pendingNotification struct {
+	notification share.ChangeNotification
+	// storage keys of the files still being uploaded
+	waiting map[string]bool
+	timer   *time.Timer
+}
+
+// changeNotifier tells the devices of an account to sync once the content of a change is stored,
+// a device told earlier would download what the file held before.
+type changeNotifier struct {
+	natsConn *share.NatsConn
+	mu       sync.Mutex
+	// the pending notifications by the storage key of every file they wait for
+	pending map[string][]*pendingNotification
+}
+
+func newChangeNotifier(natsConn *share.NatsConn) *changeNotifier {
+	return &changeNotifier{natsConn: natsConn, pending: make(map[string][]*pendingNotification)}
+}
+
+// notify announces the change once every file it uploads is stored, right away when it uploads none.
+func (n *changeNotifier) notify(notification share.ChangeNotification, uploads []string) {
+	if len(uploads) == 0 {
+		n.publish(notification)
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	pending := &pendingNotification{notification: notification, waiting: make(map[string]bool)}
+	for _, fileName := range uploads {
+		pending.waiting[fileName] = true
+		n.pending[fileName] = append(n.pending[fileName], pending)
+	}
+	pending.timer = time.AfterFunc(notifyTimeout, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if len(pending.waiting) == 0 {
+			return
+		}
+		slog.Warn("Uploads not stored in time, announcing change", "client", notification.ClientId, "dir", notification.Dir)
+		for fileName := range pending.waiting {
+			n.drop(fileName, pending)
+		}
+		pending.waiting = nil
+		n.publish(pending.notification)
+	})
+}
+
+// stored announces the changes that were only waiting for the file.
+func (n *changeNotifier) stored(fileName string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, pending := range n.pending[fileName] {
+		delete(pending.waiting, fileName)
+		if len(pending.waiting) == 0 {
+			pending.timer.Stop()
+			n.publish(pending.notification)
+		}
+	}
+	delete(n.pending, fileName)
+}
+
+// uploading tells whether a recorded change of the file still waits for its content.
+func (n *changeNotifier) uploading(fileName string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.pending[fileName]) > 0
+}
+
+// drop stops the notification from waiting for the file, n.mu has to be locked.
+func (n *changeNotifier) drop(fileName string, pending *pendingNotification) {
+	waiting := n.pending[fileName][:0]
+	for _, other := range n.pending[fileName] {
+		if other != pending {
+			waiting = append(waiting, other)
+		}
+	}
+	if len(waiting) == 0 {
+		delete(n.pending, fileName)
+		return
+	}
+	n.pending[fileName] = waiting
+}
+
+// publish tells the devices of the account to sync right away, one missing the notification
+// still gets the change on its next safety sync.
+func (n *changeNotifier) publish(notification share.ChangeNotification) {
+	data, _ := json.Marshal(notification)
+	if err := n.natsConn.PublishToSubject(share.ChangeNotifySubject(notification.ClientId), data); err != nil {
+		slog.Error("Failed to notify change", "client", notification.ClientId, "err", err.Error())
+	}
+}
@@ -0,0 +1,341 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync_server/share"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	replicationFile = "replication.json"
+	// the subject a server asks the others on for the change logs it missed
+	catchUpSubject = "change-catch-up"
+	// how long a catch up waits for the answers of the other servers
+	catchUpTimeout = 3 * time.Second
+	// a server still missing logs asks again after this long
+	catchUpRetry = 10 * time.Second
+	// most change logs a server sends per answer, the rest follows in the next round
+	catchUpBatchSize = 500
+	// the missing logs of a server that doesn't answer for this long are skipped, the server is gone and its logs with it
+	replicationGapTimeout = time.Minute
+)
+
+// CatchUpRequest asks the other servers for the change logs they recorded after the ones the server has.
+type CatchUpRequest struct {
+	ServerId string `json:"server_id"`
+	// per server, the seq up to which every log of that server is recorded
+	Seqs map[string]int64 `json:"seqs"`
+}
+
+// CatchUpResponse holds the change logs a server recorded after the requested seq, oldest first.
+type CatchUpResponse struct {
+	ServerId string      `json:"server_id"`
+	Logs     []ChangeLog `json:"logs"`
+	// the last log the server recorded
+	Seq int64 `json:"seq"`
+	// more logs follow than fit in one answer
+	More bool `json:"more,omitempty"`
+}
+
+// replication records the change logs of the other servers in the order each of them numbered its logs.
+// A log arriving ahead of a missing one is held until the missing one arrives or is fetched from its server,
+// so the change feed never moves a device past a log the server doesn't have yet.
+// The lock of the change log file guards it.
+type replication struct {
+	// per server, the seq up to which every log of that server is recorded
+	marks *jsonIndex[int64]
+	// logs held back by a missing one, by server and seq
+	held map[string]map[int64]ChangeLog
+	// when the first missing log of each server was noticed
+	missing map[string]time.Time
+	// wakes the catch up loop when a log is missing
+	wake chan struct{}
+}
+
+func newReplication(cfg *share.ServerConfig) *replication {
+	return &replication{
+		marks:   newJSONIndex[int64](cfg.LogPath(replicationFile), "replication marks"),
+		held:    make(map[string]map[int64]ChangeLog),
+		missing: make(map[string]time.Time),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// lastSeq returns the seq of the last log the server recorded.
+func lastSeq(logs []ChangeLog, serverId string) int64 {
+	var seq int64
+	for _, log := range logs {
+		if log.ServerId == serverId {
+			seq = max(seq, log.Seq)
+		}
+	}
+	return seq
+}
+
+// mark returns the seq up to which every log of the server is recorded, logs replicated before the marks were kept
+// are taken as complete.
+func (r *replication) mark(logs []ChangeLog, serverId string) int64 {
+	r.marks.Lock()
+	defer r.marks.Unlock()
+	if !r.marks.load() || !hasKey(r.marks.entries, serverId) {
+		return lastSeq(logs, serverId)
+	}
+	return r.marks.entries[serverId]
+}
+
+func hasKey[V any](entries map[string]V, key string) bool {
+	_, ok := entries[key]
+	return ok
+}
+
+func (r *replication) setMark(serverId string, seq int64) error {
+	r.marks.Lock()
+	defer r.marks.Unlock()
+	r.marks.load()
+	r.marks.entries[serverId] = seq
+	return r.marks.save()
+}
+
+func (r *replication) hold(log ChangeLog) {
+	if r.held[log.ServerId] == nil {
+		r.held[log.ServerId] = make(map[int64]ChangeLog)
+	}
+	r.held[log.ServerId][log.Seq] = log
+}
+
+// replicate records a change log another server broadcast, once every log it numbered before is recorded.
+// A missing log starts a catch up with the other servers.
+func (m *MessageHandler) replicate(log ChangeLog) error {
+	m.changeLog.Lock()
+	defer m.changeLog.Unlock()
+	logs, err := m.changeLog.read()
+	if err != nil {
+		return err
+	}
+	if log.Seq == 0 {
+		// a server that doesn't number its logs yet, they are recorded as they come
+		log.Seq = lastSeq(logs, log.ServerId) + 1
+		_, err := m.writeChangeLogs(logs, log)
+		return err
+	}
+	mark := m.replication.mark(logs, log.ServerId)
+	if log.Seq <= mark {
+		return nil
+	}
+	m.replication.hold(log)
+	if log.Seq > mark+1 {
+		if _, ok := m.replication.missing[log.ServerId]; !ok {
+			slog.Warn("Change log missing, catching up", "server", log.ServerId, "seq", mark+1, "received", log.Seq)
+			m.replication.missing[log.ServerId] = time.Now()
+		}
+		select {
+		case m.replication.wake <- struct{}{}:
+		default:
+		}
+		return nil
+	}
+	return m.drain(logs, log.ServerId, 0)
+}
+
+// drain records the held logs of the server that follow its mark in order and stops at the first one missing,
+// unless it's at or below through: the server that numbered it doesn't have it. The log file has to be locked.
+func (m *MessageHandler) drain(logs []ChangeLog, serverId string, through int64) error {
+	held := m.replication.held[serverId]
+	mark := m.replication.mark(logs, serverId)
+	recorded := make(map[int64]bool)
+	for _, log := range logs {
+		if log.ServerId == serverId {
+			recorded[log.Seq] = true
+		}
+	}
+	added := []ChangeLog{}
+	for {
+		log, ok := held[mark+1]
+		if !ok && mark+1 > through {
+			break
+		}
+		mark++
+		delete(held, mark)
+		if ok && !recorded[mark] {
+			added = append(added, log)
+		}
+	}
+	for seq := range held {
+		if seq <= mark {
+			delete(held, seq)
+		}
+	}
+	if len(held) == 0 {
+		delete(m.replication.held, serverId)
+		delete(m.replication.missing, serverId)
+	}
+	if len(added) > 0 {
+		if _, err := m.writeChangeLogs(logs, added...); err != nil {
+			return err
+		}
+	}
+	return m.replication.setMark(serverId, mark)
+}
+
+// replicationMarks returns the seq up to which the logs of every other server the log file knows are recorded.
+func (m *MessageHandler) replicationMarks() (map[string]int64, error) {
+	m.changeLog.Lock()
+	defer m.changeLog.Unlock()
+	logs, err := m.changeLog.read()
+	if err != nil {
+		return nil, err
+	}
+	marks := make(map[string]int64)
+	for _, log := range logs {
+		if log.ServerId != m.Cfg.ServerId && !hasKey(marks, log.ServerId) {
+			marks[log.ServerId] = m.replication.mark(logs, log.ServerId)
+		}
+	}
+	return marks, nil
+}
+
+// catchUpLoop catches up with the other servers when the server starts and whenever a log is missing,
+// and asks again while logs are held back.
+func (m *MessageHandler) catchUpLoop() {
+	for {
+		if !m.catchUp() {
+			<-m.replication.wake
+			continue
+		}
+		select {
+		case <-m.replication.wake:
+		case <-time.After(catchUpRetry):
+		}
+	}
+}
+
+// catchUp asks the other servers for the logs they recorded after the ones this server has, a server that
+// doesn't answer for too long is taken as gone and the logs it held back are recorded past the missing ones.
+// It tells whether the server should ask again.
+func (m *MessageHandler) catchUp() bool {
+	marks, err := m.replicationMarks()
+	if err != nil {
+		slog.Error("Failed to catch up with the other servers", "err", err.Error())
+		return true
+	}
+	data, _ := json.Marshal(CatchUpRequest{ServerId: m.Cfg.ServerId, Seqs: marks})
+	replies, err := m.NatsConnection.RequestAll(catchUpSubject, data, catchUpTimeout)
+	if err != nil {
+		slog.Error("Failed to catch up with the other servers", "err", err.Error())
+		return true
+	}
+	again := false
+	answered := make(map[string]bool)
+	for _, reply := range replies {
+		var serverResp share.ServerResponse
+		var res CatchUpResponse
+		if json.Unmarshal(reply.Data, &serverResp) != nil || serverResp.Status != share.Success ||
+			json.Unmarshal([]byte(serverResp.Data), &res) != nil || res.ServerId == m.Cfg.ServerId {
+			continue
+		}
+		answered[res.ServerId] = true
+		if err := m.caughtUp(res); err != nil {
+			slog.Error("Failed to record caught up change logs", "server", res.ServerId, "err", err.Error())
+			again = true
+		}
+		again = again || res.More
+	}
+	waiting, err := m.skipGone(answered)
+	if err != nil {
+		slog.Error("Failed to record held back change logs", "err", err.Error())
+	}
+	return again || waiting
+}
+
+// caughtUp records the logs another server answered a catch up with, along with the ones held back by them.
+func (m *MessageHandler) caughtUp(res CatchUpResponse) error {
+	m.changeLog.Lock()
+	defer m.changeLog.Unlock()
+	logs, err := m.changeLog.read()
+	if err != nil {
+		return err
+	}
+	for _, log := range res.Logs {
+		if log.ServerId == res.ServerId {
+			m.replication.hold(log)
+		}
+	}
+	// the server sent every log it has up to the last one it sent, the seqs it skipped don't exist
+	through := res.Seq
+	if res.More && len(res.Logs) > 0 {
+		through = res.Logs[len(res.Logs)-1].Seq
+	}
+	return m.drain(logs, res.ServerId, through)
+}
+
+// skipGone records the logs held back for servers that didn't answer for too long past the missing ones,
+// it tells whether logs are still held back.
+func (m *MessageHandler) skipGone(answered map[string]bool) (bool, error) {
+	m.changeLog.Lock()
+	defer m.changeLog.Unlock()
+	logs, err := m.changeLog.read()
+	if err != nil {
+		return true, err
+	}
+	for _, serverId := range slices.Collect(maps.Keys(m.replication.held)) {
+		since, ok := m.replication.missing[serverId]
+		if !ok {
+			m.replication.missing[serverId] = time.Now()
+			continue
+		}
+		if answered[serverId] || time.Since(since) < replicationGapTimeout {
+			continue
+		}
+		through := slices.Max(slices.Collect(maps.Keys(m.replication.held[serverId])))
+		slog.Warn("Server gone, skipping its missing change logs", "server", serverId, "through", through)
+		if err := m.drain(logs, serverId, through); err != nil {
+			return true, err
+		}
+		if logs, err = m.changeLog.read(); err != nil {
+			return true, err
+		}
+	}
+	return len(m.replication.held) > 0, nil
+}
+
+// CatchUp answers another server with the logs this server recorded after the ones it has.
+func (m *MessageHandler) CatchUp(msg *nats.Msg) (*share.ServerResponse, error) {
+	var req CatchUpRequest
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		return nil, fmt.Errorf("error parsing catch up request %s", err.Error())
+	}
+	res := CatchUpResponse{ServerId: m.Cfg.ServerId, Logs: []ChangeLog{}}
+	if req.ServerId != m.Cfg.ServerId {
+		m.changeLog.Lock()
+		logs, err := m.changeLog.read()
+		m.changeLog.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("error reading change logs %s", err.Error())
+		}
+		res.Seq = lastSeq(logs, m.Cfg.ServerId)
+		for _, log := range logs {
+			if log.ServerId != m.Cfg.ServerId || log.Seq <= req.Seqs[m.Cfg.ServerId] {
+				continue
+			}
+			if len(res.Logs) == catchUpBatchSize {
+				res.More = true
+				break
+			}
+			res.Logs = append(res.Logs, log)
+		}
+	}
+	resBytes, err := json.Marshal(res)
+	if err != nil {
+		return nil, err
+	}
+	return &share.ServerResponse{
+		Status: share.Success,
+		Data:   string(resBytes),
+	}, nil
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"slices"
+	"sync_server/share"
+	"testing"
+	"time"
+)
+
+func newReplicationHandler(t *testing.T) *MessageHandler {
+	cfg := &share.ServerConfig{LogDir: t.TempDir(), ServerId: "local"}
+	changeLog := NewChangeLogFile(cfg)
+	return &MessageHandler{
+		Cfg:           cfg,
+		ChangeStorage: NewChangeStorage(changeLog),
+		changeLog:     changeLog,
+		tree:          NewFileTree(cfg, nil, changeLog.Load),
+		replication:   newReplication(cfg),
+	}
+}
+
+func peerLog(seq int64) ChangeLog {
+	return ChangeLog{
+		ClientId:  "client",
+		ServerId:  "peer",
+		ChangeDir: "/s",
+		Changes:   []ChangeLogChanges{{FileName: "f", Change: "WRITE"}},
+		Time:      time.Now(),
+		Seq:       seq,
+	}
+}
+
+// fed returns the seqs of the change feed of the account in the order it delivers them.
+func fed(t *testing.T, m *MessageHandler) []int64 {
+	res, err := m.changeFeed("client", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seqs []int64
+	for _, log := range res {
+		seqs = append(seqs, log.Seq)
+	}
+	return seqs
+}
+
+func TestReplicate(t *testing.T) {
+	tests := []struct {
+		name   string
+		arrive []int64
+		want   []int64
+		held   bool
+	}{
+		{name: "in order", arrive: []int64{1, 2, 3}, want: []int64{1, 2, 3}},
+		{name: "swapped", arrive: []int64{2, 1, 3}, want: []int64{1, 2, 3}},
+		{name: "duplicate", arrive: []int64{1, 1, 2, 2}, want: []int64{1, 2}},
+		{name: "gap held back", arrive: []int64{1, 3, 4}, want: []int64{1}, held: true},
+		{name: "gap filled late", arrive: []int64{1, 3, 4, 2}, want: []int64{1, 2, 3, 4}},
+		{name: "missed start", arrive: []int64{2}, want: nil, held: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newReplicationHandler(t)
+			for _, seq := range tt.arrive {
+				if err := m.replicate(peerLog(seq)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := fed(t, m); !slices.Equal(got, tt.want) {
+				t.Errorf("fed %v, want %v", got, tt.want)
+			}
+			if held := len(m.replication.held) > 0; held != tt.held {
+				t.Errorf("logs held back %v, want %v", held, tt.held)
+			}
+			if tt.held && len(m.replication.wake) == 0 {
+				t.Errorf("catch up not woken")
+			}
+		})
+	}
+}
+
+func TestCaughtUp(t *testing.T) {
+	tests := []struct {
+		name   string
+		arrive []int64
+		res    CatchUpResponse
+		want   []int64
+	}{
+		{
+			name:   "missing log fetched",
+			arrive: []int64{1, 3},
+			res:    CatchUpResponse{ServerId: "peer", Logs: []ChangeLog{peerLog(2), peerLog(3)}, Seq: 3},
+			want:   []int64{1, 2, 3},
+		},
+		{
+			name:   "seq the server doesn't have skipped",
+			arrive: []int64{1, 4},
+			res:    CatchUpResponse{ServerId: "peer", Logs: []ChangeLog{peerLog(2)}, Seq: 4},
+			want:   []int64{1, 2, 4},
+		},
+		{
+			name:   "partial answer",
+			arrive: []int64{1, 5},
+			res:    CatchUpResponse{ServerId: "peer", Logs: []ChangeLog{peerLog(2), peerLog(3)}, Seq: 5, More: true},
+			want:   []int64{1, 2, 3},
+		},
+		{
+			name: "nothing received yet",
+			res:  CatchUpResponse{ServerId: "peer", Logs: []ChangeLog{peerLog(1), peerLog(2)}, Seq: 2},
+			want: []int64{1, 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newReplicationHandler(t)
+			for _, seq := range tt.arrive {
+				if err := m.replicate(peerLog(seq)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := m.caughtUp(tt.res); err != nil {
+				t.Fatal(err)
+			}
+			if got := fed(t, m); !slices.Equal(got, tt.want) {
+				t.Errorf("fed %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSkipGone(t *testing.T) {
+	tests := []struct {
+		name     string
+		answered bool
+		since    time.Duration
+		want     []int64
+		waiting  bool
+	}{
+		{name: "gone", since: 2 * replicationGapTimeout, want: []int64{1, 3}},
+		{name: "not gone for long", since: replicationGapTimeout / 2, want: []int64{1}, waiting: true},
+		{name: "answered", answered: true, since: 2 * replicationGapTimeout, want: []int64{1}, waiting: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newReplicationHandler(t)
+			for _, seq := range []int64{1, 3} {
+				if err := m.replicate(peerLog(seq)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			m.replication.missing["peer"] = time.Now().Add(-tt.since)
+			waiting, err := m.skipGone(map[string]bool{"peer": tt.answered})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if waiting != tt.waiting {
+				t.Errorf("waiting %v, want %v", waiting, tt.waiting)
+			}
+			if got := fed(t, m); !slices.Equal(got, tt.want) {
+				t.Errorf("fed %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordChangeLogNumbersOwnLogs(t *testing.T) {
+	m := newReplicationHandler(t)
+	if err := m.replicate(peerLog(1)); err != nil {
+		t.Fatal(err)
+	}
+	var published []int64
+	for range 3 {
+		_, err := m.recordChangeLog(ChangeLog{ClientId: "client", ServerId: "local", ChangeDir: "/s"}, func(log ChangeLog) error {
+			published = append(published, log.Seq)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []int64{1, 2, 3}; !slices.Equal(published, want) {
+		t.Errorf("published %v, want %v", published, want)
+	}
+}
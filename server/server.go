@@ -14,9 +14,12 @@ type Error struct {
 	Receiver  *nats.Msg `json:"receiver,omitempty"`
 }
 type Server struct {
-	Cfg            *share.ServerConfig
-	ErrChan        chan Error
-	Subjects       []string
+	Cfg      *share.ServerConfig
+	ErrChan  chan Error
+	Subjects []string
+	// subjects every server gets the messages of, to replicate the change logs and the feed cursors.
+	// Their messages are handled one at a time in the order they arrive, so change logs are replicated in order.
+	Broadcasts     []string
 	NatsConnection *share.NatsConn
 	Handler        *MessageHandler
 }
@@ -28,9 +31,28 @@ func NewServer(Cfg *share.ServerConfig) *Server {
 		[]string{
 			"change",
 			"sync",
+			"ack-changes",
 			"health",
-			"server-change",
+			"upload-file",
 			"download-file",
+			"file-signature",
+			"list-versions",
+			"download-version",
+			"restore-version",
+			"list-trash",
+			"restore-trash",
+			"purge-trash",
+			"create-snapshot",
+			"list-snapshots",
+			"snapshot-files",
+			"download-snapshot-file",
+			"rebuild-file-tree",
+			"list-files",
+		},
+		[]string{
+			"server-change",
+			"feed-ack",
+			catchUpSubject,
 		},
 		share.NewNatsConn(Cfg.NatsUrl),
 		NewMessageHandler(Cfg),
@@ -55,10 +77,24 @@ func (s *Server) subscribe() {
 			}
 			return
 		}
-		go s.handleSubscription(sub)
+		go s.handleSubscription(sub, false)
+	}
+	for _, sbj := range s.Broadcasts {
+		sub, err := s.NatsConnection.SubscribeBroadcast(sbj)
+		if err != nil {
+			s.ErrChan <- Error{
+				ErrorMsg:  fmt.Sprintf("Failed to subscribe to subject %s", sbj),
+				IsPublish: true,
+				Receiver:  nil,
+			}
+			return
+		}
+		go s.handleSubscription(sub, true)
 	}
+	// the change logs recorded by the other servers while this one wasn't listening
+	go s.Handler.catchUpLoop()
 }
-func (s *Server) handleSubscription(sub *nats.Subscription) {
+func (s *Server) handleSubscription(sub *nats.Subscription, sequential bool) {
 	for msg, err := range sub.Msgs() {
 		if err != nil {
 			s.ErrChan <- Error{
@@ -69,6 +105,10 @@ func (s *Server) handleSubscription(sub *nats.Subscription) {
 			return
 		}
 		s.log("Server Message", string(msg.Data))
+		if sequential {
+			s.handleMessage(msg)
+			continue
+		}
 		go s.handleMessage(msg)
 	}
 }
@@ -0,0 +1,294 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync_server/share"
+	"time"
+)
+
+const (
+	snapshotPrefix = "snapshots/"
+	snapshotsFile  = "snapshots.json"
+)
+
+func snapshotKey(clientId string, name string, localPath string) string {
+	return snapshotPrefix + clientId + "/" + name + localPath
+}
+
+func inDir(path string, dir string) bool {
+	dir = strings.TrimSuffix(dir, "/")
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// removedChange tells whether the change left no file at its path, a renamed file is created again under its new name.
+func removedChange(change string) bool {
+	return strings.Contains(change, "REMOVE") || strings.Contains(change, "RENAME") || change == share.DirRemoveChange
+}
+
+// SnapshotStore rebuilds the state of a folder at any point in time out of the change log,
+// the file versions and the trash, and keeps named snapshots of it.
+type SnapshotStore struct {
+	Cfg         *share.ServerConfig
+	fileStorage FileStorage
+	versions    *VersionStore
+	trash       *TrashBin
+	logs        func() (map[string][]ChangeLog, error)
+	// named snapshots of every account
+	index *jsonIndex[[]share.Snapshot]
+}
+
+func NewSnapshotStore(cfg *share.ServerConfig, fileStorage FileStorage, versions *VersionStore, trash *TrashBin, logs func() (map[string][]ChangeLog, error)) *SnapshotStore {
+	return &SnapshotStore{
+		Cfg:         cfg,
+		fileStorage: fileStorage,
+		versions:    versions,
+		trash:       trash,
+		logs:        logs,
+		index:       newJSONIndex[[]share.Snapshot](cfg.LogPath(snapshotsFile), "snapshots"),
+	}
+}
+
+type snapshotSource struct {
+	share.SnapshotFile
+	key string
+}
+
+// contentChange tells whether the change replaced the content at its path, metadata and folder creations leave it alone.
+func contentChange(change string) bool {
+	return change != share.MetadataChange && change != "CHMOD" && change != share.DirCreateChange
+}
+
+// contentKey returns the key of the content the file had at the given time. Whatever replaced that content
+// archived it as a version or a trash entry right before the change was logged at until, so the content is
+// the entry stored between the two. It tells false when retention took that entry away, a later one holds
+// other content. A file nothing replaced since has its current content.
+func (s *SnapshotStore) contentKey(clientId string, localPath string, at time.Time, until time.Time) (string, bool) {
+	fileName := clientId + localPath
+	if until.IsZero() {
+		return fileName, true
+	}
+	key := ""
+	var replaced time.Time
+	covers := func(t time.Time) bool {
+		return t.After(at) && !t.After(until) && (replaced.IsZero() || t.Before(replaced))
+	}
+	for _, version := range s.versions.history(fileName) {
+		if covers(version.Time) {
+			key, replaced = versionKey(fileName, version.Id), version.Time
+		}
+	}
+	for _, entry := range s.trash.deleted(clientId) {
+		if entry.FilePath == localPath && covers(entry.Time) {
+			key, replaced = trashKey(clientId, entry.Id), entry.Time
+		}
+	}
+	return key, key != ""
+}
+
+// Resolve replays the change log of dir up to the given time and finds the stored content of every file that existed then.
+// Files whose content isn't retained anymore are left out.
+func (s *SnapshotStore) Resolve(ctx context.Context, clientId string, dir string, at time.Time) ([]snapshotSource, error) {
+	logs, err := s.logs()
+	if err != nil {
+		return nil, err
+	}
+	exists := make(map[string]bool)
+	// when the content each file had at the given time was first replaced
+	replaced := make(map[string]time.Time)
+	replace := func(path string, t time.Time) {
+		if exists[path] && replaced[path].IsZero() {
+			replaced[path] = t
+		}
+	}
+	for _, log := range logs[clientId] {
+		if log.Time.After(at) {
+			for _, change := range log.Changes {
+				if !contentChange(change.Change) {
+					continue
+				}
+				path := log.ChangeDir + "/" + change.FileName
+				if change.Dir || change.Change == share.DirRemoveChange {
+					for existing := range exists {
+						if inDir(existing, path) || change.Dir && inDir(existing, change.OldPath) {
+							replace(existing, log.Time)
+						}
+					}
+					continue
+				}
+				replace(path, log.Time)
+				if change.OldPath != "" {
+					replace(change.OldPath, log.Time)
+				}
+			}
+			continue
+		}
+		for _, change := range log.Changes {
+			path := log.ChangeDir + "/" + change.FileName
+			// a moved file is gone from its old path
+			if change.Change == share.MoveChange && !change.Dir {
+				exists[change.OldPath] = false
+			}
+			switch {
+			case change.Change == share.MoveChange && change.Dir:
+				// files are tracked outside dir too, a folder may be moved into it
+				moved := []string{}
+				for existing, ok := range exists {
+					if ok && inDir(existing, change.OldPath) {
+						moved = append(moved, existing)
+					}
+				}
+				for _, existing := range moved {
+					exists[existing] = false
+					exists[path+strings.TrimPrefix(existing, change.OldPath)] = true
+				}
+			case change.Change == share.DirCreateChange:
+				// folders hold no content of their own
+			case change.Change == share.DirRemoveChange:
+				for existing := range exists {
+					if inDir(existing, path) {
+						exists[existing] = false
+					}
+				}
+			default:
+				exists[path] = !removedChange(change.Change)
+			}
+		}
+	}
+	sources := []snapshotSource{}
+	for localPath, ok := range exists {
+		if !ok || !inDir(localPath, dir) {
+			continue
+		}
+		key, retained := s.contentKey(clientId, localPath, at, replaced[localPath])
+		if !retained {
+			slog.Warn("Snapshot content not retained", "path", localPath, "at", at)
+			continue
+		}
+		info, err := s.fileStorage.Stat(ctx, key)
+		if err != nil {
+			slog.Warn("Snapshot content not retained", "path", localPath, "at", at)
+			continue
+		}
+		sources = append(sources, snapshotSource{
+			SnapshotFile: share.SnapshotFile{FilePath: localPath, Size: info.Size, Digest: info.Digest},
+			key:          key,
+		})
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].FilePath < sources[j].FilePath
+	})
+	return sources, nil
+}
+
+// Create copies the state of dir at the given time into a named snapshot, so retention can't take it away.
+func (s *SnapshotStore) Create(ctx context.Context, clientId string, name string, dir string, at time.Time) (share.Snapshot, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return share.Snapshot{}, fmt.Errorf("invalid snapshot name %q", name)
+	}
+	if at.IsZero() {
+		at = time.Now()
+	}
+	s.index.Lock()
+	defer s.index.Unlock()
+	s.index.load()
+	for _, snapshot := range s.index.entries[clientId] {
+		if snapshot.Name == name {
+			return share.Snapshot{}, fmt.Errorf("snapshot %s already exists", name)
+		}
+	}
+	sources, err := s.Resolve(ctx, clientId, dir, at)
+	if err != nil {
+		return share.Snapshot{}, err
+	}
+	snapshot := share.Snapshot{Name: name, Dir: dir, At: at, Created: time.Now(), Files: []share.SnapshotFile{}}
+	for _, source := range sources {
+		if err := s.fileStorage.CopyFile(ctx, source.key, snapshotKey(clientId, name, source.FilePath)); err != nil {
+			return share.Snapshot{}, fmt.Errorf("failed to snapshot %s: %w", source.FilePath, err)
+		}
+		snapshot.Files = append(snapshot.Files, source.SnapshotFile)
+	}
+	snapshot.FileCount = len(snapshot.Files)
+	s.index.entries[clientId] = append(s.index.entries[clientId], snapshot)
+	return snapshot, s.index.save()
+}
+
+// List returns the snapshots of the account taken inside dir, or all of them when dir is empty, without their files.
+func (s *SnapshotStore) List(clientId string, dir string) []share.Snapshot {
+	s.index.Lock()
+	defer s.index.Unlock()
+	s.index.load()
+	list := []share.Snapshot{}
+	for _, snapshot := range s.index.entries[clientId] {
+		if dir != "" && !inDir(snapshot.Dir, dir) {
+			continue
+		}
+		snapshot.Files = nil
+		list = append(list, snapshot)
+	}
+	return list
+}
+
+func (s *SnapshotStore) snapshot(clientId string, name string) (share.Snapshot, error) {
+	s.index.Lock()
+	defer s.index.Unlock()
+	s.index.load()
+	for _, snapshot := range s.index.entries[clientId] {
+		if snapshot.Name == name {
+			return snapshot, nil
+		}
+	}
+	return share.Snapshot{}, fmt.Errorf("snapshot %s not found", name)
+}
+
+// Files lists the files of a named snapshot, or of the folder at the requested time.
+func (s *SnapshotStore) Files(ctx context.Context, clientId string, req share.SnapshotRequest) ([]share.SnapshotFile, error) {
+	if req.Name != "" {
+		snapshot, err := s.snapshot(clientId, req.Name)
+		return snapshot.Files, err
+	}
+	if req.At.IsZero() {
+		req.At = time.Now()
+	}
+	sources, err := s.Resolve(ctx, clientId, req.Dir, req.At)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]share.SnapshotFile, len(sources))
+	for i, source := range sources {
+		files[i] = source.SnapshotFile
+	}
+	return files, nil
+}
+
+// Key returns the storage key of a file of a named snapshot, or of the content the file had at the requested time.
+func (s *SnapshotStore) Key(ctx context.Context, clientId string, req share.SnapshotRequest) (string, error) {
+	if req.Name == "" && req.At.IsZero() {
+		return clientId + req.FilePath, nil
+	}
+	if req.Name == "" {
+		sources, err := s.Resolve(ctx, clientId, req.FilePath, req.At)
+		if err != nil {
+			return "", err
+		}
+		for _, source := range sources {
+			if source.FilePath == req.FilePath {
+				return source.key, nil
+			}
+		}
+		return "", fmt.Errorf("%s isn't retained as of %s", req.FilePath, req.At)
+	}
+	snapshot, err := s.snapshot(clientId, req.Name)
+	if err != nil {
+		return "", err
+	}
+	for _, file := range snapshot.Files {
+		if file.FilePath == req.FilePath {
+			return snapshotKey(clientId, req.Name, req.FilePath), nil
+		}
+	}
+	return "", fmt.Errorf("%s isn't part of snapshot %s", req.FilePath, req.Name)
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sync_server/share"
+	"testing"
+	"time"
+)
+
+func TestSnapshotResolve(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) time.Time { return t0.Add(d) }
+	log := func(d time.Duration, changes ...ChangeLogChanges) ChangeLog {
+		return ChangeLog{ClientId: "c", ChangeDir: "/s", Changes: changes, Time: at(d)}
+	}
+	// f is written twice and moved to h, g is removed. Every change archived the content it replaced
+	// right before it was logged.
+	logs := []ChangeLog{
+		log(time.Minute, ChangeLogChanges{FileName: "f", Change: "CREATE"}, ChangeLogChanges{FileName: "g", Change: "CREATE"}),
+		log(2*time.Minute, ChangeLogChanges{FileName: "f", Change: "WRITE"}),
+		log(3*time.Minute, ChangeLogChanges{FileName: "f", Change: "WRITE"}),
+		log(4*time.Minute, ChangeLogChanges{FileName: "g", Change: "REMOVE"}),
+		log(5*time.Minute, ChangeLogChanges{FileName: "h", Change: share.MoveChange, OldPath: "/s/f"}),
+	}
+	versions := []struct {
+		id      string
+		content string
+		time    time.Time
+	}{
+		{id: "v1", content: "f1", time: at(2*time.Minute - time.Second)},
+		{id: "v2", content: "f2", time: at(3*time.Minute - time.Second)},
+		{id: "v3", content: "f3", time: at(5*time.Minute - time.Second)},
+	}
+
+	tests := []struct {
+		name string
+		at   time.Duration
+		// versions retention took away
+		pruned []string
+		// the trash was emptied
+		purged bool
+		want   map[string]string
+	}{
+		{name: "first contents", at: 90 * time.Second, want: map[string]string{"/s/f": "f1", "/s/g": "g1"}},
+		{name: "second content", at: 150 * time.Second, want: map[string]string{"/s/f": "f2", "/s/g": "g1"}},
+		{name: "content the move archived", at: 210 * time.Second, want: map[string]string{"/s/f": "f3", "/s/g": "g1"}},
+		{name: "current contents", at: 6 * time.Minute, want: map[string]string{"/s/h": "f3"}},
+		{name: "before anything", at: 30 * time.Second, want: map[string]string{}},
+		{
+			name:   "pruned version left out rather than a later one",
+			at:     90 * time.Second,
+			pruned: []string{"v1"},
+			want:   map[string]string{"/s/g": "g1"},
+		},
+		{
+			name:   "later versions pruned too",
+			at:     150 * time.Second,
+			pruned: []string{"v1", "v2"},
+			want:   map[string]string{"/s/g": "g1"},
+		},
+		{name: "purged trash left out", at: 90 * time.Second, purged: true, want: map[string]string{"/s/f": "f1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			cfg := &share.ServerConfig{LogDir: t.TempDir()}
+			storage := newMemStorage()
+			versionStore := NewVersionStore(cfg, storage)
+			trash := NewTrashBin(cfg, storage, versionStore)
+			store := NewSnapshotStore(cfg, storage, versionStore, trash, func() (map[string][]ChangeLog, error) {
+				return map[string][]ChangeLog{"c": logs}, nil
+			})
+
+			storage.objects["c/s/h"] = []byte("f3")
+			versionStore.index.Lock()
+			versionStore.index.load()
+			for _, version := range versions {
+				if slices.Contains(tt.pruned, version.id) {
+					continue
+				}
+				storage.objects[versionKey("c/s/f", version.id)] = []byte(version.content)
+				versionStore.index.entries["c/s/f"] = append(versionStore.index.entries["c/s/f"],
+					share.FileVersion{Id: version.id, Size: int64(len(version.content)), Time: version.time})
+			}
+			versionStore.index.Unlock()
+			if !tt.purged {
+				storage.objects[trashKey("c", "t1")] = []byte("g1")
+				trash.index.Lock()
+				trash.index.load()
+				trash.index.entries["c"] = []share.TrashEntry{{Id: "t1", FilePath: "/s/g", Size: 2, Time: at(4*time.Minute - time.Second)}}
+				trash.index.Unlock()
+			}
+
+			sources, err := store.Resolve(ctx, "c", "/s", at(tt.at))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]string)
+			for _, source := range sources {
+				content, err := storage.object(source.key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got[source.FilePath] = string(content)
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("resolved %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
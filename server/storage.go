@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"slices"
+	"sync"
 )
 
 type Storage interface {
@@ -14,14 +16,15 @@ type Storage interface {
 }
 
 type ChangeStorage struct {
+	mu            sync.Mutex
 	clientChanges map[string][]ChangeLog
 }
 
-func NewChangeStorage() *ChangeStorage {
-	logs, err := LoadLogs()
+func NewChangeStorage(changeLog *ChangeLogFile) *ChangeStorage {
+	logs, err := changeLog.Load()
 	if err != nil {
 		slog.Error("Change storage load fail", "err", err.Error())
-		logs = nil
+		logs = make(map[string][]ChangeLog)
 	}
 	return &ChangeStorage{
 		clientChanges: logs,
@@ -29,21 +32,33 @@ func NewChangeStorage() *ChangeStorage {
 }
 
 func (storage *ChangeStorage) Get(key string) (interface{}, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
 	data, ok := storage.clientChanges[key]
 	if !ok {
 		return nil, fmt.Errorf("%s key not found", key)
 	}
-	return data, nil
+	return slices.Clone(data), nil
 }
 func (storage *ChangeStorage) Del(key string) error {
 	return nil
 }
+
+// Set appends a recorded change log to the changes of the account.
 func (storage *ChangeStorage) Set(key string, value interface{}) error {
+	log, ok := value.(ChangeLog)
+	if !ok {
+		return fmt.Errorf("unexpected change log %T", value)
+	}
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	storage.clientChanges[key] = append(storage.clientChanges[key], log)
 	return nil
 }
 
-func LoadLogs() (map[string][]ChangeLog, error) {
-	file, err := os.ReadFile("logs/changes.json")
+// Load reads the change logs of every account.
+func (f *ChangeLogFile) Load() (map[string][]ChangeLog, error) {
+	file, err := os.ReadFile(f.path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open log file: %w", err)
 	}
@@ -51,7 +66,8 @@ func LoadLogs() (map[string][]ChangeLog, error) {
 	err = json.Unmarshal(file, &loadedLog)
 	logs := make(map[string][]ChangeLog)
 
-	for _, log := range loadedLog {
+	for i, log := range loadedLog {
+		log.Seq = logSeq(i, log)
 		logs[log.ClientId] = append(logs[log.ClientId], log)
 	}
 	return logs, nil
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"sync_server/share"
+	"time"
+)
+
+const (
+	trashPrefix = "trash/"
+	trashFile   = "trash.json"
+	// retention when the server doesn't configure one
+	defaultTrashRetentionDays = 30
+)
+
+func trashKey(clientId string, id string) string {
+	return trashPrefix + clientId + "/" + id
+}
+
+// TrashBin keeps deleted files of an account restorable until the retention runs out.
+type TrashBin struct {
+	Cfg         *share.ServerConfig
+	fileStorage FileStorage
+	versions    *VersionStore
+	// deleted files of every account
+	index *jsonIndex[[]share.TrashEntry]
+}
+
+func NewTrashBin(cfg *share.ServerConfig, fileStorage FileStorage, versions *VersionStore) *TrashBin {
+	return &TrashBin{
+		Cfg:         cfg,
+		fileStorage: fileStorage,
+		versions:    versions,
+		index:       newJSONIndex[[]share.TrashEntry](cfg.LogPath(trashFile), "trash"),
+	}
+}
+
+func (t *TrashBin) retention() time.Duration {
+	days := t.Cfg.TrashRetentionDays
+	if days == 0 {
+		days = defaultTrashRetentionDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// Move moves the stored file into the trash, files that aren't stored are ignored.
+func (t *TrashBin) Move(ctx context.Context, clientId string, localPath string) error {
+	fileName := clientId + localPath
+	info, err := t.fileStorage.Stat(ctx, fileName)
+	if err != nil {
+		return nil
+	}
+	entry := share.TrashEntry{
+		Id:       strconv.FormatInt(time.Now().UnixNano(), 10),
+		FilePath: localPath,
+		Size:     info.Size,
+		Digest:   info.Digest,
+		Time:     time.Now(),
+	}
+	if err := t.fileStorage.CopyFile(ctx, fileName, trashKey(clientId, entry.Id)); err != nil {
+		return fmt.Errorf("failed to move %s to the trash: %w", fileName, err)
+	}
+	if err := t.fileStorage.RemoveFile(fileName); err != nil {
+		return err
+	}
+	t.index.Lock()
+	defer t.index.Unlock()
+	t.index.load()
+	t.index.entries[clientId] = append(t.index.entries[clientId], entry)
+	t.expire(ctx, clientId)
+	return t.index.save()
+}
+
+// expire purges the entries older than the retention, the index has to be locked.
+func (t *TrashBin) expire(ctx context.Context, clientId string) {
+	expiry := time.Now().Add(-t.retention())
+	t.purge(ctx, clientId, func(entry share.TrashEntry) bool {
+		return entry.Time.Before(expiry)
+	})
+}
+
+// purge removes the entries matching the filter along with their content, the index has to be locked.
+func (t *TrashBin) purge(ctx context.Context, clientId string, filter func(entry share.TrashEntry) bool) int {
+	kept := []share.TrashEntry{}
+	purged := 0
+	for _, entry := range t.index.entries[clientId] {
+		if !filter(entry) {
+			kept = append(kept, entry)
+			continue
+		}
+		if err := t.fileStorage.RemoveFile(trashKey(clientId, entry.Id)); err != nil {
+			slog.Error("Failed to purge trash entry", "client", clientId, "path", entry.FilePath, "err", err.Error())
+		}
+		purged++
+	}
+	if len(kept) == 0 {
+		delete(t.index.entries, clientId)
+	} else {
+		t.index.entries[clientId] = kept
+	}
+	return purged
+}
+
+// List returns the trash of the account, most recently deleted first.
+func (t *TrashBin) List(ctx context.Context, clientId string) ([]share.TrashEntry, error) {
+	t.index.Lock()
+	defer t.index.Unlock()
+	t.index.load()
+	t.expire(ctx, clientId)
+	if err := t.index.save(); err != nil {
+		return nil, err
+	}
+	entries := append([]share.TrashEntry{}, t.index.entries[clientId]...)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Time.After(entries[j].Time)
+	})
+	return entries, nil
+}
+
+// deleted returns the trash entries of the account.
+func (t *TrashBin) deleted(clientId string) []share.TrashEntry {
+	t.index.Lock()
+	defer t.index.Unlock()
+	t.index.load()
+	return append([]share.TrashEntry{}, t.index.entries[clientId]...)
+}
+
+// Restore puts the deleted file back at its path and takes it out of the trash,
+// a file created at the same path in the meantime is kept as a version.
+func (t *TrashBin) Restore(ctx context.Context, clientId string, id string) (share.TrashEntry, error) {
+	t.index.Lock()
+	defer t.index.Unlock()
+	t.index.load()
+	for _, entry := range t.index.entries[clientId] {
+		if entry.Id != id {
+			continue
+		}
+		if err := t.versions.Archive(ctx, clientId, clientId+entry.FilePath); err != nil {
+			slog.Error("Failed to archive file version", "path", entry.FilePath, "err", err.Error())
+		}
+		if err := t.fileStorage.CopyFile(ctx, trashKey(clientId, id), clientId+entry.FilePath); err != nil {
+			return entry, fmt.Errorf("failed to restore %s: %w", entry.FilePath, err)
+		}
+		t.purge(ctx, clientId, func(e share.TrashEntry) bool {
+			return e.Id == id
+		})
+		return entry, t.index.save()
+	}
+	return share.TrashEntry{}, fmt.Errorf("trash entry %s not found", id)
+}
+
+// Purge permanently deletes one entry, or the whole trash of the account when id is empty.
+func (t *TrashBin) Purge(ctx context.Context, clientId string, id string) (int, error) {
+	t.index.Lock()
+	defer t.index.Unlock()
+	t.index.load()
+	purged := t.purge(ctx, clientId, func(entry share.TrashEntry) bool {
+		return id == "" || entry.Id == id
+	})
+	if id != "" && purged == 0 {
+		return 0, fmt.Errorf("trash entry %s not found", id)
+	}
+	return purged, t.index.save()
+}
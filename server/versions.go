@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync_server/share"
+	"time"
+)
+
+const (
+	versionPrefix = "versions/"
+	versionsFile  = "versions.json"
+	// history kept when neither a folder nor the server configure a retention
+	defaultKeepVersions = 10
+)
+
+func versionKey(fileName string, id string) string {
+	return versionPrefix + fileName + "/" + id
+}
+
+// VersionStore keeps the previous contents of files before they are overwritten or removed.
+type VersionStore struct {
+	Cfg         *share.ServerConfig
+	fileStorage FileStorage
+	// stored versions of every file, oldest first
+	index *jsonIndex[[]share.FileVersion]
+}
+
+func NewVersionStore(cfg *share.ServerConfig, fileStorage FileStorage) *VersionStore {
+	return &VersionStore{
+		Cfg:         cfg,
+		fileStorage: fileStorage,
+		index:       newJSONIndex[[]share.FileVersion](cfg.LogPath(versionsFile), "file versions"),
+	}
+}
+
+// retention returns the retention of the most specific configured folder that contains the local path.
+func (v *VersionStore) retention(localPath string) share.VersionRetention {
+	retention := v.Cfg.Versioning.VersionRetention
+	matched := ""
+	for _, folder := range v.Cfg.Versioning.Folders {
+		path := strings.TrimSuffix(folder.Path, "/")
+		if (localPath == path || strings.HasPrefix(localPath, path+"/")) && len(path) > len(matched) {
+			matched = path
+			retention = folder.VersionRetention
+		}
+	}
+	if retention.KeepVersions == 0 && retention.KeepDays == 0 {
+		retention.KeepVersions = defaultKeepVersions
+	}
+	return retention
+}
+
+// Archive stores the current content of fileName as a version, nothing is stored if there is no current content
+// or if it's already the latest version.
+func (v *VersionStore) Archive(ctx context.Context, clientId string, fileName string) error {
+	return v.archive(ctx, clientId, fileName, "")
+}
+
+func (v *VersionStore) archive(ctx context.Context, clientId string, fileName string, keep string) error {
+	info, err := v.fileStorage.Stat(ctx, fileName)
+	if err != nil {
+		return nil
+	}
+	v.index.Lock()
+	defer v.index.Unlock()
+	v.index.load()
+	versions := v.index.entries[fileName]
+	if n := len(versions); n > 0 && info.Digest != "" && versions[n-1].Digest == info.Digest {
+		return nil
+	}
+	version := share.FileVersion{
+		Id:     strconv.FormatInt(time.Now().UnixNano(), 10),
+		Size:   info.Size,
+		Digest: info.Digest,
+		Time:   time.Now(),
+	}
+	if err := v.fileStorage.CopyFile(ctx, fileName, versionKey(fileName, version.Id)); err != nil {
+		return fmt.Errorf("failed to archive %s: %w", fileName, err)
+	}
+	v.index.entries[fileName] = append(versions, version)
+	v.prune(ctx, clientId, fileName, keep)
+	return v.index.save()
+}
+
+// prune removes the versions the retention of the file's folder doesn't keep anymore except keep,
+// the index has to be locked.
+func (v *VersionStore) prune(ctx context.Context, clientId string, fileName string, keep string) {
+	retention := v.retention(strings.TrimPrefix(fileName, clientId))
+	versions := v.index.entries[fileName]
+	expiry := time.Now().AddDate(0, 0, -retention.KeepDays)
+	kept := []share.FileVersion{}
+	for i, version := range versions {
+		newer := len(versions) - 1 - i
+		expired := retention.KeepVersions > 0 && newer >= retention.KeepVersions || retention.KeepDays > 0 && version.Time.Before(expiry)
+		if expired && version.Id != keep {
+			if err := v.fileStorage.RemoveFile(versionKey(fileName, version.Id)); err != nil {
+				slog.Error("Failed to remove version", "filename", fileName, "version", version.Id, "err", err.Error())
+			}
+			continue
+		}
+		kept = append(kept, version)
+	}
+	if len(kept) == 0 {
+		delete(v.index.entries, fileName)
+		return
+	}
+	v.index.entries[fileName] = kept
+}
+
+// List returns the versions of fileName, newest first.
+func (v *VersionStore) List(ctx context.Context, clientId string, fileName string) ([]share.FileVersion, error) {
+	v.index.Lock()
+	defer v.index.Unlock()
+	v.index.load()
+	v.prune(ctx, clientId, fileName, "")
+	if err := v.index.save(); err != nil {
+		return nil, err
+	}
+	versions := append([]share.FileVersion{}, v.index.entries[fileName]...)
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Time.After(versions[j].Time)
+	})
+	return versions, nil
+}
+
+// history returns the versions of fileName, oldest first.
+func (v *VersionStore) history(fileName string) []share.FileVersion {
+	v.index.Lock()
+	defer v.index.Unlock()
+	v.index.load()
+	return append([]share.FileVersion{}, v.index.entries[fileName]...)
+}
+
+// Key returns the storage key of a version of fileName.
+func (v *VersionStore) Key(fileName string, id string) (string, error) {
+	v.index.Lock()
+	defer v.index.Unlock()
+	v.index.load()
+	for _, version := range v.index.entries[fileName] {
+		if version.Id == id {
+			return versionKey(fileName, id), nil
+		}
+	}
+	return "", fmt.Errorf("version %s of %s not found", id, fileName)
+}
+
+// Restore makes a version the current content of fileName, the content it replaces is archived first
+// without letting the retention drop the version being restored.
+func (v *VersionStore) Restore(ctx context.Context, clientId string, fileName string, id string) error {
+	key, err := v.Key(fileName, id)
+	if err != nil {
+		return err
+	}
+	if err := v.archive(ctx, clientId, fileName, id); err != nil {
+		return err
+	}
+	return v.fileStorage.CopyFile(ctx, key, fileName)
+}
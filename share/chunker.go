@@ -0,0 +1,135 @@
+package share
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+)
+
+// FastCDC parameters, chunks average 64KB and always fit in a single nats message
+const (
+	MinChunkSize = 16 * 1024
+	AvgChunkSize = 64 * 1024
+	MaxChunkSize = 256 * 1024
+
+	// a harder mask before the average size and an easier one after it keeps chunk sizes close to the average
+	chunkMaskS uint64 = ((1 << 18) - 1) << (64 - 18)
+	chunkMaskL uint64 = ((1 << 14) - 1) << (64 - 14)
+)
+
+type ChunkRef struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// Manifest lists the chunks a file is made of, in order.
+type Manifest struct {
+	Size   int64      `json:"size"`
+	Digest string     `json:"digest"`
+	Chunks []ChunkRef `json:"chunks"`
+}
+
+// gear is the random table of the gear rolling hash, it has to be the same on every client and server
+var gear = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x5379_6e63_6865_7221)
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+type Chunker struct {
+	r     io.Reader
+	buf   []byte
+	start int
+	end   int
+	eof   bool
+}
+
+func NewChunker(r io.Reader) *Chunker {
+	return &Chunker{r: r, buf: make([]byte, 2*MaxChunkSize)}
+}
+
+// Next returns the next content defined chunk, the slice is only valid until the following call.
+func (c *Chunker) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	n := cutPoint(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+func (c *Chunker) fill() error {
+	if c.eof || c.end-c.start >= MaxChunkSize {
+		return nil
+	}
+	c.end = copy(c.buf, c.buf[c.start:c.end])
+	c.start = 0
+	n, err := io.ReadFull(c.r, c.buf[c.end:])
+	c.end += n
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		c.eof = true
+		return nil
+	}
+	return err
+}
+
+func cutPoint(data []byte) int {
+	n := len(data)
+	if n <= MinChunkSize {
+		return n
+	}
+	n = min(n, MaxChunkSize)
+	normal := min(n, AvgChunkSize)
+	var fp uint64
+	i := MinChunkSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&chunkMaskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&chunkMaskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+func ChunkHash(chunk []byte) string {
+	sum := sha256.Sum256(chunk)
+	return hex.EncodeToString(sum[:])
+}
+
+// BuildManifest chunks the content of r and hashes it as a whole.
+func BuildManifest(r io.Reader) (Manifest, error) {
+	h := sha256.New()
+	chunker := NewChunker(io.TeeReader(r, h))
+	manifest := Manifest{Chunks: []ChunkRef{}}
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return manifest, err
+		}
+		manifest.Chunks = append(manifest.Chunks, ChunkRef{Hash: ChunkHash(chunk), Size: int64(len(chunk))})
+		manifest.Size += int64(len(chunk))
+	}
+	manifest.Digest = hex.EncodeToString(h.Sum(nil))
+	return manifest, nil
+}
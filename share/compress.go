@@ -0,0 +1,136 @@
+package share
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const ZstdCompression = "zstd"
+
+const (
+	// how much of the content is compressed up front to decide whether compressing the rest is worth it
+	CompressionSampleSize = 64 * 1024
+	// content that doesn't shrink below this ratio is most likely already compressed (jpg, zip, mp4...)
+	minCompressionRatio = 0.9
+)
+
+var sampleEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+
+// Compressible compresses a sample of the content and tells whether it shrinks enough to be worth compressing.
+func Compressible(sample []byte) bool {
+	if len(sample) == 0 {
+		return false
+	}
+	compressed := sampleEncoder.EncodeAll(sample, make([]byte, 0, len(sample)))
+	return float64(len(compressed)) < float64(len(sample))*minCompressionRatio
+}
+
+func CompressBytes(data []byte) []byte {
+	return sampleEncoder.EncodeAll(data, make([]byte, 0, len(data)))
+}
+
+// DecompressBytes refuses content that decompresses to more than maxSize bytes, so a small message
+// can't expand into an unbounded amount of memory.
+func DecompressBytes(data []byte, maxSize int) ([]byte, error) {
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(maxSize)))
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+	return dec.DecodeAll(data, nil)
+}
+
+// NewCompressReader returns the zstd compressed content of r as it is being read.
+func NewCompressReader(r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		enc, err := zstd.NewWriter(pw, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(enc, r); err != nil {
+			enc.Close()
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(enc.Close())
+	}()
+	return pr
+}
+
+// NewDecompressReader decompresses r on demand. The decoder reads r ahead of what it returned,
+// so nothing may follow the compressed content on r.
+func NewDecompressReader(r io.Reader) (io.ReadCloser, error) {
+	dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return dec.IOReadCloser(), nil
+}
+
+// NewDecompressWriter decompresses what is written to it into w. Once the writer is closed,
+// wait returns the result of the decompression.
+func NewDecompressWriter(w io.Writer) (io.WriteCloser, func() error) {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		dec, err := NewDecompressReader(pr)
+		if err == nil {
+			_, err = io.Copy(w, dec)
+			dec.Close()
+		}
+		pr.CloseWithError(err)
+		done <- err
+	}()
+	return pw, func() error { return <-done }
+}
+
+// CompressSource samples r and compresses it when that's worth it, it tells whether the returned content is compressed.
+func CompressSource(r io.Reader) (io.ReadCloser, bool) {
+	sampled := bufio.NewReaderSize(r, CompressionSampleSize)
+	// peeking doesn't consume the sample, it's still sent as part of the content
+	sample, err := sampled.Peek(CompressionSampleSize)
+	if err != nil && err != io.EOF || !Compressible(sample) {
+		return io.NopCloser(sampled), false
+	}
+	return NewCompressReader(sampled), true
+}
+
+// WriteContent copies the content to a tcp transfer, once compression was negotiated
+// it's preceded by a flag telling whether the content actually is compressed.
+func WriteContent(w io.Writer, content io.Reader, compress bool) error {
+	if !compress {
+		_, err := io.Copy(w, content)
+		return err
+	}
+	source, compressed := CompressSource(content)
+	defer source.Close()
+	flag := UncompressedContent
+	if compressed {
+		flag = ZstdContent
+	}
+	if err := binary.Write(w, binary.BigEndian, flag); err != nil {
+		return err
+	}
+	_, err := io.Copy(w, source)
+	return err
+}
+
+// ReadContent reads the content written by WriteContent.
+func ReadContent(r io.Reader, compress bool) (io.ReadCloser, error) {
+	if !compress {
+		return io.NopCloser(r), nil
+	}
+	var flag byte
+	if err := binary.Read(r, binary.BigEndian, &flag); err != nil {
+		return nil, err
+	}
+	if flag == ZstdContent {
+		return NewDecompressReader(r)
+	}
+	return io.NopCloser(r), nil
+}
@@ -3,6 +3,7 @@ package share
 import (
 	"errors"
 	"log"
+	"path/filepath"
 
 	"github.com/spf13/viper"
 )
@@ -13,17 +14,89 @@ type MinIO struct {
 	SecretAccessKey string `mapstructure:"MINIO_SECRET_ACCESS`
 	UseSSL          bool   `mapstructure:"MINIO_USE_SSL"`
 }
+
+// files are stored as deduplicated chunks instead of whole objects
+const ChunkedStorage = "chunked"
+
 type ServerConfig struct {
-	NatsUrl  string `mapstructure:"NATS_URL"`
+	NatsUrl        string       `mapstructure:"NATS_URL"`
+	TransferMode   TransferMode `mapstructure:"TRANSFER_MODE"`
+	AdvertiseHosts []string     `mapstructure:"ADVERTISE_HOSTS"`
+	Storage        string       `mapstructure:"STORAGE"`
+	// compress transfers with clients that ask for it
+	Compression bool `mapstructure:"COMPRESSION"`
+	// keep compressible objects compressed in the storage
+	CompressStorage bool       `mapstructure:"COMPRESS_STORAGE"`
+	Versioning      Versioning `mapstructure:"VERSIONING"`
+	// deleted files stay restorable for this many days
+	TrashRetentionDays int `mapstructure:"TRASH_RETENTION_DAYS"`
+	// folder the server keeps its change log and registries in, logs when not set
+	LogDir   string `mapstructure:"LOG_DIR"`
 	ServerId string
 	MinIO
 }
+
+// LogPath returns the path of a file kept in the log folder.
+func (c *ServerConfig) LogPath(name string) string {
+	dir := c.LogDir
+	if dir == "" {
+		dir = "logs"
+	}
+	return filepath.Join(dir, name)
+}
+
+// VersionRetention limits the history kept per file, a zero limit doesn't apply.
+type VersionRetention struct {
+	KeepVersions int `mapstructure:"KEEP_VERSIONS"`
+	KeepDays     int `mapstructure:"KEEP_DAYS"`
+}
+
+type FolderVersioning struct {
+	// sync folder of the client the retention applies to
+	Path             string `mapstructure:"PATH"`
+	VersionRetention `mapstructure:",squash"`
+}
+
+type Versioning struct {
+	VersionRetention `mapstructure:",squash"`
+	Folders          []FolderVersioning `mapstructure:"FOLDERS"`
+}
 type ClientConfig struct {
-	NatsUrl      string `mapstructure:"NATS_URL"`
-	ClientId     string `mapstructure:"CLIENT_ID"`
-	HttpPort     string   `mapstructure:"HTTP_PORT"`
-	SyncDirs     []string `mapstructure:"SYNC_DIRS"`
-	SyncInterval int      `mapstructure:"SYNC_INTERVAL"`
+	NatsUrl      string       `mapstructure:"NATS_URL"`
+	ClientId     string       `mapstructure:"CLIENT_ID"`
+	DeviceId     string       `mapstructure:"DEVICE_ID"`
+	HttpPort     string       `mapstructure:"HTTP_PORT"`
+	SyncDirs     []string     `mapstructure:"SYNC_DIRS"`
+	SyncInterval int          `mapstructure:"SYNC_INTERVAL"`
+	TransferMode TransferMode `mapstructure:"TRANSFER_MODE"`
+	Compression  bool         `mapstructure:"COMPRESSION"`
+	// remote paths this device doesn't download, its own changes elsewhere are still uploaded
+	SyncExclude []string `mapstructure:"SYNC_EXCLUDE"`
+	// gitignore style patterns applied to every sync folder on top of its .syncignore files
+	IgnorePatterns []string `mapstructure:"IGNORE_PATTERNS"`
+	// keep, follow or skip symlinks pointing outside the sync folders, skipped by default
+	SymlinkPolicy string `mapstructure:"SYMLINK_POLICY"`
+	// milliseconds a file's size and modification time have to stay the same before it's uploaded
+	QuietPeriod int `mapstructure:"QUIET_PERIOD"`
+	// transfers running at once
+	TransferConcurrency int `mapstructure:"TRANSFER_CONCURRENCY"`
+	BandwidthLimit      `mapstructure:",squash"`
+	// limits replacing the ones above at certain times of the day
+	SyncWindows []SyncWindow `mapstructure:"SYNC_WINDOWS"`
+}
+
+// BandwidthLimit caps the transfers of the client in KiB per second, a zero limit doesn't apply.
+type BandwidthLimit struct {
+	UploadLimit   int `mapstructure:"UPLOAD_LIMIT" json:"upload_limit"`
+	DownloadLimit int `mapstructure:"DOWNLOAD_LIMIT" json:"download_limit"`
+}
+
+// SyncWindow applies its limits from Start to End, both "15:04" in local time. A window ending before it
+// starts runs past midnight.
+type SyncWindow struct {
+	Start          string `mapstructure:"START" json:"start"`
+	End            string `mapstructure:"END" json:"end"`
+	BandwidthLimit `mapstructure:",squash"`
 }
 
 func GetServerConfig() (*ServerConfig, error) {
@@ -59,6 +132,12 @@ func GetClientConfig() (*ClientConfig, error) {
 func WriteClientConfig() {
 	clientViper.WriteConfig()
 }
+
+// SetClientConfig changes a single client setting and writes it to client.yaml.
+func SetClientConfig(key string, value any) error {
+	clientViper.Set(key, value)
+	return clientViper.WriteConfig()
+}
 func InitConfig(name string) (*viper.Viper, error) {
 	v := viper.New()
 	v.SetConfigType("yml")
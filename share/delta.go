@@ -0,0 +1,292 @@
+package share
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// files smaller than this are always transferred whole, the signature round trip isn't worth it
+const DeltaMinSize = 1024 * 1024
+
+const (
+	minDeltaBlockSize = 4 * 1024
+	maxDeltaBlocks    = 8192
+)
+
+const (
+	deltaCopy    byte = 'C'
+	deltaLiteral byte = 'L'
+	deltaEnd     byte = 'E'
+)
+
+type BlockSignature struct {
+	Weak   uint32 `json:"w"`
+	Strong string `json:"s"`
+}
+
+// Signature describes the blocks of the version the receiver already has, block i starts at i*BlockSize.
+type Signature struct {
+	BlockSize int              `json:"block_size"`
+	Blocks    []BlockSignature `json:"blocks"`
+}
+
+type SignatureRequest struct {
+	ClientRequest
+	FilePath string
+}
+
+// DeltaBlockSize keeps the signature of a file of the given size small enough for a single nats message.
+func DeltaBlockSize(size int64) int {
+	blockSize := int64(minDeltaBlockSize)
+	for (size+blockSize-1)/blockSize > maxDeltaBlocks {
+		blockSize *= 2
+	}
+	return int(blockSize)
+}
+
+func ComputeSignature(r io.Reader, blockSize int) (Signature, error) {
+	sig := Signature{BlockSize: blockSize}
+	block := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, block)
+		if n > 0 {
+			sig.Blocks = append(sig.Blocks, BlockSignature{
+				Weak:   weakSum(block[:n]),
+				Strong: strongSum(block[:n]),
+			})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		}
+		if err != nil {
+			return sig, err
+		}
+	}
+}
+
+func FileSignature(file string, blockSize int) (Signature, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return Signature{}, err
+	}
+	defer f.Close()
+	return ComputeSignature(f, blockSize)
+}
+
+// WriteDelta writes the instructions to rebuild the content of r out of the blocks described by sig.
+// Memory use is bounded by a couple of blocks no matter how big the content is.
+func WriteDelta(w io.Writer, sig Signature, r io.Reader) error {
+	blockSize := sig.BlockSize
+	if blockSize <= 0 {
+		return fmt.Errorf("invalid block size %d", blockSize)
+	}
+	index := make(map[uint32][]int, len(sig.Blocks))
+	for i, block := range sig.Blocks {
+		index[block.Weak] = append(index[block.Weak], i)
+	}
+	bw := bufio.NewWriter(w)
+	br := bufio.NewReader(r)
+	buf := make([]byte, 2*blockSize)
+	start, end := 0, 0
+	literal := make([]byte, 0, blockSize)
+
+	flushLiteral := func() error {
+		if len(literal) == 0 {
+			return nil
+		}
+		if err := writeLiteral(bw, literal); err != nil {
+			return err
+		}
+		literal = literal[:0]
+		return nil
+	}
+	fill := func() error {
+		if start > 0 {
+			end = copy(buf, buf[start:end])
+			start = 0
+		}
+		n, err := io.ReadFull(br, buf[end:blockSize])
+		end += n
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		return err
+	}
+
+	if err := fill(); err != nil {
+		return err
+	}
+	a, b := rollingSums(buf[start:end])
+	eof := end-start < blockSize
+	for end > start {
+		window := buf[start:end]
+		if match, ok := findBlock(sig, index, a|b<<16, window, blockSize); ok {
+			if err := flushLiteral(); err != nil {
+				return err
+			}
+			if err := writeCopy(bw, match); err != nil {
+				return err
+			}
+			start = end
+			if err := fill(); err != nil {
+				return err
+			}
+			a, b = rollingSums(buf[start:end])
+			eof = end-start < blockSize
+			continue
+		}
+
+		out := buf[start]
+		literal = append(literal, out)
+		if len(literal) == blockSize {
+			if err := flushLiteral(); err != nil {
+				return err
+			}
+		}
+		n := uint32(end - start)
+		start++
+		a -= uint32(out)
+		b -= n * uint32(out)
+		if !eof {
+			c, err := br.ReadByte()
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			} else {
+				if end == len(buf) {
+					end = copy(buf, buf[start:end])
+					start = 0
+				}
+				buf[end] = c
+				end++
+				a += uint32(c)
+				b += a
+			}
+		}
+		a &= 0xffff
+		b &= 0xffff
+	}
+	if err := flushLiteral(); err != nil {
+		return err
+	}
+	if err := bw.WriteByte(deltaEnd); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// ApplyDelta rebuilds the new content out of base and the delta written by WriteDelta.
+func ApplyDelta(w io.Writer, base io.ReaderAt, blockSize int, delta io.Reader) error {
+	br := bufio.NewReader(delta)
+	block := make([]byte, blockSize)
+	for {
+		op, err := br.ReadByte()
+		if err != nil {
+			return fmt.Errorf("reading delta: %w", err)
+		}
+		switch op {
+		case deltaEnd:
+			return nil
+		case deltaCopy:
+			var idx uint32
+			if err := binary.Read(br, binary.BigEndian, &idx); err != nil {
+				return fmt.Errorf("reading delta: %w", err)
+			}
+			n, err := base.ReadAt(block, int64(idx)*int64(blockSize))
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if n == 0 {
+				return fmt.Errorf("block %d is out of range", idx)
+			}
+			if _, err := w.Write(block[:n]); err != nil {
+				return err
+			}
+		case deltaLiteral:
+			var length uint32
+			if err := binary.Read(br, binary.BigEndian, &length); err != nil {
+				return fmt.Errorf("reading delta: %w", err)
+			}
+			if _, err := io.CopyN(w, br, int64(length)); err != nil {
+				return fmt.Errorf("reading delta: %w", err)
+			}
+		default:
+			return fmt.Errorf("unknown delta op %q", op)
+		}
+	}
+}
+
+// NewDeltaReader returns the content rebuilt out of base and delta as it is being read.
+func NewDeltaReader(base io.ReaderAt, blockSize int, delta io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(ApplyDelta(pw, base, blockSize, delta))
+	}()
+	return pr
+}
+
+// findBlock looks up the window in the signature, a window shorter than a block can only be the last block.
+func findBlock(sig Signature, index map[uint32][]int, weak uint32, window []byte, blockSize int) (int, bool) {
+	candidates, ok := index[weak]
+	if !ok {
+		return 0, false
+	}
+	var strong string
+	for _, i := range candidates {
+		if len(window) != blockSize && i != len(sig.Blocks)-1 {
+			continue
+		}
+		if strong == "" {
+			strong = strongSum(window)
+		}
+		if sig.Blocks[i].Strong == strong {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func writeCopy(w *bufio.Writer, idx int) error {
+	if err := w.WriteByte(deltaCopy); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, uint32(idx))
+}
+
+func writeLiteral(w *bufio.Writer, data []byte) error {
+	if err := w.WriteByte(deltaLiteral); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// rollingSums is the rsync weak checksum, split in its two 16 bit halves so it can be rolled byte by byte.
+func rollingSums(data []byte) (uint32, uint32) {
+	var a, b uint32
+	n := uint32(len(data))
+	for i, c := range data {
+		a += uint32(c)
+		b += (n - uint32(i)) * uint32(c)
+	}
+	return a & 0xffff, b & 0xffff
+}
+
+func weakSum(data []byte) uint32 {
+	a, b := rollingSums(data)
+	return a | b<<16
+}
+
+func strongSum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,122 @@
+package share
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func randomBytes(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	base := randomBytes(1, 4096)
+	tests := []struct {
+		name   string
+		base   []byte
+		target []byte
+		// most literal bytes the delta may carry
+		maxLiteral int
+	}{
+		{"identical", base, base, 0},
+		{"empty base", nil, base, len(base)},
+		{"empty target", base, nil, 0},
+		{"appended", base, concat(base, []byte("tail")), 4},
+		{"prepended", base, concat([]byte("head"), base), 4},
+		{"inserted in the middle", base, concat(base[:2000], []byte("inserted"), base[2000:]), 8 + 2*64},
+		{"byte changed", base, concat(base[:1000], []byte{base[1000] + 1}, base[1001:]), 64},
+		{"removed block", base, concat(base[:1024], base[1088:]), 64},
+		{"blocks reordered", base, concat(base[2048:], base[:2048]), 0},
+		{"partial last block", base[:4000], base[:4000], 0},
+		{"unrelated", base, randomBytes(2, 4096), 4096},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const blockSize = 64
+			sig, err := ComputeSignature(bytes.NewReader(tt.base), blockSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var delta bytes.Buffer
+			if err := WriteDelta(&delta, sig, bytes.NewReader(tt.target)); err != nil {
+				t.Fatal(err)
+			}
+			literal := literalBytes(t, delta.Bytes())
+			if literal > tt.maxLiteral {
+				t.Errorf("delta carries %d literal bytes, want at most %d", literal, tt.maxLiteral)
+			}
+			var out bytes.Buffer
+			if err := ApplyDelta(&out, bytes.NewReader(tt.base), blockSize, &delta); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), tt.target) {
+				t.Errorf("applied delta differs from the target: got %d bytes, want %d", out.Len(), len(tt.target))
+			}
+		})
+	}
+}
+
+// literalBytes sums the literal instructions of a delta.
+func literalBytes(t *testing.T, delta []byte) int {
+	total := 0
+	for i := 0; i < len(delta); {
+		switch delta[i] {
+		case deltaCopy:
+			i += 5
+		case deltaLiteral:
+			n := int(delta[i+1])<<24 | int(delta[i+2])<<16 | int(delta[i+3])<<8 | int(delta[i+4])
+			total += n
+			i += 5 + n
+		case deltaEnd:
+			return total
+		default:
+			t.Fatalf("unknown delta instruction %q at %d", delta[i], i)
+		}
+	}
+	return total
+}
+
+func TestDeltaInvalidBlockSize(t *testing.T) {
+	if err := WriteDelta(&bytes.Buffer{}, Signature{}, bytes.NewReader([]byte("data"))); err == nil {
+		t.Error("expected an error for a zero block size")
+	}
+}
+
+func TestDeltaBlockSize(t *testing.T) {
+	tests := []struct {
+		size int64
+		want int
+	}{
+		{0, minDeltaBlockSize},
+		{DeltaMinSize, minDeltaBlockSize},
+		{minDeltaBlockSize * maxDeltaBlocks, minDeltaBlockSize},
+		{minDeltaBlockSize*maxDeltaBlocks + 1, 2 * minDeltaBlockSize},
+		{1 << 30, 1 << 30 / maxDeltaBlocks},
+	}
+	for _, tt := range tests {
+		if got := DeltaBlockSize(tt.size); got != tt.want {
+			t.Errorf("DeltaBlockSize(%d) = %d, want %d", tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestWeakSumRolls(t *testing.T) {
+	data := randomBytes(3, 256)
+	const window = 32
+	a, b := rollingSums(data[:window])
+	for i := 1; i+window <= len(data); i++ {
+		out, in := uint32(data[i-1]), uint32(data[i+window-1])
+		a = (a - out + in) & 0xffff
+		b = (b - window*out + a) & 0xffff
+		if want := weakSum(data[i : i+window]); a|b<<16 != want {
+			t.Fatalf("rolled sum at %d = %x, want %x", i, a|b<<16, want)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package share
+
+import "time"
+
+// MetadataChange only changes the metadata of a file, its content stays as it is.
+const MetadataChange = "ATTRIB"
+
+// what happens to symlinks pointing outside the sync folders, links inside them are always synced as links
+const (
+	// the link is synced as is, it may dangle on other devices
+	SymlinkKeep = "keep"
+	// the content the link points to is synced as a regular file
+	SymlinkFollow = "follow"
+	// the link isn't synced at all
+	SymlinkSkip = "skip"
+)
+
+// FileMetadata is what a change carries besides the content of the file.
+type FileMetadata struct {
+	// permission bits
+	Mode    uint32    `json:"mode,omitempty"`
+	ModTime time.Time `json:"mod_time"`
+	// size of the content, lets small files be transferred first
+	Size int64 `json:"size,omitempty"`
+	// the target of a symlink, the link is synced instead of what it points to
+	LinkTarget string `json:"link_target,omitempty"`
+}
+
+// Equal tells whether applying other would change nothing.
+func (m *FileMetadata) Equal(other *FileMetadata) bool {
+	if m == nil || other == nil {
+		return m == other
+	}
+	return m.Mode == other.Mode && m.ModTime.Equal(other.ModTime) && m.LinkTarget == other.LinkTarget
+}
@@ -31,6 +31,30 @@ func (nc *NatsConn) SubscribeToSubject(sbj string) (*nats.Subscription, error) {
 	return sub, nil
 }
 
+// SubscribeBroadcast subscribes outside the queue group, every server gets the messages of the subject.
+func (nc *NatsConn) SubscribeBroadcast(sbj string) (*nats.Subscription, error) {
+	sub, err := nc.conn.SubscribeSync(sbj)
+	if err != nil {
+		slog.Error("NatsConn SubscribeBroadcast", "err", err.Error())
+		return nil, err
+	}
+	return sub, nil
+}
+
+func (nc *NatsConn) Subscribe(sbj string, handler nats.MsgHandler) (*nats.Subscription, error) {
+	sub, err := nc.conn.Subscribe(sbj, handler)
+	if err != nil {
+		slog.Error("NatsConn Subscribe", "err", err.Error())
+		return nil, err
+	}
+	return sub, nil
+}
+
+// OnReconnect runs handler every time the connection comes back after being lost.
+func (nc *NatsConn) OnReconnect(handler func()) {
+	nc.conn.SetReconnectHandler(func(*nats.Conn) { handler() })
+}
+
 func (nc *NatsConn) PublishToSubject(sbj string, data []byte) error {
 	err := nc.conn.Publish(sbj, data)
 	if err != nil {
@@ -49,6 +73,40 @@ func (nc *NatsConn) RequestToSubject(sbj string, data []byte, timeout time.Durat
 	return msg, nil
 }
 
+func (nc *NatsConn) RequestMsg(msg *nats.Msg, timeout time.Duration) (*nats.Msg, error) {
+	resp, err := nc.conn.RequestMsg(msg, timeout)
+	if err != nil {
+		slog.Error("NatsConn RequestMsg", "err", err.Error())
+		return nil, err
+	}
+	return resp, nil
+}
+
+// RequestAll sends a request every subscriber of the subject answers and collects the replies that arrive before the timeout.
+func (nc *NatsConn) RequestAll(sbj string, data []byte, timeout time.Duration) ([]*nats.Msg, error) {
+	inbox := nc.conn.NewRespInbox()
+	sub, err := nc.conn.SubscribeSync(inbox)
+	if err != nil {
+		slog.Error("NatsConn RequestAll", "err", err.Error())
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+	if err := nc.conn.PublishRequest(sbj, inbox, data); err != nil {
+		slog.Error("NatsConn RequestAll", "err", err.Error())
+		return nil, err
+	}
+	replies := []*nats.Msg{}
+	deadline := time.Now().Add(timeout)
+	for {
+		msg, err := sub.NextMsg(time.Until(deadline))
+		if err != nil {
+			// the timeout ends the collection, whatever arrived is all there is
+			return replies, nil
+		}
+		replies = append(replies, msg)
+	}
+}
+
 func (nc *NatsConn) Close() error {
 	// TODO: we should apply graceful shutdown
 	nc.conn.Close()
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
+	"slices"
 )
 
 func getOutboundInterface() (string, string, error) {
@@ -44,3 +45,39 @@ func GetIPv4() (string, error) {
 	}
 	return ip, err
 }
+
+// GetHostAddrs lists the unicast addresses of every interface that is up, IPv4 and IPv6,
+// with the address of the outbound interface first.
+func GetHostAddrs() ([]string, error) {
+	var hosts []string
+	if ip, err := GetIPv4(); err == nil {
+		hosts = append(hosts, ip)
+	}
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return hosts, err
+	}
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || !ipNet.IP.IsGlobalUnicast() {
+				continue
+			}
+			ip := ipNet.IP.String()
+			if !slices.Contains(hosts, ip) {
+				hosts = append(hosts, ip)
+			}
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no reachable address found")
+	}
+	return hosts, nil
+}
@@ -0,0 +1,28 @@
+package share
+
+import "time"
+
+type SnapshotFile struct {
+	FilePath string `json:"file_path"`
+	Size     int64  `json:"size"`
+	Digest   string `json:"digest"`
+}
+
+// Snapshot is the state of a sync folder at a point in time, its files are kept as long as the snapshot exists.
+type Snapshot struct {
+	Name      string         `json:"name"`
+	Dir       string         `json:"dir"`
+	At        time.Time      `json:"at"`
+	Created   time.Time      `json:"created"`
+	FileCount int            `json:"file_count"`
+	Files     []SnapshotFile `json:"files,omitempty"`
+}
+
+// SnapshotRequest addresses a named snapshot, or the state of Dir at At when Name is empty.
+type SnapshotRequest struct {
+	ClientRequest
+	Name     string    `json:",omitempty"`
+	Dir      string    `json:",omitempty"`
+	At       time.Time `json:",omitempty"`
+	FilePath string    `json:",omitempty"`
+}
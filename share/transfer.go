@@ -0,0 +1,86 @@
+package share
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+type TransferMode string
+
+const (
+	TcpTransfer  TransferMode = "tcp"
+	NatsTransfer TransferMode = "nats"
+	// only the chunks the server doesn't have yet are sent over nats, needs a chunked server storage
+	ChunkTransfer TransferMode = "chunks"
+)
+
+// chunks are kept well below the default nats max_payload of 1MB
+const TransferChunkSize = 512 * 1024
+
+const (
+	TransferSeqHeader    = "Transfer-Seq"
+	TransferSizeHeader   = "Transfer-Size"
+	TransferOffsetHeader = "Transfer-Offset"
+	TransferDigestHeader = "Transfer-Digest"
+	TransferEOFHeader    = "Transfer-EOF"
+	TransferErrorHeader  = "Transfer-Error"
+	TransferOpHeader     = "Transfer-Op"
+	TransferChunkHeader  = "Transfer-Chunk"
+	// set when the data of the transfer is compressed, its value is the compression
+	TransferCompressionHeader = "Transfer-Compression"
+)
+
+// operations of a chunk transfer
+const (
+	ChunkOpMissing = "missing"
+	ChunkOpPut     = "chunk"
+	ChunkOpCommit  = "commit"
+)
+
+// tcp transfers that negotiated compression send one of these before the content
+const (
+	UncompressedContent byte = 0
+	ZstdContent         byte = 1
+)
+
+// status byte the tcp receiver answers with once the upload is stored and verified
+const (
+	TransferOk     byte = 0
+	TransferFailed byte = 1
+)
+
+// downloads are written to this file next to the target until they are complete, so they can be resumed
+const PartialSuffix = ".partial"
+
+type TransferInfo struct {
+	Mode    TransferMode
+	Hosts   []string `json:",omitempty"`
+	Port    int      `json:",omitempty"`
+	Subject string   `json:",omitempty"`
+	// the content is sent as a delta against the version the receiver already has
+	Delta bool `json:",omitempty"`
+	// both sides accept compressed data, the sender still only compresses what actually shrinks
+	Compression string `json:",omitempty"`
+}
+
+func ResolveTransferMode(mode TransferMode) TransferMode {
+	switch mode {
+	case NatsTransfer, ChunkTransfer:
+		return mode
+	}
+	return TcpTransfer
+}
+
+// EncodeDigest turns a hex sha256 into the fixed size form used by the tcp protocol, an unknown digest is all zeros.
+func EncodeDigest(digest string) [sha256.Size]byte {
+	var raw [sha256.Size]byte
+	hex.Decode(raw[:], []byte(digest))
+	return raw
+}
+
+func DecodeDigest(raw [sha256.Size]byte) string {
+	if raw == [sha256.Size]byte{} {
+		return ""
+	}
+	return hex.EncodeToString(raw[:])
+}
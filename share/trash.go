@@ -0,0 +1,21 @@
+package share
+
+import "time"
+
+type TrashEntry struct {
+	Id string `json:"id"`
+	// local path the file had on the client that deleted it
+	FilePath string    `json:"file_path"`
+	Size     int64     `json:"size"`
+	Digest   string    `json:"digest"`
+	Time     time.Time `json:"time"`
+}
+
+// TrashRequest addresses one entry of the account's trash, an empty Id purges the whole trash.
+type TrashRequest struct {
+	ClientRequest
+	Id string `json:",omitempty"`
+}
+
+// changes recorded by the server itself are applied by every device, including the one that asked for them
+const ServerAgent = "server"
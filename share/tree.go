@@ -0,0 +1,23 @@
+package share
+
+import "time"
+
+// FileEntry is the current state of a synced file or folder as the server knows it.
+type FileEntry struct {
+	Path       string        `json:"path"`
+	Size       int64         `json:"size"`
+	Hash       string        `json:"hash"`
+	Version    int64         `json:"version"`
+	ModifiedBy string        `json:"modified_by"`
+	Modified   time.Time     `json:"modified"`
+	Deleted    bool          `json:"deleted"`
+	Dir        bool          `json:"dir,omitempty"`
+	Metadata   *FileMetadata `json:"metadata,omitempty"`
+}
+
+// ListFilesRequest lists the files stored under Path, the whole account when it's empty.
+type ListFilesRequest struct {
+	ClientRequest
+	Path    string `json:",omitempty"`
+	Deleted bool   `json:",omitempty"`
+}
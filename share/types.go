@@ -9,6 +9,8 @@ type ResponseStatus string
 const (
 	Success ResponseStatus = "success"
 	Failure ResponseStatus = "failure"
+	// the file asked for doesn't exist anymore, a change that followed superseded the request
+	NotFound ResponseStatus = "not_found"
 )
 
 type ServerResponse struct {
@@ -17,33 +19,87 @@ type ServerResponse struct {
 }
 
 type ClientRequest struct {
-	ClientId string
-	Time     time.Time
-	Agent    string
+	ClientId     string
+	Time         time.Time
+	Agent        string
+	TransferMode TransferMode `json:",omitempty"`
+	// compression the client accepts for its transfers
+	Compression string `json:",omitempty"`
+	// device of the account sending the request, the server keeps the change feed of every device
+	DeviceId string `json:",omitempty"`
 }
 
+const (
+	// MoveChange is a file or folder renamed or moved inside the sync folders, FileName is the new name and OldPath the path it had.
+	MoveChange = "MOVE"
+	// folders are created empty, removing one removes everything under it
+	DirCreateChange = "MKDIR"
+	DirRemoveChange = "RMDIR"
+)
+
 type ChangeRequestChange struct {
 	FileName    string
 	ChangeEvent string
 	Agent       string
+	OldPath     string `json:",omitempty"`
+	// content of a moved file, lets the server recognise a move it already applied
+	Digest   string        `json:",omitempty"`
+	Metadata *FileMetadata `json:",omitempty"`
+	// a moved folder, everything under OldPath moves along
+	Dir bool `json:",omitempty"`
 }
 type ChangeRequest struct {
 	ClientRequest
 	Dir     string
 	Changes []ChangeRequestChange
 }
-type ChangeResponse map[string]int
+type ChangeResponse map[string]TransferInfo
 
 type SyncResponse struct {
 	Dir     string
 	Changes []ChangeRequestChange
+	// the server that recorded the changes and their position in its log, acknowledged once they are applied
+	ServerId string `json:",omitempty"`
+	Seq      int64  `json:",omitempty"`
+	// the device the changes came from, it already has them
+	DeviceId string `json:",omitempty"`
+}
+
+// AckRequest acknowledges the change feed of the device up to and including the position in the log of every server.
+type AckRequest struct {
+	ClientRequest
+	Seqs map[string]int64
+}
+
+// ChangeNotification tells the devices of an account the server recorded changes they should sync.
+type ChangeNotification struct {
+	ClientId string
+	Dir      string
+	Agent    string
+	Time     time.Time
+}
+
+// ChangeNotifySubject is the subject the changes of an account are announced on.
+func ChangeNotifySubject(clientId string) string {
+	return "change-notify." + clientId
+}
+
+// UploadRequest asks for a new transfer of a file whose change is already recorded, a failed upload is retried with it.
+type UploadRequest struct {
+	ClientRequest
+	FilePath string
+}
+
+type UploadResponse struct {
+	TransferInfo
 }
 
 type DownloadRequest struct {
 	ClientRequest
 	FilePath string
+	Delta    bool `json:",omitempty"`
 }
 
 type DownloadResponse struct {
-	Port int
+	TransferInfo
 }
@@ -0,0 +1,18 @@
+package share
+
+import "time"
+
+type FileVersion struct {
+	Id     string `json:"id"`
+	Size   int64  `json:"size"`
+	Digest string `json:"digest"`
+	// when the version was replaced by a newer one
+	Time time.Time `json:"time"`
+}
+
+// VersionRequest addresses a synced file by its local path, VersionId is empty when listing.
+type VersionRequest struct {
+	ClientRequest
+	FilePath  string
+	VersionId string `json:",omitempty"`
+}